@@ -0,0 +1,360 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the HTTP API used to control the daemon.
+//
+//	GET    /api/jobs               the queue followed by the history
+//	POST   /api/jobs               add an NZB, uploaded as the "nzb" form file
+//	                               or read from the local file in "path".
+//	                               "name", "category" and "priority" are optional.
+//	                               Local files can only be added when an API key
+//	                               is configured, since any file the daemon can
+//	                               read could be asked for.
+//	GET    /api/jobs/{id}          a single job, with its progress if it is running
+//	DELETE /api/jobs/{id}          cancel a job. With delete=1 its files are removed too.
+//	POST   /api/jobs/{id}/pause
+//	POST   /api/jobs/{id}/resume
+//	POST   /api/jobs/{id}/priority set the priority to the "priority" form value
+//	GET    /api/limits             the speed limits in bytes per second
+//	PUT    /api/limits             change the speed limits, taking the same JSON
+//	POST   /api/pause              stop downloading until resumed
+//	POST   /api/resume
+//	GET    /api/status             whether the queue is paused, the current speed,
+//	                               the speed over the last few minutes and the limits
+//	GET    /api/log                recent log output
+//	GET    /api/categories         the configured categories
+//
+// Responses are JSON. Errors are returned as {"Error": "message"}.
+//
+// /api itself is the SABnzbd compatible API, see sab.go. Everything
+// outside of /api is the web interface, see web.go.
+//
+// If an API key is configured, every API request must carry it, either as
+// the apikey parameter or in the X-Api-Key header.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// the largest NZB upload accepted
+const maxUpload = 64 << 20
+
+// jobStatus is the API view of a job.
+type jobStatus struct {
+	queue.Item
+	// Progress is set for the running job.
+	Progress *download.Progress `json:",omitempty"`
+}
+
+type limits struct {
+	// Total is the limit on the combined speed, Server the limit on the
+	// speed from the server. 0 means no limit.
+	Total  int64
+	Server int64
+}
+
+type daemonStatus struct {
+	Paused bool
+	// Speed is the current download speed in bytes per second, and
+	// SpeedHistory the speed measured every second, oldest first.
+	Speed        int64
+	SpeedHistory []int64
+	Limits       limits
+}
+
+type apiError struct {
+	Error string
+}
+
+// serveAPI starts serving the API on addr.
+func (r *runner) serveAPI(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(l, checkAPIKey(config.APIKey, r.apiHandler()))
+		fmt.Fprintln(os.Stderr, err)
+	}()
+	return nil
+}
+
+func (r *runner) apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/jobs", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			r.listJobs(w, req)
+		case "POST":
+			r.addJob(w, req)
+		default:
+			methodNotAllowed(w)
+		}
+	})
+	mux.HandleFunc("/api/jobs/", r.jobHandler)
+	mux.HandleFunc("/api/limits", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			r.getLimits(w, req)
+		case "PUT":
+			r.setLimits(w, req)
+		default:
+			methodNotAllowed(w)
+		}
+	})
+	mux.HandleFunc("/api/pause", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		r.pauseQueue()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/resume", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		r.resumeQueue()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/api/status", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, daemonStatus{
+			Paused:       r.queuePaused(),
+			Speed:        r.currentSpeed(),
+			SpeedHistory: r.speedHistory(),
+			Limits:       limits{Total: r.total.Rate(), Server: r.server.Rate()},
+		})
+	})
+	mux.HandleFunc("/api/log", func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, r.logs.Lines())
+	})
+	mux.HandleFunc("/api/categories", func(w http.ResponseWriter, req *http.Request) {
+		cats := config.Categories
+		if cats == nil {
+			cats = []Category{}
+		}
+		writeJSON(w, http.StatusOK, cats)
+	})
+	mux.HandleFunc("/api", r.sabHandler)
+	// where SABnzbd serves it
+	mux.HandleFunc("/sabnzbd/api", r.sabHandler)
+	mux.Handle("/", webHandler())
+	return mux
+}
+
+// checkAPIKey makes h reject API requests that don't carry key.
+// An empty key lets every request through.
+func checkAPIKey(key string, h http.Handler) http.Handler {
+	if key == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		p := req.URL.Path
+		if p != "/api" && !strings.HasPrefix(p, "/api/") && p != "/sabnzbd/api" {
+			// the web interface asks for the key itself
+			h.ServeHTTP(w, req)
+			return
+		}
+		k := req.Header.Get("X-Api-Key")
+		if k == "" {
+			k = req.URL.Query().Get("apikey")
+		}
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) != 1 {
+			if p == "/api" || p == "/sabnzbd/api" {
+				sabError(w, "API Key Incorrect")
+				return
+			}
+			writeJSON(w, http.StatusUnauthorized, apiError{"missing or incorrect API key"})
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// jobHandler handles the requests under /api/jobs/{id}
+func (r *runner) jobHandler(w http.ResponseWriter, req *http.Request) {
+	rest := strings.TrimPrefix(req.URL.Path, "/api/jobs/")
+	idStr, action := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		idStr, action = rest[:i], rest[i+1:]
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeError(w, queue.ErrNotFound)
+		return
+	}
+	switch {
+	case action == "" && req.Method == "GET":
+		r.getJob(w, id)
+	case action == "" && req.Method == "DELETE":
+		r.cancelJob(w, req, id)
+	case action == "pause" && req.Method == "POST":
+		r.jobAction(w, id, r.pause)
+	case action == "resume" && req.Method == "POST":
+		r.jobAction(w, id, r.resume)
+	case action == "priority" && req.Method == "POST":
+		r.jobAction(w, id, func(id int64) error {
+			p, err := strconv.Atoi(req.FormValue("priority"))
+			if err != nil {
+				return err
+			}
+			return r.q.SetPriority(id, p)
+		})
+	case action == "" || action == "pause" || action == "resume" || action == "priority":
+		methodNotAllowed(w)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if err == queue.ErrNotFound {
+		code = http.StatusNotFound
+	}
+	writeJSON(w, code, apiError{err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+}
+
+var (
+	errNoNzb    = errors.New("no NZB file given")
+	errLocalNzb = errors.New("adding local files needs an API key")
+)
+
+func (r *runner) status(it queue.Item) jobStatus {
+	return jobStatus{Item: it, Progress: r.progress(it.ID)}
+}
+
+func (r *runner) listJobs(w http.ResponseWriter, req *http.Request) {
+	items := r.q.Items()
+	jobs := make([]jobStatus, 0, len(items))
+	for _, it := range items {
+		jobs = append(jobs, r.status(it))
+	}
+	writeJSON(w, http.StatusOK, jobs)
+}
+
+func (r *runner) addJob(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseMultipartForm(maxUpload)
+	if err != nil && err != http.ErrNotMultipart {
+		writeError(w, err)
+		return
+	}
+	var (
+		b    []byte
+		name string
+	)
+	if f, fh, ferr := req.FormFile("nzb"); ferr == nil {
+		b, err = ioutil.ReadAll(f)
+		f.Close()
+		name = nzbName(fh.Filename)
+	} else if path := req.FormValue("path"); path != "" {
+		if config.APIKey == "" {
+			writeJSON(w, http.StatusForbidden, apiError{errLocalNzb.Error()})
+			return
+		}
+		b, err = ioutil.ReadFile(path)
+		name = nzbName(path)
+	} else {
+		err = errNoNzb
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	it := queue.Item{
+		Name:     name,
+		Category: req.FormValue("category"),
+		Priority: *priority,
+	}
+	if n := req.FormValue("name"); n != "" {
+		it.Name = n
+	}
+	setPriority := priorityFlagSet()
+	if p := req.FormValue("priority"); p != "" {
+		it.Priority, err = strconv.Atoi(p)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		setPriority = true
+	}
+	it, err = addNzb(r.q, it, b, setPriority)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, r.status(it))
+}
+
+func (r *runner) getJob(w http.ResponseWriter, id int64) {
+	it, err := r.q.Get(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, r.status(it))
+}
+
+// jobAction handles the requests that change a single job,
+// replying with the job afterwards.
+func (r *runner) jobAction(w http.ResponseWriter, id int64, action func(id int64) error) {
+	err := action(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r.getJob(w, id)
+}
+
+func (r *runner) cancelJob(w http.ResponseWriter, req *http.Request, id int64) {
+	err := r.cancel(id, req.FormValue("delete") == "1")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *runner) getLimits(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, http.StatusOK, limits{Total: r.total.Rate(), Server: r.server.Rate()})
+}
+
+// setLimits changes the speed limits until the config file is reloaded.
+func (r *runner) setLimits(w http.ResponseWriter, req *http.Request) {
+	l := limits{Total: r.total.Rate(), Server: r.server.Rate()}
+	err := json.NewDecoder(req.Body).Decode(&l)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	r.total.SetRate(l.Total)
+	r.server.SetRate(l.Server)
+	r.getLimits(w, req)
+}
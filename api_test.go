@@ -0,0 +1,244 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// apiCall sends a request to the API, decoding the reply into v.
+// Form values are sent in the body.
+func apiCall(t *testing.T, s *httptest.Server, method, path string, form url.Values, code int, v interface{}) {
+	t.Helper()
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, s.URL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("X-Api-Key", config.APIKey)
+	decode(t, req, code, v)
+}
+
+func jobPath(id int64) string {
+	return "/api/jobs/" + strconv.FormatInt(id, 10)
+}
+
+func TestAPIAddUpload(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("nzb", "upload.nzb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(testNzb))
+	mw.WriteField("category", "tv")
+	mw.WriteField("priority", "5")
+	mw.Close()
+	req, err := http.NewRequest("POST", s.URL+"/api/jobs", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var js jobStatus
+	decode(t, req, http.StatusCreated, &js)
+	if js.Name != "upload" || js.Category != "tv" || js.Priority != 5 || js.Status != queue.Pending {
+		t.Errorf("got %+v", js.Item)
+	}
+	if _, err := r.q.Get(js.ID); err != nil {
+		t.Error(err)
+	}
+
+	var e apiError
+	apiCall(t, s, "POST", "/api/jobs", url.Values{}, http.StatusBadRequest, &e)
+	if e.Error != errNoNzb.Error() {
+		t.Errorf("got %q", e.Error)
+	}
+}
+
+func TestAPIAddPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "local.nzb")
+	err := ioutil.WriteFile(path, []byte(testNzb), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without an API key, anyone could read files through the daemon
+	_, s := newAPIServer(t, "")
+	var e apiError
+	apiCall(t, s, "POST", "/api/jobs", url.Values{"path": {path}}, http.StatusForbidden, &e)
+	if e.Error != errLocalNzb.Error() {
+		t.Errorf("got %q", e.Error)
+	}
+
+	r, s := newAPIServer(t, "secret")
+	var js jobStatus
+	apiCall(t, s, "POST", "/api/jobs", url.Values{"path": {path}, "name": {"renamed"}}, http.StatusCreated, &js)
+	if js.Name != "renamed" {
+		t.Errorf("got %+v", js.Item)
+	}
+	if len(r.q.Items()) != 1 {
+		t.Error("job not queued")
+	}
+	apiCall(t, s, "POST", "/api/jobs", url.Values{"path": {path + ".missing"}}, http.StatusBadRequest, nil)
+}
+
+func TestAPIJobs(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	first := addItem(t, r, "first")
+	second := addItem(t, r, "second")
+
+	var jobs []jobStatus
+	apiCall(t, s, "GET", "/api/jobs", nil, http.StatusOK, &jobs)
+	if len(jobs) != 2 || jobs[0].Name != "first" || jobs[1].Name != "second" {
+		t.Fatalf("got %+v", jobs)
+	}
+
+	var js jobStatus
+	apiCall(t, s, "POST", jobPath(second.ID)+"/priority", url.Values{"priority": {"3"}}, http.StatusOK, &js)
+	if js.Priority != 3 {
+		t.Errorf("priority %d", js.Priority)
+	}
+	apiCall(t, s, "POST", jobPath(second.ID)+"/priority", url.Values{"priority": {"high"}}, http.StatusBadRequest, nil)
+	apiCall(t, s, "GET", "/api/jobs", nil, http.StatusOK, &jobs)
+	if jobs[0].Name != "second" {
+		t.Errorf("job with higher priority not first, got %+v", jobs)
+	}
+
+	apiCall(t, s, "POST", jobPath(first.ID)+"/pause", nil, http.StatusOK, &js)
+	if js.Status != queue.Paused {
+		t.Errorf("status %s after pause", js.Status)
+	}
+	// paused jobs can't be paused again
+	apiCall(t, s, "POST", jobPath(first.ID)+"/pause", nil, http.StatusBadRequest, nil)
+	apiCall(t, s, "POST", jobPath(first.ID)+"/resume", nil, http.StatusOK, &js)
+	if js.Status != queue.Pending {
+		t.Errorf("status %s after resume", js.Status)
+	}
+	apiCall(t, s, "GET", jobPath(first.ID), nil, http.StatusOK, &js)
+	if js.ID != first.ID || js.Progress != nil {
+		t.Errorf("got %+v", js)
+	}
+
+	apiCall(t, s, "DELETE", jobPath(first.ID), nil, http.StatusNoContent, nil)
+	apiCall(t, s, "GET", jobPath(first.ID), nil, http.StatusNotFound, nil)
+	apiCall(t, s, "DELETE", jobPath(first.ID), nil, http.StatusNotFound, nil)
+	apiCall(t, s, "GET", "/api/jobs/nonsense", nil, http.StatusNotFound, nil)
+	apiCall(t, s, "PUT", jobPath(second.ID), nil, http.StatusMethodNotAllowed, nil)
+	apiCall(t, s, "POST", jobPath(second.ID)+"/nonsense", nil, http.StatusNotFound, nil)
+}
+
+func TestAPICancelDelete(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	it := addItem(t, r, "cancel")
+	err := os.MkdirAll(it.Dir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCall(t, s, "DELETE", jobPath(it.ID)+"?delete=1", nil, http.StatusNoContent, nil)
+	if _, err := os.Stat(it.Dir); !os.IsNotExist(err) {
+		t.Error("job directory not removed")
+	}
+}
+
+func TestAPILimits(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	var l limits
+	apiCall(t, s, "GET", "/api/limits", nil, http.StatusOK, &l)
+	if l.Total != 0 || l.Server != 0 {
+		t.Errorf("got %+v", l)
+	}
+	req, err := http.NewRequest("PUT", s.URL+"/api/limits", strings.NewReader(`{"Total": 1000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, req, http.StatusOK, &l)
+	// limits that aren't given are left alone
+	if l.Total != 1000 || l.Server != 0 || r.total.Rate() != 1000 {
+		t.Errorf("got %+v", l)
+	}
+	req, err = http.NewRequest("PUT", s.URL+"/api/limits", strings.NewReader(`nonsense`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, req, http.StatusBadRequest, nil)
+	apiCall(t, s, "DELETE", "/api/limits", nil, http.StatusMethodNotAllowed, nil)
+}
+
+func TestAPIPause(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	apiCall(t, s, "POST", "/api/pause", nil, http.StatusNoContent, nil)
+	var st daemonStatus
+	apiCall(t, s, "GET", "/api/status", nil, http.StatusOK, &st)
+	if !st.Paused || !r.queuePaused() {
+		t.Error("queue not paused")
+	}
+	apiCall(t, s, "POST", "/api/resume", nil, http.StatusNoContent, nil)
+	if r.queuePaused() {
+		t.Error("queue not resumed")
+	}
+	apiCall(t, s, "GET", "/api/pause", nil, http.StatusMethodNotAllowed, nil)
+}
+
+func TestAPIAddName(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	add := func(name string, code int, v interface{}) {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("nzb", "upload.nzb")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(testNzb))
+		mw.WriteField("name", name)
+		mw.Close()
+		req, err := http.NewRequest("POST", s.URL+"/api/jobs", &body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		decode(t, req, code, v)
+	}
+	// the job directory stays in the download directory
+	var js jobStatus
+	add("../x", http.StatusCreated, &js)
+	if js.Name != "x" || js.Dir != config.jobDir("", "x") {
+		t.Errorf("got name %q and directory %q", js.Name, js.Dir)
+	}
+	add("..", http.StatusBadRequest, nil)
+	add("/", http.StatusBadRequest, nil)
+
+	// directories outside the download directory are never removed
+	outside := t.TempDir()
+	it, err := r.q.Add(queue.Item{Name: "outside", Dir: outside}, []byte(testNzb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiCall(t, s, "DELETE", jobPath(it.ID)+"?delete=1", nil, http.StatusBadRequest, nil)
+	if _, err := os.Stat(outside); err != nil {
+		t.Error(err)
+	}
+	if _, err := r.q.Get(it.ID); err != nil {
+		t.Error("job removed from the queue")
+	}
+}
@@ -0,0 +1,39 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCategoryDefaults(t *testing.T) {
+	var c Config
+	err := json.Unmarshal([]byte(`{
+		"Unpack": true,
+		"Categories": [
+			{"Name": "tv"},
+			{"Name": "movies", "Repair": false, "Unpack": false}
+		]
+	}`), &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		category       string
+		repair, unpack bool
+	}{
+		{"", true, true},
+		{"tv", true, true},
+		{"movies", false, false},
+	}
+	for _, tt := range tests {
+		if r := c.repair(tt.category); r != tt.repair {
+			t.Errorf("%q: repair is %v", tt.category, r)
+		}
+		if u := c.unpack(tt.category); u != tt.unpack {
+			t.Errorf("%q: unpack is %v", tt.category, u)
+		}
+	}
+}
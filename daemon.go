@@ -0,0 +1,540 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains daemon mode, where gonzbee keeps running and
+// works through a persistent queue of jobs.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// how often the queue is updated with the phase of the running job
+const statusInterval = time.Second
+
+// runner processes the queue, one job at a time.
+type runner struct {
+	q       *queue.Queue
+	d       *download.Downloader
+	display *progressDisplay
+	log     *log.Logger
+	// recent log output
+	logs *logBuffer
+	// the limiters of the downloader, so that they can be changed
+	// through the API
+	total, server *download.Limiter
+
+	// mu also keeps the queue from changing under cancel
+	// while the next job is picked.
+	mu  sync.Mutex
+	id  int64 // id of the running job, set as soon as it is picked
+	job *download.Job
+	// set when the running job is stopped by a pause or cancel,
+	// rather than by us shutting down.
+	interrupt queue.Status
+	// download speed of the running job in bytes per second,
+	// measured every statusInterval
+	speed int64
+	// the speed measured every statusInterval, oldest first
+	speeds []int64
+	// no jobs are started while the queue is paused
+	paused   bool
+	unpaused chan struct{} // closed when the queue is resumed
+}
+
+// cancelled is the interrupt for jobs that should be removed from the queue.
+const cancelled queue.Status = "cancelled"
+
+// the number of speed measurements kept for the web interface
+const maxSpeeds = 300
+
+// runDaemon adds the NZB files given on the command line to the queue and
+// then processes the queue with r until stopping is closed. It returns the exit status.
+func runDaemon(r *runner, stopping <-chan struct{}) int {
+	q, err := queue.Open(config.queueDir())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	r.q = q
+	go r.measureSpeed(stopping)
+	for _, path := range flag.Args() {
+		err := enqueue(q, path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if config.WatchDir != "" {
+		go watch(q, config.WatchDir, config.WatchCategories, stopping)
+	}
+	if *apiAddr != "" {
+		err := r.serveAPI(*apiAddr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	for {
+		r.mu.Lock()
+		paused, unpaused := r.paused, r.unpaused
+		r.mu.Unlock()
+		if paused {
+			select {
+			case <-unpaused:
+				continue
+			case <-stopping:
+				return 0
+			}
+		}
+		// grab the channel before looking in the queue,
+		// so that we don't miss jobs added in between.
+		changed := q.Changed()
+		it, ok, err := r.next()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !ok {
+			select {
+			case <-changed:
+				continue
+			case <-stopping:
+				return 0
+			}
+		}
+		r.run(it)
+		select {
+		case <-stopping:
+			return 0
+		default:
+		}
+	}
+}
+
+// nzbName returns the job name for the NZB file at path.
+func nzbName(path string) string {
+	name := filepath.Base(path)
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".nzb") {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+var errJobName = errors.New("invalid job name")
+
+// jobName returns name without any directories, so that it can
+// be used as the name of the job directory.
+func jobName(name string) (string, error) {
+	name = filepath.Base(filepath.Clean(filepath.FromSlash(name)))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", errJobName
+	}
+	return name, nil
+}
+
+// addNzb checks that b is a valid NZB file and adds it to the queue as it.
+// If no category is set, the category in the NZB file is used if it is a
+// configured one. If setPriority is false, jobs in a configured category
+// get the priority of the category. If no directory is set, the job is
+// downloaded to a directory named after it. The name can come from
+// API clients, so any directories in it are left out.
+func addNzb(q *queue.Queue, it queue.Item, b []byte, setPriority bool) (queue.Item, error) {
+	name, err := jobName(it.Name)
+	if err != nil {
+		return queue.Item{}, err
+	}
+	it.Name = name
+	n, err := nzb.Parse(bytes.NewReader(b))
+	if err != nil {
+		return queue.Item{}, err
+	}
+	if it.Category == "" {
+		if cat := config.category(n.MetaValue("category")); cat != nil {
+			it.Category = cat.Name
+		}
+	}
+	if cat := config.category(it.Category); cat != nil && !setPriority {
+		it.Priority = cat.Priority
+	}
+	if it.Dir == "" {
+		it.Dir = config.jobDir(it.Category, it.Name)
+	}
+	it.Bytes = 0
+	for _, f := range n.File {
+		for _, seg := range f.Segments {
+			it.Bytes += int64(seg.Bytes)
+		}
+	}
+	return q.Add(it, b)
+}
+
+// priorityFlagSet reports whether -priority was given on the command line.
+func priorityFlagSet() bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "priority" {
+			set = true
+		}
+	})
+	return set
+}
+
+// enqueue adds the NZB file at path to the queue.
+func enqueue(q *queue.Queue, path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	it := queue.Item{
+		Name:     nzbName(path),
+		Category: *category,
+		Priority: *priority,
+	}
+	_, err = addNzb(q, it, b, priorityFlagSet())
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if *rm {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// jobOptions returns the download options for jobs in category.
+func jobOptions(category string) []download.JobOption {
+	opts := []download.JobOption{
+		download.WithDirectUnpack(config.DirectUnpack),
+		download.WithDeobfuscate(config.Deobfuscate),
+		download.WithRepair(config.repair(category)),
+		download.WithUnpack(config.unpack(category)),
+	}
+	if cat := config.category(category); cat != nil {
+		opts = append(opts, download.WithDeleteArchives(cat.Delete))
+	}
+	return opts
+}
+
+// next takes the next pending job from the queue and makes it the running one.
+func (r *runner) next() (queue.Item, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	it, ok, err := r.q.Next()
+	if ok {
+		r.id, r.job, r.interrupt = it.ID, nil, ""
+	}
+	return it, ok, err
+}
+
+// run downloads a single job from the queue, keeping
+// its status up to date. It must have been picked by next.
+func (r *runner) run(it queue.Item) {
+	q := r.q
+	n, err := readNzb(q.NZBPath(it.ID))
+	r.mu.Lock()
+	if r.interrupt == cancelled {
+		// cancelled before it started
+		r.id = 0
+		r.mu.Unlock()
+		return
+	}
+	if err != nil {
+		r.id = 0
+		r.mu.Unlock()
+		q.SetStatus(it.ID, queue.Failed, err.Error())
+		if it.Source != "" && config.WatchDir != "" {
+			moveProcessed(config.WatchDir, it.Source, false)
+		}
+		r.runScript(it, err, nil)
+		return
+	}
+	// only directories the daemon made for its jobs are renamed
+	opts := append(jobOptions(it.Category), download.WithRenameDir(config.inJobDir(it.Dir)))
+	job := r.d.Download(n, it.Dir, opts...)
+	r.job = job
+	if r.paused {
+		// paused after we looked
+		job.Stop()
+	}
+	r.mu.Unlock()
+	r.display.setJob(r.d, job)
+	tick := time.NewTicker(statusInterval)
+	defer tick.Stop()
+	var last int64
+	lastTime := time.Now()
+wait:
+	for {
+		select {
+		case <-job.Done():
+			break wait
+		case now := <-tick.C:
+			q.SetStatus(it.ID, phaseStatus(job.Phase()), "")
+			done := job.Progress().BytesDone
+			r.mu.Lock()
+			r.speed = int64(float64(done-last) / now.Sub(lastTime).Seconds())
+			r.mu.Unlock()
+			last, lastTime = done, now
+		}
+	}
+
+	jobErr := job.Wait()
+	r.display.setJob(r.d, nil)
+	r.mu.Lock()
+	interrupt := r.interrupt
+	r.id, r.job, r.speed = 0, nil, 0
+	r.mu.Unlock()
+	switch {
+	case jobErr == nil:
+		r.log.Printf("Finished %q", it.Name)
+	case jobErr != download.ErrStopped:
+		r.log.Printf("%q failed: %v", it.Name, jobErr)
+	}
+	if interrupt == cancelled {
+		// cancel removes it from the queue
+		return
+	}
+	if dir := job.DoneDir(); dir != it.Dir {
+		it.Dir = dir
+		err = q.SetDir(it.ID, it.Dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	switch {
+	case jobErr == download.ErrStopped && interrupt == queue.Paused:
+		err = q.SetStatus(it.ID, queue.Paused, "")
+	case jobErr == download.ErrStopped:
+		// pick it up again next time
+		err = q.SetStatus(it.ID, queue.Pending, "")
+	case jobErr != nil:
+		err = q.SetStatus(it.ID, queue.Failed, jobErr.Error())
+	default:
+		err = q.SetStatus(it.ID, queue.Done, "")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if jobErr == download.ErrStopped {
+		return
+	}
+	if it.Source != "" && config.WatchDir != "" {
+		moveProcessed(config.WatchDir, it.Source, jobErr == nil)
+	}
+	r.runScript(it, jobErr, job)
+}
+
+// runScript runs the post-processing script for the finished job it,
+// if there is one, and records its output in the queue.
+func (r *runner) runScript(it queue.Item, jobErr error, job *download.Job) {
+	script := config.script(it.Category)
+	if script == "" {
+		return
+	}
+	s := &scriptJob{
+		name:     it.Name,
+		dir:      it.Dir,
+		category: it.Category,
+		err:      jobErr,
+		job:      job,
+	}
+	err := r.q.SetScriptLog(it.ID, runScript(script, s, r.log))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// stopJob stops the job with id if it is running, recording what should
+// happen to it afterwards. It returns the stopped download, or nil if
+// the job wasn't running.
+func (r *runner) stopJob(id int64, interrupt queue.Status) *download.Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.id != id || r.job == nil {
+		return nil
+	}
+	r.interrupt = interrupt
+	r.job.Stop()
+	return r.job
+}
+
+// progress returns the progress of the job with id, if it is running.
+func (r *runner) progress(id int64) *download.Progress {
+	r.mu.Lock()
+	job := r.job
+	running := r.id == id && job != nil
+	r.mu.Unlock()
+	if !running {
+		return nil
+	}
+	p := job.Progress()
+	return &p
+}
+
+// pause pauses the job with id. A running job is stopped, and will resume
+// where it left off once it is resumed.
+func (r *runner) pause(id int64) error {
+	if r.stopJob(id, queue.Paused) != nil {
+		return nil
+	}
+	it, err := r.q.Get(id)
+	if err != nil {
+		return err
+	}
+	if it.Status != queue.Pending {
+		return fmt.Errorf("can't pause %s job", it.Status)
+	}
+	return r.q.SetStatus(id, queue.Paused, "")
+}
+
+// resume makes a paused job pending again.
+func (r *runner) resume(id int64) error {
+	it, err := r.q.Get(id)
+	if err != nil {
+		return err
+	}
+	if it.Status != queue.Paused {
+		return fmt.Errorf("can't resume %s job", it.Status)
+	}
+	return r.q.SetStatus(id, queue.Pending, "")
+}
+
+// cancel removes the job with id from the queue, stopping it if it is running.
+// If deleteFiles is set, the job directory is removed as well, as long as it
+// is in the download directory or the directory of a category. An unfinished
+// job from the watch directory has its NZB file moved to the failed
+// subdirectory, so that it isn't picked up again.
+func (r *runner) cancel(id int64, deleteFiles bool) error {
+	// the job is looked up, stopped and removed with r.mu held,
+	// so that it can't be started in between.
+	r.mu.Lock()
+	it, err := r.q.Get(id)
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	if deleteFiles && !config.inJobDir(it.Dir) {
+		r.mu.Unlock()
+		return fmt.Errorf("not removing %s: it isn't in the download directory", it.Dir)
+	}
+	var job *download.Job
+	if r.id == id {
+		// a job that was picked, but not started, never starts
+		r.interrupt = cancelled
+		job = r.job
+		if job != nil {
+			job.Stop()
+		}
+	}
+	if it.Source != "" && config.WatchDir != "" && !it.Status.Finished() {
+		// moved before the job leaves the queue, so that
+		// the watch directory isn't scanned in between.
+		moveProcessed(config.WatchDir, it.Source, false)
+	}
+	err = r.q.Remove(id)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if job != nil {
+		// wait for the files to be closed before removing them
+		job.Wait()
+	}
+	if deleteFiles {
+		return os.RemoveAll(it.Dir)
+	}
+	return nil
+}
+
+// pauseQueue stops the running job and keeps new ones from starting
+// until resumeQueue is called. The stopped job is continued once the
+// queue is resumed.
+func (r *runner) pauseQueue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.paused {
+		return
+	}
+	r.paused = true
+	r.unpaused = make(chan struct{})
+	if r.job != nil {
+		r.job.Stop()
+	}
+}
+
+// resumeQueue resumes a paused queue.
+func (r *runner) resumeQueue() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused {
+		return
+	}
+	r.paused = false
+	close(r.unpaused)
+}
+
+func (r *runner) queuePaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+// measureSpeed records the download speed every statusInterval
+// until stopping is closed.
+func (r *runner) measureSpeed(stopping <-chan struct{}) {
+	tick := time.NewTicker(statusInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-stopping:
+			return
+		}
+		r.mu.Lock()
+		r.speeds = append(r.speeds, r.speed)
+		if over := len(r.speeds) - maxSpeeds; over > 0 {
+			r.speeds = append(r.speeds[:0], r.speeds[over:]...)
+		}
+		r.mu.Unlock()
+	}
+}
+
+// speedHistory returns the recorded download speeds, oldest first.
+func (r *runner) speedHistory() []int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int64{}, r.speeds...)
+}
+
+// currentSpeed returns the download speed of the running job.
+func (r *runner) currentSpeed() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.speed
+}
+
+func phaseStatus(p download.Phase) queue.Status {
+	switch p {
+	case download.PhaseVerifying:
+		return queue.Verifying
+	case download.PhaseRepairing:
+		return queue.Repairing
+	case download.PhaseUnpacking:
+		return queue.Unpacking
+	}
+	return queue.Downloading
+}
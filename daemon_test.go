@@ -0,0 +1,132 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2/par2test"
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+const testNzb = `<?xml version="1.0" encoding="iso-8859-1" ?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<file poster="poster" date="2000000000" subject="Here is your file &quot;example.rar&quot; yEnc (1/1)">
+<groups>
+<group>alt.binaries.example</group>
+</groups>
+<segments>
+<segment bytes="14043" number="1">part1@example</segment>
+</segments>
+</file>
+</nzb>`
+
+// setConfig replaces the config for the duration of the test.
+func setConfig(t *testing.T, c *Config) {
+	old := config
+	config = c
+	t.Cleanup(func() { config = old })
+}
+
+// newTestRunner returns a runner with an empty queue and no running job.
+func newTestRunner(t *testing.T) *runner {
+	q, err := queue.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &runner{
+		q:      q,
+		logs:   newLogBuffer(maxLogLines),
+		total:  download.NewLimiter(0),
+		server: download.NewLimiter(0),
+	}
+}
+
+func TestRunDamaged(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := bytes.Repeat([]byte("PK\x03\x04 not much of a zip"), 1000)
+	n := &nzb.Nzb{File: []*nzb.File{
+		s.AddFile("stuff.par2", par2test.Create(4096, par2test.File{Name: "stuff.zip", Data: data}), 5000),
+		s.AddFile("stuff.zip", data, 5000),
+	}}
+	s.Update(n.File[1].Segments[0].MsgId, func(a *nntptest.Article) { a.Missing = true })
+	b, err := xml.Marshal(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watchDir := t.TempDir()
+	setConfig(t, &Config{WatchDir: watchDir, DownloadDir: t.TempDir(), Unpack: true})
+	r := newTestRunner(t)
+	r.d = download.New(download.WithServer(download.Server{Address: s.Addr}))
+	defer r.d.Close()
+	r.display = &progressDisplay{}
+	r.log = log.New(ioutil.Discard, "", 0)
+	src := filepath.Join(watchDir, "stuff.nzb")
+	err = ioutil.WriteFile(src, b, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := addNzb(r.q, queue.Item{Name: "stuff", Source: src}, b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	it, ok, err := r.next()
+	if !ok || err != nil {
+		t.Fatalf("job not picked: %v", err)
+	}
+	r.run(it)
+	// a job that couldn't be extracted isn't done
+	it, err = r.q.Get(it.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Status != queue.Failed || it.Error != download.ErrDamaged.Error() {
+		t.Errorf("got status %s, error %q", it.Status, it.Error)
+	}
+	if _, err := os.Stat(filepath.Join(watchDir, watchFailed, "stuff.nzb")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancelPicked(t *testing.T) {
+	setConfig(t, &Config{DownloadDir: t.TempDir()})
+	r := newTestRunner(t)
+	r.log = log.New(ioutil.Discard, "", 0)
+	it, err := addNzb(r.q, queue.Item{Name: "picked"}, []byte(testNzb), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, ok, err := r.next()
+	if !ok || err != nil {
+		t.Fatalf("job not picked: %v", err)
+	}
+	// cancelled between being picked and being started
+	err = r.cancel(it.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the job never starts, so it doesn't need a downloader
+	r.run(it)
+	if _, err := os.Stat(it.Dir); !os.IsNotExist(err) {
+		t.Error("job directory created after the job was cancelled")
+	}
+	if _, err := r.q.Get(it.ID); err != queue.ErrNotFound {
+		t.Error("cancelled job still in the queue")
+	}
+	if r.id != 0 {
+		t.Errorf("job %d still running", r.id)
+	}
+}
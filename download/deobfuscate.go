@@ -0,0 +1,311 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// code for giving files with random names their real names back.
+
+package download
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2"
+	"github.com/DanielMorsing/gonzbee/rar"
+)
+
+// WithDeobfuscate sets whether downloaded files whose names look random
+// are renamed to their real names. The names are taken from the par2
+// files, the yEnc headers and the archives themselves. If the job
+// directory has a random name too and WithRenameDir allows it, it is
+// renamed once the job is done, after the title of the NZB file or its
+// largest file. The default is false.
+func WithDeobfuscate(deobfuscate bool) JobOption {
+	return func(j *Job) { j.deobfuscate = deobfuscate }
+}
+
+// WithRenameDir sets whether a job that deobfuscates may rename its
+// directory. Only allow it for directories made for the job alone,
+// not ones the user picked. The new directory is reported by
+// Job.DoneDir. The default is false.
+func WithRenameDir(rename bool) JobOption {
+	return func(j *Job) { j.mayRenameDir = rename }
+}
+
+// the shortest random names recognized
+const minObfuscated = 16
+
+// obfuscated reports whether name looks randomly generated, like a hash.
+// Only the part before the first dot is looked at.
+func obfuscated(name string) bool {
+	stem := name
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		stem = name[:i]
+	}
+	if len(stem) < minObfuscated {
+		return false
+	}
+	letters, digits := 0, 0
+	for _, c := range stem {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letters++
+		default:
+			// real names have words separated by something
+			return false
+		}
+	}
+	return letters > 0 && digits > 0
+}
+
+// uniqueName returns name, or if it is taken, name with a number
+// added before the extension.
+func uniqueName(name string, taken func(string) bool) string {
+	ext := filepath.Ext(name)
+	stem := name[:len(name)-len(ext)]
+	for i := 1; taken(name); i++ {
+		name = stem + "." + strconv.Itoa(i) + ext
+	}
+	return name
+}
+
+// exists reports whether there is a file at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
+
+// cleanName returns the last element of name, or "" if it doesn't
+// make a usable file name.
+func cleanName(name string) string {
+	name = filepath.Base(filepath.Clean(filepath.FromSlash(name)))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return ""
+	}
+	return name
+}
+
+// renameTo renames the file at path to name in the job directory,
+// and returns its new path. Names that are taken get a number added.
+func (j *Job) renameTo(path, name string) string {
+	name = cleanName(name)
+	if name == "" || name == filepath.Base(path) {
+		return path
+	}
+	name = j.claimName(name)
+	newpath := filepath.Join(j.Dir, name)
+	err := os.Rename(path, newpath)
+	if err != nil {
+		j.addErr(err)
+		return path
+	}
+	j.d.log.Printf("Renamed %q to %q", filepath.Base(path), name)
+	return newpath
+}
+
+// restoreNames renames the downloaded files at paths to their real names,
+// and returns their new paths. Files found in the par2 sets are given the
+// names recorded there. Other files with random names are given the name
+// in their yEnc headers, or if it is random too, a name made from the
+// title of the job and the type of archive they are.
+func (j *Job) restoreNames(parfiles map[*nzb.File][]*parfile, paths []string) []string {
+	var fsets []*par2.Fileset
+	for fp := range parfiles {
+		f, err := os.Open(filepath.Join(j.Dir, fp.Subject.Filename()))
+		if err != nil {
+			continue
+		}
+		fsets = append(fsets, par2.NewFileset(f))
+		f.Close()
+	}
+	yencNames := make(map[string]string)
+	j.mu.Lock()
+	for _, f := range j.fileList {
+		f.mu.Lock()
+		yencNames[filepath.Base(f.path)] = f.yencName
+		f.mu.Unlock()
+	}
+	j.mu.Unlock()
+
+	newPaths := make([]string, len(paths))
+	copy(newPaths, paths)
+	// the RAR volumes that are still unnamed, by index into paths
+	var volumes []int
+	for i, path := range paths {
+		name := filepath.Base(path)
+		if real := identify(path, fsets); real != "" {
+			newPaths[i] = j.renameTo(path, real)
+			continue
+		}
+		if !obfuscated(name) {
+			continue
+		}
+		if yname := yencNames[name]; yname != "" && !obfuscated(yname) {
+			newPaths[i] = j.renameTo(path, yname)
+			continue
+		}
+		kind, err := sniffVolumes([]string{path})
+		if err != nil {
+			continue
+		}
+		switch kind {
+		case kindRAR:
+			volumes = append(volumes, i)
+		case kindZip:
+			newPaths[i] = j.renameArchive(path, ".zip")
+		case kind7z:
+			newPaths[i] = j.renameArchive(path, ".7z")
+		}
+	}
+	j.renameVolumes(newPaths, volumes)
+	return newPaths
+}
+
+// identify returns the name that the par2 sets record for the file
+// at path, or "" if it isn't in any of them.
+func identify(path string, fsets []*par2.Fileset) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	for _, fset := range fsets {
+		_, err = f.Seek(0, 0)
+		if err != nil {
+			return ""
+		}
+		if file := fset.Identify(f, fi.Size()); file != nil {
+			return file.Name
+		}
+	}
+	return ""
+}
+
+// title returns a name for the contents of the job, or "" if there is
+// no better one than a random name.
+func (j *Job) title() string {
+	if t := j.nzb.MetaValue("title"); t != "" {
+		return t
+	}
+	if base := filepath.Base(j.Dir); !obfuscated(base) {
+		return base
+	}
+	return ""
+}
+
+// renameArchive names the archive at path after the job.
+func (j *Job) renameArchive(path, ext string) string {
+	t := j.title()
+	if t == "" {
+		return path
+	}
+	return j.renameTo(path, t+ext)
+}
+
+// renameVolumes names the RAR volumes at the indexes into paths after
+// the job, numbering them by the volume numbers in their headers.
+// Volumes of several archives can't be told apart, so nothing is
+// renamed if two volumes have the same number.
+func (j *Job) renameVolumes(paths []string, volumes []int) {
+	t := j.title()
+	if t == "" || len(volumes) == 0 {
+		return
+	}
+	numbers := make(map[int]int)
+	last := 0
+	for _, i := range volumes {
+		f, err := os.Open(paths[i])
+		if err != nil {
+			continue
+		}
+		info, err := rar.ReadVolumeInfo(f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+		if !info.Multi {
+			paths[i] = j.renameTo(paths[i], t+".rar")
+			continue
+		}
+		if info.Number < 0 {
+			continue
+		}
+		if _, ok := numbers[info.Number]; ok {
+			return
+		}
+		numbers[info.Number] = i
+		if info.Number > last {
+			last = info.Number
+		}
+	}
+	digits := len(strconv.Itoa(last + 1))
+	for n, i := range numbers {
+		paths[i] = j.renameTo(paths[i], fmt.Sprintf("%s.part%0*d.rar", t, digits, n+1))
+	}
+}
+
+// partSuffix matches what is left of the name of a RAR volume without its extension.
+var partSuffix = regexp.MustCompile(`(?i)\.part\d+$`)
+
+// renameDir renames a job directory with a random name after the
+// title of the NZB file, or if it has none, after the largest file in it.
+func (j *Job) renameDir() {
+	if !j.mayRenameDir || !obfuscated(filepath.Base(j.Dir)) {
+		return
+	}
+	name := j.nzb.MetaValue("title")
+	if name == "" {
+		name = largestFile(j.Dir)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		name = partSuffix.ReplaceAllString(name, "")
+	}
+	name = cleanName(name)
+	if name == "" || obfuscated(name) {
+		return
+	}
+	parent := filepath.Dir(j.Dir)
+	name = uniqueName(name, func(n string) bool {
+		return exists(filepath.Join(parent, n))
+	})
+	dir := filepath.Join(parent, name)
+	err := os.Rename(j.Dir, dir)
+	if err != nil {
+		j.addErr(err)
+		return
+	}
+	j.d.log.Printf("Renamed job directory %q to %q", filepath.Base(j.Dir), name)
+	j.mu.Lock()
+	j.doneDir = dir
+	j.mu.Unlock()
+}
+
+// largestFile returns the name of the largest file in dir.
+func largestFile(dir string) string {
+	d, err := os.Open(dir)
+	if err != nil {
+		return ""
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return ""
+	}
+	var name string
+	var size int64 = -1
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && fi.Size() > size && !strings.HasPrefix(fi.Name(), ".") {
+			name, size = fi.Name(), fi.Size()
+		}
+	}
+	return name
+}
@@ -0,0 +1,151 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download_test
+
+import (
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2"
+	"github.com/DanielMorsing/gonzbee/par2/par2test"
+)
+
+func randomData(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// obfuscate changes the name in the subject of f.
+func obfuscate(f *nzb.File, name string) {
+	f.Subject = nzb.Subject(`"` + name + `" yEnc (1/1)`)
+}
+
+func TestDeobfuscatePar2(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := randomData(40000, 1)
+	small := randomData(3000, 2)
+	par := par2test.Create(4096, par2test.File{Name: "movie.mkv", Data: data}, par2test.File{Name: "movie.nfo", Data: small})
+	n := &nzb.Nzb{Meta: []nzb.Meta{{Type: "title", Value: "My Movie"}}}
+	n.File = append(n.File,
+		s.AddFile("8f2a9c1b7d3e6f4a0b5c.par2", par, 5000),
+		s.AddFile("3c9d8e7f6a5b4c3d2e1f", data, 5000),
+		s.AddFile("0a1b2c3d4e5f6a7b8c9d", small, 5000),
+	)
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "c0ffee1234567890abcdef")
+	job := newDownloader(s).Download(n, dir, WithDeobfuscate(true), WithRenameDir(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.DoneDir() != filepath.Join(parent, "My Movie") || job.Dir != dir {
+		t.Fatalf("job directory not renamed: %s", job.DoneDir())
+	}
+	checkFile(t, filepath.Join(job.DoneDir(), "movie.mkv"), data)
+	checkFile(t, filepath.Join(job.DoneDir(), "movie.nfo"), small)
+	// the renamed files were verified under their new names
+	if job.ParStatus() != ParVerified {
+		t.Errorf("par status %v", job.ParStatus())
+	}
+	results := job.ParResults()
+	if len(results) != 2 {
+		t.Fatalf("got %d par2 results, expected 2", len(results))
+	}
+	for _, m := range results {
+		if m.Status != par2.StatusComplete {
+			t.Errorf("%s: %v", m.File.Name, m.Status)
+		}
+	}
+}
+
+func TestDeobfuscateYenc(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	f := s.AddFile("readme.txt", []byte("read me\n"), 5000)
+	obfuscate(f, "b7e23c91d04a58f6e2a1")
+	n.File = append(n.File, f)
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "b7e23c91d04a58f6e2a1")
+	job := newDownloader(s).Download(n, dir, WithDeobfuscate(true), WithRenameDir(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without a title, the directory is named after the largest file
+	if job.DoneDir() != filepath.Join(parent, "readme") {
+		t.Fatalf("job directory not renamed: %s", job.DoneDir())
+	}
+	checkFile(t, filepath.Join(job.DoneDir(), "readme.txt"), []byte("read me\n"))
+}
+
+func TestDeobfuscateKeepsDir(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	f := s.AddFile("readme.txt", []byte("read me\n"), 5000)
+	obfuscate(f, "b7e23c91d04a58f6e2a1")
+	n.File = append(n.File, f)
+
+	// a directory that wasn't made for the job is never renamed
+	dir := filepath.Join(t.TempDir(), "b7e23c91d04a58f6e2a1")
+	job := newDownloader(s).Download(n, dir, WithDeobfuscate(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.DoneDir() != dir {
+		t.Fatalf("job directory renamed to %s", job.DoneDir())
+	}
+	checkFile(t, filepath.Join(dir, "readme.txt"), []byte("read me\n"))
+}
+
+func TestDeobfuscateArchive(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{Meta: []nzb.Meta{{Type: "title", Value: "Big File"}}}
+	// the volumes are posted out of order, with random names everywhere
+	names := map[string]string{
+		"multi5.part3.rar": "9e8d7c6b5a4f3e2d1c0b",
+		"multi5.part1.rar": "1a2b3c4d5e6f7a8b9c0d",
+		"multi5.part2.rar": "5f4e3d2c1b0a9f8e7d6c",
+	}
+	for _, vol := range []string{"multi5.part3.rar", "multi5.part1.rar", "multi5.part2.rar"} {
+		b, err := ioutil.ReadFile(filepath.Join("..", "rar", "testdata", vol))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.File = append(n.File, s.AddFile(names[vol], b, 5000))
+	}
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithDeobfuscate(true), WithUnpack(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"Big File.part1.rar", "Big File.part2.rar", "Big File.part3.rar"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 30000 || crc32.ChecksumIEEE(b) != 0x8bd8dad2 {
+		t.Error("big.bin extracted wrong")
+	}
+}
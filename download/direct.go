@@ -0,0 +1,163 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// code for extracting RAR archives while the job is still downloading.
+
+package download
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/DanielMorsing/gonzbee/rar"
+)
+
+// WithDirectUnpack sets whether RAR archives are extracted while the job
+// is downloading, reading each volume as soon as it is done. If a volume
+// is damaged or missing, direct unpack of the archive pauses. The files
+// extracted from it so far are kept, and the rest of it is extracted with
+// the other archives once the job is done, after the volumes have been
+// verified and renamed. Damaged volumes aren't repaired, so the rest of
+// an archive that the par2 files say is damaged isn't extracted. It has
+// no effect unless the job unpacks. The default is false.
+func WithDirectUnpack(direct bool) JobOption {
+	return func(j *Job) { j.directUnpack = direct }
+}
+
+var (
+	errVolumeDamaged = errors.New("volume is damaged")
+	errVolumeMissing = errors.New("volume was not downloaded")
+)
+
+// directUnpacker extracts the RAR archives of a job as their volumes are done.
+type directUnpacker struct {
+	j  *Job
+	wg sync.WaitGroup
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// the files that are done, and whether they are damaged
+	done map[string]bool
+	// set once no more files will be done
+	finished bool
+	// the first volumes of the archives started, and of those extracted
+	started   map[string]bool
+	extracted map[string]bool
+	// the paths of the files extracted from archives that were paused,
+	// by their first volumes
+	partial map[string][]string
+}
+
+func newDirectUnpacker(j *Job) *directUnpacker {
+	u := &directUnpacker{
+		j:         j,
+		done:      make(map[string]bool),
+		started:   make(map[string]bool),
+		extracted: make(map[string]bool),
+		partial:   make(map[string][]string),
+	}
+	u.cond = sync.NewCond(&u.mu)
+	return u
+}
+
+// fileDone is called when the file called name is in place.
+func (u *directUnpacker) fileDone(name string, damaged bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.done[name] = damaged
+	u.cond.Broadcast()
+	if damaged || u.finished || u.started[name] || !rar.IsFirstVolume(name) {
+		return
+	}
+	u.started[name] = true
+	u.wg.Add(1)
+	go u.extract(name)
+}
+
+// finish waits for the archives being extracted. Volumes that aren't
+// done by now won't be, so extracting archives that need them stops.
+func (u *directUnpacker) finish() {
+	u.mu.Lock()
+	u.finished = true
+	u.cond.Broadcast()
+	u.mu.Unlock()
+	u.wg.Wait()
+}
+
+// wasExtracted reports whether the archive whose first volume is at path
+// has been extracted.
+func (u *directUnpacker) wasExtracted(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.extracted[filepath.Base(path)]
+}
+
+// partlyExtracted returns the paths of the files extracted from the
+// archive whose first volume is at path, if extracting it was paused.
+func (u *directUnpacker) partlyExtracted(path string) map[string]bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	paths := u.partial[filepath.Base(path)]
+	if paths == nil {
+		return nil
+	}
+	done := make(map[string]bool, len(paths))
+	for _, p := range paths {
+		done[p] = true
+	}
+	return done
+}
+
+// extract extracts the archive whose first volume is called first.
+func (u *directUnpacker) extract(first string) {
+	defer u.wg.Done()
+	j := u.j
+	kind, err := sniffVolumes([]string{filepath.Join(j.Dir, first)})
+	if err != nil || kind != kindRAR {
+		return
+	}
+	r, err := rar.NewReader(func(n int) (io.ReadCloser, error) {
+		return u.openVolume(rar.VolumeName(first, n))
+	})
+	if err == nil {
+		var written []string
+		written, err = j.extractFiles(&rarReader{r, r}, nil)
+		r.Close()
+		if err != nil {
+			// the files written are whole, so the rest of the
+			// archive picks up after them once the job is done.
+			u.mu.Lock()
+			u.partial[first] = written
+			u.mu.Unlock()
+		}
+	}
+	if err != nil {
+		j.d.log.Printf("Pausing direct unpack of %q until the job is done: %v", first, err)
+		return
+	}
+	j.d.log.Printf("Done unpacking %q", first)
+	u.mu.Lock()
+	u.extracted[first] = true
+	u.mu.Unlock()
+}
+
+// openVolume waits for the volume called name to be done and opens it.
+func (u *directUnpacker) openVolume(name string) (io.ReadCloser, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for {
+		if damaged, ok := u.done[name]; ok {
+			if damaged {
+				return nil, errVolumeDamaged
+			}
+			return os.Open(filepath.Join(u.j.Dir, name))
+		}
+		if u.finished {
+			return nil, errVolumeMissing
+		}
+		u.cond.Wait()
+	}
+}
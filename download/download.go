@@ -0,0 +1,783 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package download downloads the files described by NZB files from
+// an NNTP server, and uses the par2 files in the NZB to figure out how
+// many recovery blocks to fetch.
+//
+// A Downloader holds the connections to the server and can run several
+// jobs at once:
+//
+//	d := download.New(download.WithServer(download.Server{Address: "news.example.com:119"}))
+//	job := d.Download(n, "/tmp/example")
+//	err := job.Wait()
+package download
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DanielMorsing/gonzbee/nntp"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2"
+	"github.com/DanielMorsing/gonzbee/yenc"
+)
+
+// Server describes the NNTP server to download from.
+type Server struct {
+	// Address in host:port form.
+	Address  string
+	Username string
+	Password string
+	TLS      bool
+	// Dialer is used to establish connections. If nil, a net.Dialer is used.
+	Dialer nntp.Dialer
+	// Limiter, if non-nil, limits how fast data is read from this server.
+	Limiter *Limiter
+}
+
+// Downloader downloads NZB jobs. It is safe for concurrent use, and
+// jobs started on the same Downloader share its connections.
+type Downloader struct {
+	server   Server
+	maxConns int
+	pipeline int
+	parOnly  bool
+	log      *log.Logger
+	limiter  *Limiter
+	pool     *pool
+
+	mu     sync.Mutex
+	jobs   map[*Job]bool
+	closed bool
+}
+
+var (
+	// ErrStopped is returned by Job.Wait when the job was stopped.
+	ErrStopped = errors.New("download: job stopped")
+	// ErrClosed is returned by Job.Wait for jobs started on a closed Downloader.
+	ErrClosed = errors.New("download: downloader closed")
+)
+
+// An Option configures a Downloader.
+type Option func(*Downloader)
+
+// WithServer sets the server to download from.
+func WithServer(s Server) Option {
+	return func(d *Downloader) { d.server = s }
+}
+
+// WithConnections sets the maximum number of connections to the server.
+// The default is 20.
+func WithConnections(n int) Option {
+	return func(d *Downloader) { d.maxConns = n }
+}
+
+// WithPipeline sets how many requests can be outstanding on a single
+// connection. The default is 10.
+func WithPipeline(n int) Option {
+	return func(d *Downloader) { d.pipeline = n }
+}
+
+// WithParOnly makes jobs only download the par2 files.
+func WithParOnly(parOnly bool) Option {
+	return func(d *Downloader) { d.parOnly = parOnly }
+}
+
+// WithLimiter limits how fast data is read from all connections of the
+// Downloader. It is applied in addition to the limiter of the server.
+func WithLimiter(l *Limiter) Option {
+	return func(d *Downloader) { d.limiter = l }
+}
+
+// WithLogger sets the logger that progress messages and errors are
+// written to. By default, nothing is logged.
+func WithLogger(l *log.Logger) Option {
+	return func(d *Downloader) { d.log = l }
+}
+
+// New returns a Downloader configured by opts.
+func New(opts ...Option) *Downloader {
+	d := &Downloader{
+		maxConns: 20,
+		pipeline: 10,
+		log:      log.New(ioutil.Discard, "", 0),
+		jobs:     make(map[*Job]bool),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+	var limiters []*Limiter
+	for _, l := range []*Limiter{d.server.Limiter, d.limiter} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	d.pool = newPool(d.server, limiters, d.maxConns, d.pipeline)
+	return d
+}
+
+// Job is a single NZB being downloaded.
+type Job struct {
+	// Name is the name of the job, taken from the directory it downloads to.
+	Name string
+	// Dir is the directory that files are downloaded to.
+	Dir string
+
+	d              *Downloader
+	nzb            *nzb.Nzb
+	done           chan struct{}
+	stop           chan struct{}
+	stopOnce       sync.Once
+	filewg         sync.WaitGroup
+	resume         *resumeState
+	err            error
+	repair         bool
+	unpack         bool
+	deleteArchives bool
+	directUnpack   bool
+	direct         *directUnpacker
+	deobfuscate    bool
+	mayRenameDir   bool
+
+	// the names of the files of the job, so that files
+	// being renamed don't take the name of another
+	namesMu sync.Mutex
+	names   map[string]bool
+
+	// the files counted in the progress before they were started.
+	// It isn't changed once the job is running.
+	planned map[*nzb.File]bool
+
+	mu       sync.Mutex
+	errs     []error
+	fileList []*file
+	verified []*par2.FileMatch
+	doneDir  string
+
+	phase          int32
+	parStatus      int32
+	blocksNeeded   int64
+	files          int64
+	filesDone      int64
+	segments       int64
+	segmentsDone   int64
+	segmentsFailed int64
+	bytes          int64
+	bytesDone      int64
+}
+
+// Phase is the stage a job is in.
+type Phase int32
+
+const (
+	PhaseDownloading Phase = iota
+	// the downloaded files are verified against the par2 files
+	PhaseVerifying
+	// recovery blocks are being downloaded to repair damaged files
+	PhaseRepairing
+	// the downloaded archives are being extracted
+	PhaseUnpacking
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseDownloading:
+		return "downloading"
+	case PhaseVerifying:
+		return "verifying"
+	case PhaseRepairing:
+		return "repairing"
+	case PhaseUnpacking:
+		return "unpacking"
+	}
+	return "Phase(" + strconv.Itoa(int(p)) + ")"
+}
+
+// Phase returns the stage the job is in.
+func (j *Job) Phase() Phase {
+	return Phase(atomic.LoadInt32(&j.phase))
+}
+
+func (j *Job) setPhase(p Phase) {
+	atomic.StoreInt32(&j.phase, int32(p))
+}
+
+// ParStatus is the outcome of verifying a job against its par2 files.
+type ParStatus int32
+
+const (
+	// the job had no par2 files to verify against, or wasn't verified
+	ParNone ParStatus = iota
+	// every file matched the par2 files
+	ParVerified
+	// some files are damaged, and enough recovery blocks were
+	// downloaded to repair them
+	ParRepairable
+	// some files are damaged beyond what the recovery blocks can repair
+	ParUnrepairable
+)
+
+func (p ParStatus) String() string {
+	switch p {
+	case ParNone:
+		return "none"
+	case ParVerified:
+		return "verified"
+	case ParRepairable:
+		return "repairable"
+	case ParUnrepairable:
+		return "unrepairable"
+	}
+	return "ParStatus(" + strconv.Itoa(int(p)) + ")"
+}
+
+// ParStatus returns the result of verifying the job. If the job has
+// several par2 sets, the worst result is returned.
+func (j *Job) ParStatus() ParStatus {
+	return ParStatus(atomic.LoadInt32(&j.parStatus))
+}
+
+// BlocksNeeded returns the number of recovery blocks needed to
+// repair the damaged files of the job.
+func (j *Job) BlocksNeeded() int {
+	return int(atomic.LoadInt64(&j.blocksNeeded))
+}
+
+// ParResults returns the result of verifying each file in the par2 sets
+// of the job. It is empty if the job wasn't verified.
+func (j *Job) ParResults() []*par2.FileMatch {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]*par2.FileMatch(nil), j.verified...)
+}
+
+// DoneDir returns the directory that the files of the job are in.
+// It is Dir, unless the job has renamed its directory.
+func (j *Job) DoneDir() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.doneDir != "" {
+		return j.doneDir
+	}
+	return j.Dir
+}
+
+// setParStatus records the result of verifying a par2 set.
+// Only the worst result is kept.
+func (j *Job) setParStatus(p ParStatus, blocksNeeded int) {
+	atomic.AddInt64(&j.blocksNeeded, int64(blocksNeeded))
+	for {
+		old := atomic.LoadInt32(&j.parStatus)
+		if ParStatus(old) >= p || atomic.CompareAndSwapInt32(&j.parStatus, old, int32(p)) {
+			return
+		}
+	}
+}
+
+// Progress is a snapshot of how far along a job is.
+// Byte counts are measured using the segment sizes in the NZB file.
+// The totals are of every file that the job downloads from the start,
+// except for recovery volumes, which are added once they are needed.
+// Files that were already in the job directory count as done.
+type Progress struct {
+	Files          int
+	FilesDone      int
+	Segments       int
+	SegmentsDone   int
+	SegmentsFailed int
+	Bytes          int64
+	BytesDone      int64
+	// FileProgress has an entry for every file started,
+	// in the order they were started.
+	FileProgress []FileProgress
+}
+
+// FileProgress is a snapshot of how far along a single file is.
+type FileProgress struct {
+	Name           string
+	Segments       int
+	SegmentsDone   int
+	SegmentsFailed int
+	Bytes          int64
+	BytesDone      int64
+	// Done is set once the file has been moved into place.
+	Done bool
+}
+
+// A JobOption configures a single job.
+type JobOption func(*Job)
+
+// WithRepair sets whether the job verifies the downloaded files against
+// the par2 files and fetches the recovery blocks needed to repair them.
+// The default is true.
+func WithRepair(repair bool) JobOption {
+	return func(j *Job) { j.repair = repair }
+}
+
+// Download starts downloading the files in n into dir and returns
+// a handle for the running job. The NZB must not be modified while the
+// job is running.
+func (d *Downloader) Download(n *nzb.Nzb, dir string, opts ...JobOption) *Job {
+	j := &Job{
+		Name:   filepath.Base(dir),
+		Dir:    dir,
+		d:      d,
+		nzb:    n,
+		done:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		repair: true,
+	}
+	for _, o := range opts {
+		o(j)
+	}
+	// the progress is of the whole job from the start, not just of the
+	// files started so far. Recovery volumes are only counted once they
+	// turn out to be needed.
+	j.planned = make(map[*nzb.File]bool)
+	for _, f := range n.File {
+		s := parregexp.FindStringSubmatch(f.Subject.Filename())
+		isPar, isVolume := s != nil, s != nil && s[1] != ""
+		if (d.parOnly && isPar) || (!d.parOnly && !isVolume) {
+			j.planned[f] = true
+			j.count(f, 1)
+		}
+	}
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		j.err = ErrClosed
+		close(j.done)
+		return j
+	}
+	d.jobs[j] = true
+	d.mu.Unlock()
+
+	go func() {
+		err := j.run()
+		j.filewg.Wait()
+		if j.resume != nil {
+			serr := j.resume.save()
+			if serr != nil {
+				j.addErr(serr)
+			}
+		}
+		if err == nil && j.stopped() {
+			err = ErrStopped
+		}
+		if err == nil && j.deobfuscate {
+			j.renameDir()
+		}
+		j.err = err
+		d.mu.Lock()
+		delete(d.jobs, j)
+		d.mu.Unlock()
+		close(j.done)
+	}()
+	return j
+}
+
+// Connections returns the number of open connections to the server.
+func (d *Downloader) Connections() int {
+	return d.pool.active()
+}
+
+// Stop stops every running job. See Job.Stop.
+func (d *Downloader) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for j := range d.jobs {
+		j.Stop()
+	}
+}
+
+// Close stops every running job, waits for them to finish and ends
+// the sessions with the server. Jobs started after Close fail with ErrClosed.
+func (d *Downloader) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	jobs := make([]*Job, 0, len(d.jobs))
+	for j := range d.jobs {
+		jobs = append(jobs, j)
+	}
+	d.mu.Unlock()
+	for _, j := range jobs {
+		j.Stop()
+		j.Wait()
+	}
+	d.pool.close()
+	return nil
+}
+
+// Stop makes the job stop requesting segments. Segments that have already
+// been requested are written out, and the state of unfinished files is
+// saved in the job directory, so that downloading the same NZB into the
+// directory later resumes where it left off. Wait returns ErrStopped for
+// a stopped job.
+func (j *Job) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+func (j *Job) stopped() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that is closed when the job has finished.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Wait waits for the job to finish and returns the error that stopped
+// it, if any. Errors that did not stop the job, like missing articles,
+// are available from Errors.
+func (j *Job) Wait() error {
+	<-j.done
+	return j.err
+}
+
+// Errors returns the errors encountered so far.
+func (j *Job) Errors() []error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]error(nil), j.errs...)
+}
+
+// Progress returns the current progress of the job.
+func (j *Job) Progress() Progress {
+	j.mu.Lock()
+	files := make([]FileProgress, 0, len(j.fileList))
+	for _, f := range j.fileList {
+		files = append(files, f.progress())
+	}
+	j.mu.Unlock()
+	return Progress{
+		FileProgress:   files,
+		Files:          int(atomic.LoadInt64(&j.files)),
+		FilesDone:      int(atomic.LoadInt64(&j.filesDone)),
+		Segments:       int(atomic.LoadInt64(&j.segments)),
+		SegmentsDone:   int(atomic.LoadInt64(&j.segmentsDone)),
+		SegmentsFailed: int(atomic.LoadInt64(&j.segmentsFailed)),
+		Bytes:          atomic.LoadInt64(&j.bytes),
+		BytesDone:      atomic.LoadInt64(&j.bytesDone),
+	}
+}
+
+func (j *Job) addErr(err error) {
+	j.d.log.Println(err)
+	j.mu.Lock()
+	j.errs = append(j.errs, err)
+	j.mu.Unlock()
+}
+
+// download all the files contained in an nzb,
+func (j *Job) run() error {
+	// if the directory already exist, assume that it's an old download that was canceled
+	// and restarted.
+	err := os.MkdirAll(j.Dir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	j.resume = loadResume(j.Dir)
+	j.names = make(map[string]bool)
+	for _, file := range j.nzb.File {
+		j.names[j.doneName(file)] = true
+	}
+	if j.unpack && j.directUnpack {
+		j.direct = newDirectUnpacker(j)
+	}
+	parfiles := filterPars(j.nzb)
+	err = j.downloadAll(parfiles)
+	if j.direct != nil {
+		// volumes that aren't done by now won't be
+		j.direct.finish()
+	}
+	if err != nil || j.d.parOnly {
+		return err
+	}
+
+	// create a list of files downloaded
+	var paths []string
+	for _, file := range j.nzb.File {
+		paths = append(paths, j.filePath(file))
+	}
+	if j.deobfuscate {
+		paths = j.restoreNames(parfiles, paths)
+	}
+	if j.repair {
+		err = j.verify(parfiles, paths)
+		if err != nil {
+			return err
+		}
+	}
+	if j.unpack {
+		// wait for the recovery files too
+		j.filewg.Wait()
+		return j.unpackAll()
+	}
+	return nil
+}
+
+// downloadAll downloads the par2 files and then the rest of the files,
+// or the par2 files and their recovery volumes if the downloader only
+// downloads par2 files, and waits for them to be done.
+func (j *Job) downloadAll(parfiles map[*nzb.File][]*parfile) error {
+	for file := range parfiles {
+		err := j.downloadFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	files := j.nzb.File
+	if j.d.parOnly {
+		files = nil
+		for _, pfiles := range parfiles {
+			for _, f := range pfiles {
+				files = append(files, f.file)
+			}
+		}
+	}
+	for _, file := range files {
+		err := j.downloadFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	j.filewg.Wait()
+	return nil
+}
+
+// verify verifies the files at paths against the par2 sets and downloads
+// the recovery files needed to repair them.
+func (j *Job) verify(parfiles map[*nzb.File][]*parfile, paths []string) error {
+	for fp, set := range parfiles {
+		if j.stopped() {
+			return ErrStopped
+		}
+		j.setPhase(PhaseVerifying)
+		var n int
+		var err error
+		// volumes downloaded because the par2 file couldn't be
+		// verified against on its own.
+		var vols []*parfile
+		for {
+			paths, n, err = j.verifyPar(fp, vols, paths)
+			if err != errCantVerify {
+				break
+			}
+			// every recovery volume holds the list of files too,
+			// so try again with the smallest one.
+			v := smallestPar(without(set, vols))
+			if v == nil {
+				break
+			}
+			j.d.log.Printf("Can't verify with %q, downloading %q", fp.Subject.Filename(), v.file.Subject.Filename())
+			err = j.downloadFile(v.file)
+			if err != nil {
+				return err
+			}
+			j.filewg.Wait()
+			vols = append(vols, v)
+		}
+		if err == errCantVerify {
+			continue
+		} else if err != nil {
+			j.addErr(err)
+			continue
+		}
+		available := 0
+		for _, p := range set {
+			available += p.n
+		}
+		switch {
+		case n == 0:
+			j.setParStatus(ParVerified, 0)
+		case available >= n:
+			j.setParStatus(ParRepairable, n)
+		default:
+			j.setParStatus(ParUnrepairable, n)
+		}
+		// the volumes already downloaded count towards the blocks needed
+		for _, v := range vols {
+			n -= v.n
+		}
+		files := selectPars(without(set, vols), n)
+		if len(files) != 0 {
+			j.setPhase(PhaseRepairing)
+		}
+
+		for _, file := range files {
+			err = j.downloadFile(file)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filePath returns where nzbfile was downloaded to.
+func (j *Job) filePath(nzbfile *nzb.File) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, f := range j.fileList {
+		if f.nzbfile == nzbfile {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			return f.path
+		}
+	}
+	return filepath.Join(j.Dir, j.doneName(nzbfile))
+}
+
+// fileDone is called when a file of the job is in place. damaged
+// reports whether some of its segments couldn't be downloaded.
+func (j *Job) fileDone(name string, damaged bool) {
+	if j.direct != nil {
+		j.direct.fileDone(name, damaged)
+	}
+}
+
+// count adds nzbfile to the progress of the job, or
+// takes it out again if n is -1.
+func (j *Job) count(nzbfile *nzb.File, n int64) {
+	atomic.AddInt64(&j.files, n)
+	atomic.AddInt64(&j.segments, n*int64(len(nzbfile.Segments)))
+	atomic.AddInt64(&j.bytes, n*fileBytes(nzbfile))
+}
+
+// fileBytes returns the size of the segments of nzbfile.
+func fileBytes(nzbfile *nzb.File) int64 {
+	var n int64
+	for _, seg := range nzbfile.Segments {
+		n += int64(seg.Bytes)
+	}
+	return n
+}
+
+// download a single file contained in an nzb.
+// Only errors that should stop the job are returned.
+func (j *Job) downloadFile(nzbfile *nzb.File) error {
+	if j.stopped() {
+		return ErrStopped
+	}
+	planned := j.planned[nzbfile]
+	file, err := j.newFile(nzbfile)
+	if err == errExist {
+		if planned {
+			// already there, so it is as good as downloaded
+			atomic.AddInt64(&j.filesDone, 1)
+			atomic.AddInt64(&j.segmentsDone, int64(len(nzbfile.Segments)))
+			atomic.AddInt64(&j.bytesDone, fileBytes(nzbfile))
+		}
+		j.fileDone(j.doneName(nzbfile), false)
+		return nil
+	} else if err != nil {
+		if planned {
+			j.count(nzbfile, -1)
+		}
+		j.addErr(err)
+		return nil
+	}
+	if !planned {
+		j.count(nzbfile, 1)
+	}
+	for _, seg := range nzbfile.Segments {
+		file.bytes += int64(seg.Bytes)
+		if file.skip[seg.MsgId] {
+			atomic.AddInt64(&j.segmentsDone, 1)
+			atomic.AddInt64(&j.bytesDone, int64(seg.Bytes))
+			file.segmentsDone++
+			file.bytesDone += int64(seg.Bytes)
+		}
+	}
+	j.mu.Lock()
+	j.fileList = append(j.fileList, file)
+	j.mu.Unlock()
+	for _, seg := range nzbfile.Segments {
+		if file.skip[seg.MsgId] {
+			continue
+		}
+		if j.stopped() {
+			file.scheduled(false)
+			return ErrStopped
+		}
+		c, err := j.d.pool.get()
+		if err != nil {
+			// we can't get connections to the server.
+			// leave the file for a later run.
+			file.scheduled(false)
+			return err
+		}
+		if j.stopped() {
+			j.d.pool.put(c)
+			file.scheduled(false)
+			return ErrStopped
+		}
+		file.request()
+		go j.decodeMsg(c, file, seg)
+	}
+	file.scheduled(true)
+	return nil
+}
+
+// decodes an nntp message and writes it to a section of the file.
+func (j *Job) decodeMsg(c *nntp.Conn, f *file, seg *nzb.Segment) {
+	err := j.writeSegment(c, f, seg)
+	f.Done(seg, err == nil)
+	if err != nil {
+		atomic.AddInt64(&j.segmentsFailed, 1)
+		j.addErr(err)
+		return
+	}
+	atomic.AddInt64(&j.segmentsDone, 1)
+	atomic.AddInt64(&j.bytesDone, int64(seg.Bytes))
+}
+
+func (j *Job) writeSegment(c *nntp.Conn, f *file, seg *nzb.Segment) error {
+	rc, err := c.GetMessage(seg.MsgId)
+	if err != nil {
+		if _, ok := err.(*textproto.Error); ok {
+			j.d.pool.put(c)
+		} else {
+			j.d.pool.putBroken(c)
+		}
+		return &SegmentError{MsgId: seg.MsgId, Err: err}
+	}
+	j.d.pool.put(c)
+
+	yread, err := yenc.NewPart(bytes.NewBuffer(rc))
+	if err != nil {
+		return &SegmentError{MsgId: seg.MsgId, Err: err}
+	}
+	f.setYencName(yread.Filename)
+	wr := f.WriterAt(yread.Begin)
+	_, err = io.Copy(wr, yread)
+	if err != nil {
+		return &SegmentError{MsgId: seg.MsgId, Err: err}
+	}
+	return nil
+}
+
+// SegmentError records a segment that could not be downloaded or decoded.
+type SegmentError struct {
+	MsgId string
+	Err   error
+}
+
+func (e *SegmentError) Error() string {
+	return "segment " + e.MsgId + ": " + e.Err.Error()
+}
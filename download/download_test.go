@@ -0,0 +1,302 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+)
+
+func testData(n int, seed byte) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*7) + seed
+	}
+	return b
+}
+
+func newDownloader(s *nntptest.Server, opts ...Option) *Downloader {
+	opts = append([]Option{WithServer(Server{Address: s.Addr}), WithConnections(4)}, opts...)
+	return New(opts...)
+}
+
+func checkFile(t *testing.T, path string, exp []byte) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(b, exp) {
+		t.Errorf("%s: contents differ", path)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data1 := testData(100000, 1)
+	data2 := testData(1234, 2)
+	n := &nzb.Nzb{File: []*nzb.File{
+		s.AddFile("first.bin", data1, 7000),
+		s.AddFile("second.bin", data2, 7000),
+	}}
+
+	var total int64
+	for _, f := range n.File {
+		for _, seg := range f.Segments {
+			total += int64(seg.Bytes)
+		}
+	}
+
+	dir := filepath.Join(t.TempDir(), "job")
+	job := newDownloader(s).Download(n, dir)
+	// every file is counted from the start, not just those started
+	if p := job.Progress(); p.Bytes != total || p.Files != 2 || p.Segments != 16 {
+		t.Errorf("bad progress before the download %+v", p)
+	}
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := job.Errors(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	checkFile(t, filepath.Join(dir, "first.bin"), data1)
+	checkFile(t, filepath.Join(dir, "second.bin"), data2)
+
+	p := job.Progress()
+	if p.Files != 2 || p.FilesDone != 2 {
+		t.Errorf("expected 2 of 2 files done, got %d of %d", p.FilesDone, p.Files)
+	}
+	if p.Segments != 16 || p.SegmentsDone != 16 || p.SegmentsFailed != 0 {
+		t.Errorf("bad segment progress %+v", p)
+	}
+	if p.Bytes != total || p.Bytes != p.BytesDone {
+		t.Errorf("bad byte progress %+v", p)
+	}
+	if len(p.FileProgress) != 2 {
+		t.Fatalf("expected progress for 2 files, got %d", len(p.FileProgress))
+	}
+	for i, fp := range p.FileProgress {
+		if fp.Name != n.File[i].Subject.Filename() || !fp.Done || fp.Bytes == 0 || fp.Bytes != fp.BytesDone {
+			t.Errorf("bad file progress %+v", fp)
+		}
+	}
+	if job.Name != "job" {
+		t.Errorf("expected job name %q, got %q", "job", job.Name)
+	}
+}
+
+func TestDownloadMissingSegment(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := testData(20000, 3)
+	f := s.AddFile("holes.bin", data, 5000)
+	missing := f.Segments[1].MsgId
+	s.Update(missing, func(a *nntptest.Article) { a.Missing = true })
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(&nzb.Nzb{File: []*nzb.File{f}}, dir)
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := job.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 error, got %v", errs)
+	}
+	if se, ok := errs[0].(*SegmentError); !ok || se.MsgId != missing {
+		t.Errorf("expected segment error for %s, got %v", missing, errs[0])
+	}
+	if p := job.Progress(); p.SegmentsFailed != 1 || p.SegmentsDone != 3 {
+		t.Errorf("bad segment progress %+v", p)
+	}
+	// the file should still be moved into place so that it can be repaired
+	if _, err := os.Stat(filepath.Join(dir, "holes.bin")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadExisting(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("exists.bin", testData(100, 4), 5000)
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "exists.bin"), []byte("old"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := newDownloader(s).Download(&nzb.Nzb{File: []*nzb.File{f}}, dir)
+	err = job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Requests(f.Segments[0].MsgId) != 0 {
+		t.Error("existing file was downloaded again")
+	}
+	checkFile(t, filepath.Join(dir, "exists.bin"), []byte("old"))
+}
+
+func TestDownloadUnnamed(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	named := s.AddFile("same.bin", testData(100, 5), 5000)
+	first := testData(12000, 6)
+	second := testData(200, 7)
+	n := &nzb.Nzb{File: []*nzb.File{named}}
+	// the subjects of these don't name them, but their yEnc headers do
+	for _, data := range [][]byte{first, second} {
+		f := s.AddFile("same.bin", data, 5000)
+		f.Subject = "no name here"
+		n.File = append(n.File, f)
+	}
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir)
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "same.bin"), testData(100, 5))
+	// which of the unnamed files gets which name depends on timing
+	got := make(map[int]string)
+	for _, name := range []string{"same.1.bin", "same.2.bin"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[len(b)] = name
+	}
+	if got[len(first)] == "" || got[len(second)] == "" {
+		t.Errorf("unnamed files not renamed, got %v", got)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the names the unnamed files were given are kept in the resume
+	// state, for when the job is run again.
+	if len(fis) != 4 {
+		t.Errorf("expected 4 files, got %d", len(fis))
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gonzbee-resume")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadUnnamedAgain(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := testData(12000, 8)
+	f := s.AddFile("named.bin", data, 5000)
+	f.Subject = "no name here"
+	n := &nzb.Nzb{File: []*nzb.File{f}}
+
+	dir := t.TempDir()
+	for i := 0; i < 2; i++ {
+		job := newDownloader(s).Download(n, dir)
+		err := job.Wait()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if errs := job.Errors(); len(errs) != 0 {
+			t.Fatal(errs)
+		}
+	}
+	checkFile(t, filepath.Join(dir, "named.bin"), data)
+	for _, seg := range f.Segments {
+		if r := s.Requests(seg.MsgId); r != 1 {
+			t.Errorf("segment %s requested %d times", seg.MsgId, r)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "named.1.bin")); !os.IsNotExist(err) {
+		t.Error("file downloaded again under another name")
+	}
+}
+
+func TestDownloadDisconnects(t *testing.T) {
+	s := nntptest.NewUnstartedServer()
+	s.DisconnectAfter = 2
+	s.Start()
+	defer s.Close()
+	f := s.AddFile("flaky.bin", testData(50000, 5), 1000)
+
+	// segments in flight on a dropped connection fail, but the job
+	// should redial and get through the rest.
+	dir := t.TempDir()
+	job := newDownloader(s, WithConnections(2), WithPipeline(1)).Download(&nzb.Nzb{File: []*nzb.File{f}}, dir)
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range job.Errors() {
+		if _, ok := err.(*SegmentError); !ok {
+			t.Errorf("unexpected error %v", err)
+		}
+	}
+	p := job.Progress()
+	if p.SegmentsDone+p.SegmentsFailed != 50 || p.SegmentsDone == 0 {
+		t.Errorf("bad segment progress %+v", p)
+	}
+	if s.Accepted() < 2 {
+		t.Errorf("expected redials, server accepted %d connections", s.Accepted())
+	}
+}
+
+func TestStopResume(t *testing.T) {
+	s := nntptest.NewUnstartedServer()
+	s.Delay = 5 * time.Millisecond
+	s.Start()
+	defer s.Close()
+	data := testData(100000, 6)
+	f := s.AddFile("resume.bin", data, 1000)
+	n := &nzb.Nzb{File: []*nzb.File{f}}
+
+	dir := t.TempDir()
+	d := newDownloader(s, WithConnections(2), WithPipeline(1))
+	job := d.Download(n, dir)
+	for job.Progress().SegmentsDone < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	d.Close()
+	err := job.Wait()
+	if err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+	if s.Open() != 0 {
+		t.Errorf("%d connections still open after Close", s.Open())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "resume.bin")); err == nil {
+		t.Fatal("unfinished file was moved into place")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gonzbee-resume")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Download(n, dir).Wait(); err != ErrClosed {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	job = newDownloader(s).Download(n, dir)
+	err = job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "resume.bin"), data)
+	for _, seg := range f.Segments {
+		if r := s.Requests(seg.MsgId); r != 1 {
+			t.Errorf("segment %s requested %d times", seg.MsgId, r)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".gonzbee-resume")); !os.IsNotExist(err) {
+		t.Error("resume state left behind after finishing")
+	}
+}
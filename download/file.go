@@ -0,0 +1,271 @@
+//Copyright 2012, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DanielMorsing/gonzbee/nzb"
+)
+
+var errExist = errors.New("file exists")
+
+// file is a file being downloaded. Segments are written to a temporary
+// file which is moved into place once every segment is done.
+type file struct {
+	job     *Job
+	nzbfile *nzb.File
+	// the name the file is downloaded under
+	name string
+	// set if name is a placeholder
+	placeholder bool
+	// where the file is moved once it is done
+	path string
+	file *os.File
+	// segments already in the temporary file from an earlier run
+	skip map[string]bool
+	// one for every segment requested, plus one that is
+	// released when all segments have been scheduled.
+	partsLeft int
+	// some segments were never requested
+	incomplete bool
+	written    []string
+	// the name in the yEnc headers, which can differ from the subject
+	yencName string
+	mu       sync.Mutex
+
+	// progress, protected by mu
+	segments       int
+	segmentsDone   int
+	segmentsFailed int
+	bytes          int64
+	bytesDone      int64
+	done           bool
+}
+
+// placeholderPrefix starts the names that files are downloaded under
+// when their subjects don't name them.
+const placeholderPrefix = "gonzbee-unnamed-"
+
+// fileName returns the name that nzbfile is downloaded under. Files whose
+// subjects don't hold a name get a placeholder until the yEnc headers name
+// them. It is made from the first segment, so that it is the same when
+// the job is resumed.
+func fileName(nzbfile *nzb.File) string {
+	if name := nzbfile.Subject.Filename(); name != "" {
+		return name
+	}
+	if len(nzbfile.Segments) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%08x", placeholderPrefix, crc32.ChecksumIEEE([]byte(nzbfile.Segments[0].MsgId)))
+}
+
+// doneName returns the name that nzbfile has once it is done. It is the
+// name it is downloaded under, unless that was a placeholder and an
+// earlier run of the job found its real name.
+func (j *Job) doneName(nzbfile *nzb.File) string {
+	name := fileName(nzbfile)
+	if nzbfile.Subject.Filename() == "" {
+		if n := j.resume.name(name); n != "" {
+			return n
+		}
+	}
+	return name
+}
+
+// claimName returns name, or if another file of the job has or will
+// have that name, name with a number added. The name returned is
+// taken from then on.
+func (j *Job) claimName(name string) string {
+	j.namesMu.Lock()
+	defer j.namesMu.Unlock()
+	name = uniqueName(name, func(n string) bool {
+		return j.names[n] || exists(filepath.Join(j.Dir, n))
+	})
+	j.names[name] = true
+	return name
+}
+
+// ownsName reports whether a file of the job has or will have name.
+func (j *Job) ownsName(name string) bool {
+	j.namesMu.Lock()
+	defer j.namesMu.Unlock()
+	return j.names[name]
+}
+
+// setName records that a file of the job was given name.
+func (j *Job) setName(name string) {
+	j.namesMu.Lock()
+	defer j.namesMu.Unlock()
+	j.names[name] = true
+}
+
+func (j *Job) newFile(nzbfile *nzb.File) (*file, error) {
+	filename := fileName(nzbfile)
+	if filename == "" {
+		return nil, errors.New("bad subject")
+	}
+
+	path := filepath.Join(j.Dir, j.doneName(nzbfile))
+	if _, err := os.Stat(path); err == nil {
+		return nil, errExist
+	}
+
+	temppath := filepath.Join(j.Dir, filename) + ".gonztemp"
+	skip := j.resume.written(filename)
+	var f *os.File
+	var err error
+	if skip != nil {
+		f, err = os.OpenFile(temppath, os.O_RDWR, 0)
+		if os.IsNotExist(err) {
+			skip = nil
+		}
+	}
+	if skip == nil {
+		f, err = os.Create(temppath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &file{
+		job:         j,
+		nzbfile:     nzbfile,
+		name:        filename,
+		placeholder: nzbfile.Subject.Filename() == "",
+		path:        path,
+		file:        f,
+		skip:        skip,
+		partsLeft:   1,
+		segments:    len(nzbfile.Segments),
+	}
+	for _, seg := range nzbfile.Segments {
+		if skip[seg.MsgId] {
+			ret.written = append(ret.written, seg.MsgId)
+		}
+	}
+	j.filewg.Add(1)
+	return ret, nil
+}
+
+func (f *file) WriterAt(offset int64) io.Writer {
+	return &fileWriter{
+		f:      f.file,
+		offset: offset,
+	}
+}
+
+// request is called for every segment requested for the file.
+func (f *file) request() {
+	f.mu.Lock()
+	f.partsLeft++
+	f.mu.Unlock()
+}
+
+// Done marks a segment as finished. ok reports whether
+// it was written to the file.
+func (f *file) Done(seg *nzb.Segment, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ok {
+		f.written = append(f.written, seg.MsgId)
+		f.segmentsDone++
+		f.bytesDone += int64(seg.Bytes)
+	} else {
+		f.segmentsFailed++
+	}
+	f.release()
+}
+
+// setYencName records the name found in the yEnc header of a segment.
+// A file downloaded under a placeholder is given that name.
+func (f *file) setYencName(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.yencName != "" {
+		return
+	}
+	f.yencName = strings.TrimSpace(name)
+	if n := cleanName(f.yencName); f.placeholder && n != "" {
+		if filepath.Base(f.path) != f.name {
+			// named by an earlier run
+			return
+		}
+		n = f.job.claimName(n)
+		f.path = filepath.Join(f.job.Dir, n)
+		f.job.resume.setName(f.name, n)
+	}
+}
+
+func (f *file) progress() FileProgress {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return FileProgress{
+		Name:           filepath.Base(f.path),
+		Segments:       f.segments,
+		SegmentsDone:   f.segmentsDone,
+		SegmentsFailed: f.segmentsFailed,
+		Bytes:          f.bytes,
+		BytesDone:      f.bytesDone,
+		Done:           f.done,
+	}
+}
+
+// scheduled is called when no more segments will be requested for
+// the file. all reports whether every segment was requested.
+func (f *file) scheduled(all bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !all {
+		f.incomplete = true
+	}
+	f.release()
+}
+
+func (f *file) release() {
+	f.partsLeft--
+	if f.partsLeft != 0 {
+		return
+	}
+	j := f.job
+	err := f.file.Sync()
+	if err != nil {
+		j.addErr(err)
+	}
+	f.file.Close()
+	if f.incomplete {
+		// leave the temporary file for a later run to resume
+		j.resume.set(f.name, f.written)
+	} else {
+		j.resume.set(f.name, nil)
+		j.d.log.Printf("Done downloading file %q", filepath.Base(f.path))
+		os.Rename(f.file.Name(), f.path)
+		f.done = true
+		atomic.AddInt64(&j.filesDone, 1)
+		j.fileDone(filepath.Base(f.path), f.segmentsFailed > 0)
+	}
+	j.filewg.Done()
+}
+
+// filewriter allows for multiple goroutines to write concurrently to
+// non-overlapping sections of a file
+type fileWriter struct {
+	f      *os.File
+	offset int64
+}
+
+func (f *fileWriter) Write(b []byte) (int, error) {
+	n, err := f.f.WriteAt(b, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
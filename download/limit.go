@@ -0,0 +1,128 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the token bucket used to limit how fast
+// we read from the server.
+
+package download
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/nntp"
+)
+
+// Limiter limits the rate that bytes are read from connections.
+// It can be shared between servers and Downloaders to put a single cap
+// on all of them. The rate can be changed while downloading.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// closed and replaced when the rate changes
+	changed chan struct{}
+}
+
+// NewLimiter returns a Limiter that allows rate bytes per second.
+// A rate of 0 or less means no limit.
+func NewLimiter(rate int64) *Limiter {
+	l := new(Limiter)
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate of the limiter.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.changed != nil {
+		// wake up waiters so that they don't sleep
+		// according to the old rate.
+		close(l.changed)
+	}
+	l.changed = make(chan struct{})
+	if l.rate <= 0 {
+		// start with an empty bucket, so that we don't go
+		// over the limit right after it is set.
+		l.tokens = 0
+		l.last = time.Now()
+	}
+	l.rate = float64(rate)
+	// allow bursts of a tenth of a second
+	l.burst = l.rate / 10
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current rate in bytes per second. 0 means no limit.
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	return int64(l.rate)
+}
+
+// wait takes n bytes from the bucket, sleeping if it
+// has gone into debt.
+func (l *Limiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return
+	}
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	changed := l.changed
+	l.mu.Unlock()
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-changed:
+	}
+}
+
+// limitDialer wraps the connections from a dialer so
+// that reads from them obey the limiters.
+type limitDialer struct {
+	nntp.Dialer
+	limiters []*Limiter
+}
+
+func (l *limitDialer) Dial(network, address string) (net.Conn, error) {
+	c, err := l.Dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &limitConn{Conn: c, limiters: l.limiters}, nil
+}
+
+type limitConn struct {
+	net.Conn
+	limiters []*Limiter
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for _, l := range c.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
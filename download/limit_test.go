@@ -0,0 +1,71 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+)
+
+func timeDownload(t *testing.T, s *nntptest.Server, f *nzb.File, opts ...Option) time.Duration {
+	start := time.Now()
+	job := newDownloader(s, opts...).Download(&nzb.Nzb{File: []*nzb.File{f}}, filepath.Join(t.TempDir(), "job"))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := job.Errors(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	return time.Since(start)
+}
+
+func TestGlobalLimit(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("limited.bin", testData(200000, 7), 10000)
+
+	// 200k at 250k/s, should take at least 0.8 seconds
+	el := timeDownload(t, s, f, WithLimiter(NewLimiter(250000)))
+	if el < 750*time.Millisecond {
+		t.Errorf("download finished in %v, faster than the limit allows", el)
+	}
+}
+
+func TestServerLimit(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("limited.bin", testData(200000, 8), 10000)
+
+	server := Server{Address: s.Addr, Limiter: NewLimiter(250000)}
+	el := timeDownload(t, s, f, WithServer(server))
+	if el < 750*time.Millisecond {
+		t.Errorf("download finished in %v, faster than the limit allows", el)
+	}
+}
+
+func TestChangeLimit(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("limited.bin", testData(200000, 9), 10000)
+
+	// start out at a crawl and then lift the limit
+	l := NewLimiter(1000)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		l.SetRate(0)
+	}()
+	el := timeDownload(t, s, f, WithLimiter(l))
+	if el < 200*time.Millisecond || el > 2*time.Second {
+		t.Errorf("download took %v", el)
+	}
+	if l.Rate() != 0 {
+		t.Errorf("expected no limit, got %d", l.Rate())
+	}
+}
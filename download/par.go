@@ -4,12 +4,17 @@
 // code for figuring out which par files to select to get the proper
 // number of blocks.
 
-package main
+package download
 
 import (
-	"github.com/DanielMorsing/gonzbee/nzb"
+	"errors"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
+
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2"
 )
 
 type parfile struct {
@@ -146,3 +151,103 @@ func selectPars(parfiles []*parfile, npars int) []*nzb.File {
 	}
 	return files
 }
+
+// smallestPar returns the recovery volume with the fewest blocks,
+// or nil if there are none.
+func smallestPar(parfiles []*parfile) *parfile {
+	var smallest *parfile
+	for _, p := range parfiles {
+		if smallest == nil || p.n < smallest.n {
+			smallest = p
+		}
+	}
+	return smallest
+}
+
+// without returns the parfiles that aren't in remove.
+func without(parfiles, remove []*parfile) []*parfile {
+	var ret []*parfile
+outer:
+	for _, p := range parfiles {
+		for _, r := range remove {
+			if p == r {
+				continue outer
+			}
+		}
+		ret = append(ret, p)
+	}
+	return ret
+}
+
+// errCantVerify is returned by verifyPar when the par2 files don't
+// hold enough information to verify against.
+var errCantVerify = errors.New("download: par2 file can't be used for verification")
+
+// verifyPar verifies the files at paths against the par2 file fp, and
+// the recovery volumes vols, which are read if fp is missing packets.
+// Files that match the recovery set are renamed to the name recorded in the
+// par2 file. It returns the paths that weren't part of the set and the amount
+// of blocks needed for repair.
+func (j *Job) verifyPar(fp *nzb.File, vols []*parfile, paths []string) ([]string, int, error) {
+	parpaths := []string{filepath.Join(j.Dir, fp.Subject.Filename())}
+	for _, v := range vols {
+		parpaths = append(parpaths, j.filePath(v.file))
+	}
+	fset := new(par2.Fileset)
+	for _, path := range parpaths {
+		if fset.CanVerify() {
+			break
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		fset.Add(f)
+		f.Close()
+	}
+	if !fset.CanVerify() {
+		return paths, 0, errCantVerify
+	}
+	pathSet := make(map[string]bool)
+	for _, s := range paths {
+		pathSet[s] = true
+	}
+	matches, blockNeeded := fset.Verify(paths)
+	for _, fm := range matches {
+		switch fm.Status {
+		case par2.StatusDamaged:
+			j.d.log.Printf("File %q is damaged, %d of %d blocks missing", fm.File.Name, len(fm.Missing), len(fm.Missing)+len(fm.Found))
+		case par2.StatusMissing:
+			j.d.log.Printf("File %q is missing", fm.File.Name)
+		}
+		if pathSet[fm.Path] {
+			delete(pathSet, fm.Path)
+			// the names in par2 files can't be trusted
+			// to stay in the job directory
+			name := cleanName(fm.File.Name)
+			par2path := filepath.Join(j.Dir, name)
+			if name != "" && par2path != fm.Path {
+				err := os.Rename(fm.Path, par2path)
+				if err != nil {
+					j.addErr(err)
+				} else {
+					j.setName(name)
+					fm.Path = par2path
+					if fm.Status == par2.StatusMisnamed {
+						fm.Status = par2.StatusComplete
+					}
+				}
+			}
+		}
+	}
+	// recorded once the files have been renamed, so
+	// that the results say where they are now.
+	j.mu.Lock()
+	j.verified = append(j.verified, matches...)
+	j.mu.Unlock()
+	retPaths := make([]string, 0, len(pathSet))
+	for s := range pathSet {
+		retPaths = append(retPaths, s)
+	}
+	return retPaths, blockNeeded, nil
+}
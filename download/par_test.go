@@ -0,0 +1,109 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download_test
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2"
+	"github.com/DanielMorsing/gonzbee/par2/par2test"
+)
+
+func TestVerifyDamagedIndex(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := randomData(40000, 9)
+	files := []par2test.File{{Name: "movie.mkv", Data: data}}
+	vol := func(exps ...int) []byte {
+		set := &par2test.Set{SliceSize: 4096, Files: files, Exponents: exps}
+		return set.Bytes()
+	}
+	index := s.AddFile("movie.par2", par2test.Create(4096, files...), 5000)
+	// the index par2 file has expired, so the file list has to be
+	// read from a recovery volume.
+	s.Update(index.Segments[0].MsgId, func(a *nntptest.Article) { a.Missing = true })
+	n := &nzb.Nzb{}
+	n.File = append(n.File,
+		index,
+		s.AddFile("movie.vol01+02.par2", vol(1, 2), 10000),
+		s.AddFile("movie.vol00+01.par2", vol(0), 10000),
+		s.AddFile("movie.mkv", data, 5000),
+	)
+
+	var logbuf bytes.Buffer
+	dir := t.TempDir()
+	job := newDownloader(s, WithLogger(log.New(&logbuf, "", 0))).Download(n, dir, WithRepair(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ParStatus() != ParVerified {
+		t.Errorf("par status %v", job.ParStatus())
+	}
+	if !strings.Contains(logbuf.String(), `downloading "movie.vol00+01.par2"`) {
+		t.Errorf("smallest volume not downloaded:\n%s", logbuf.String())
+	}
+	// nothing needs repairing, so the larger volume is left alone
+	if _, err := os.Stat(filepath.Join(dir, "movie.vol01+02.par2")); !os.IsNotExist(err) {
+		t.Errorf("larger volume downloaded: %v", err)
+	}
+}
+
+func TestVerifyMisnamed(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := randomData(20000, 10)
+	n := &nzb.Nzb{File: []*nzb.File{
+		s.AddFile("movie.par2", par2test.Create(4096, par2test.File{Name: "movie.mkv", Data: data}), 5000),
+		s.AddFile("wrong.mkv", data, 5000),
+	}}
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithRepair(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "movie.mkv")
+	checkFile(t, path, data)
+	// the results say where the file is now
+	results := job.ParResults()
+	if len(results) != 1 {
+		t.Fatalf("got %d par2 results, expected 1", len(results))
+	}
+	if m := results[0]; m.Path != path || m.Status != par2.StatusComplete {
+		t.Errorf("got %s %v", m.Path, m.Status)
+	}
+}
+
+func TestVerifyMisnamedOutside(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := randomData(20000, 11)
+	n := &nzb.Nzb{File: []*nzb.File{
+		s.AddFile("movie.par2", par2test.Create(4096, par2test.File{Name: "../movie.mkv", Data: data}), 5000),
+		s.AddFile("wrong.mkv", data, 5000),
+	}}
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "job")
+	job := newDownloader(s).Download(n, dir, WithRepair(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// files are only renamed inside the job directory
+	checkFile(t, filepath.Join(dir, "movie.mkv"), data)
+	if _, err := os.Stat(filepath.Join(parent, "movie.mkv")); !os.IsNotExist(err) {
+		t.Error("file moved out of the job directory")
+	}
+}
@@ -0,0 +1,196 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains a muxer that will limit the amount of connections
+// that are concurrently running.
+
+package download
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/DanielMorsing/gonzbee/nntp"
+)
+
+type pool struct {
+	server   Server
+	limiters []*Limiter
+	maxConns int
+	depth    int
+
+	mu     sync.Mutex
+	num    int
+	ch     chan *nntp.Conn
+	conns  map[*nntp.Conn]bool
+	closed bool
+	// closed and replaced whenever a connection slot is freed
+	freed chan struct{}
+}
+
+var errPoolClosed = errors.New("download: connection pool closed")
+
+func newPool(server Server, limiters []*Limiter, maxConns, depth int) *pool {
+	return &pool{
+		server:   server,
+		limiters: limiters,
+		maxConns: maxConns,
+		depth:    depth,
+		ch:       make(chan *nntp.Conn, maxConns*depth),
+		conns:    make(map[*nntp.Conn]bool),
+		freed:    make(chan struct{}),
+	}
+}
+
+func (p *pool) get() (*nntp.Conn, error) {
+	// check if there's a free conn we can get
+	select {
+	case c := <-p.ch:
+		return c, nil
+	default:
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errPoolClosed
+	}
+	for p.num == p.maxConns {
+		freed := p.freed
+		p.mu.Unlock()
+		// wait for idle conn, or for a broken one
+		// to make room for a new connection
+		select {
+		case c := <-p.ch:
+			return c, nil
+		case <-freed:
+		}
+		p.mu.Lock()
+	}
+	p.num++
+	p.mu.Unlock()
+	type connerr struct {
+		c   *nntp.Conn
+		err error
+	}
+	ch := make(chan connerr)
+	cancelch := make(chan struct{})
+
+	// dial with this connection.
+	// if we manage to get a connection from
+	// a client  done with theirs, we will use that one
+	// and put the idle conn
+	go func() {
+		c, err := p.dial()
+		if err != nil {
+			p.release()
+		} else {
+			p.mu.Lock()
+			p.conns[c] = true
+			p.mu.Unlock()
+		}
+		select {
+		case <-cancelch:
+			if err == nil {
+				for i := 0; i < p.depth; i++ {
+					p.put(c)
+				}
+			}
+			// ignore error
+		case ch <- connerr{c, err}:
+			if err == nil {
+				for i := 0; i < p.depth-1; i++ {
+					p.put(c)
+				}
+			}
+		}
+	}()
+	select {
+	case ce := <-ch:
+		return ce.c, ce.err
+	case c := <-p.ch:
+		close(cancelch)
+		return c, nil
+	}
+}
+
+func (p *pool) put(c *nntp.Conn) {
+	p.ch <- c
+}
+
+func (p *pool) putBroken(c *nntp.Conn) {
+	err := c.Close()
+	if err == nntp.ErrAlreadyClosed {
+		return
+	}
+	p.mu.Lock()
+	delete(p.conns, c)
+	p.mu.Unlock()
+	p.release()
+}
+
+// close sends QUIT on every connection in the pool. It should only be
+// called once all requests on the pool are finished.
+func (p *pool) close() {
+	p.mu.Lock()
+	p.closed = true
+	conns := p.conns
+	p.conns = make(map[*nntp.Conn]bool)
+	p.mu.Unlock()
+	for c := range conns {
+		c.Quit()
+	}
+	for {
+		select {
+		case <-p.ch:
+		default:
+			return
+		}
+	}
+}
+
+// active returns the number of open connections.
+func (p *pool) active() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+func (p *pool) release() {
+	p.mu.Lock()
+	p.num--
+	close(p.freed)
+	p.freed = make(chan struct{})
+	p.mu.Unlock()
+}
+
+func (p *pool) dial() (*nntp.Conn, error) {
+	s := &p.server
+	var d nntp.Dialer = s.Dialer
+	if d == nil {
+		d = new(net.Dialer)
+	}
+	if len(p.limiters) != 0 {
+		d = &limitDialer{Dialer: d, limiters: p.limiters}
+	}
+	var err error
+	var c *nntp.Conn
+
+	for {
+		if s.TLS {
+			c, err = nntp.DialTLSWith(d, s.Address, s.Username, s.Password)
+		} else {
+			c, err = nntp.DialWith(d, s.Address, s.Username, s.Password)
+		}
+		if err != nil {
+			// if it's a timeout, ignore and try again
+			e, ok := err.(net.Error)
+			if ok && e.Temporary() {
+				continue
+			}
+			return nil, err
+		}
+		break
+	}
+	return c, nil
+}
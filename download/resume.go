@@ -0,0 +1,127 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the state that lets a stopped job
+// pick up where it left off.
+
+package download
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const resumeFile = ".gonzbee-resume"
+
+// resumeState records which segments of unfinished files have
+// already been written to their temporary files, and the names that
+// files downloaded under placeholders were given.
+type resumeState struct {
+	mu    sync.Mutex
+	path  string
+	files map[string][]string
+	names map[string]string
+}
+
+// resumeJSON is how the state is stored.
+type resumeJSON struct {
+	Files map[string][]string `json:"files"`
+	Names map[string]string   `json:"names,omitempty"`
+}
+
+func loadResume(dir string) *resumeState {
+	r := &resumeState{
+		path:  filepath.Join(dir, resumeFile),
+		files: make(map[string][]string),
+		names: make(map[string]string),
+	}
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return r
+	}
+	var state resumeJSON
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		// a corrupt state file just means that we start over
+		return r
+	}
+	if state.Files != nil {
+		r.files = state.Files
+	}
+	if state.Names != nil {
+		r.names = state.Names
+	}
+	return r
+}
+
+// written returns the set of message ids written to the
+// temporary file for name.
+func (r *resumeState) written(name string) map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := r.files[name]
+	if ids == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// set records the message ids written for name.
+// A nil list removes the file from the state.
+func (r *resumeState) set(name string, msgIds []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msgIds == nil {
+		delete(r.files, name)
+		return
+	}
+	r.files[name] = msgIds
+}
+
+// name returns the name that the file downloaded under the
+// placeholder was given, or "" if it hasn't been given one.
+func (r *resumeState) name(placeholder string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.names[placeholder]
+}
+
+// setName records that the file downloaded under the placeholder was
+// given name. It is kept even once the file is done, so that running
+// the job again finds the file under its name.
+func (r *resumeState) setName(placeholder, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names[placeholder] = name
+}
+
+// save writes the state to the job directory, removing
+// the state file if there's nothing left to resume.
+func (r *resumeState) save() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.files) == 0 && len(r.names) == 0 {
+		err := os.Remove(r.path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+	b, err := json.Marshal(resumeJSON{Files: r.files, Names: r.names})
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".gonztemp"
+	err = ioutil.WriteFile(tmp, b, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
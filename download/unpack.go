@@ -0,0 +1,533 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// code for extracting the archives a job downloaded.
+
+package download
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/rar"
+	"github.com/DanielMorsing/gonzbee/sevenzip"
+)
+
+// WithUnpack sets whether the job extracts the RAR, zip and 7z archives
+// it downloaded into the job directory once it is done. If the par2 files
+// say that the files are damaged, nothing is extracted and the job fails
+// with ErrDamaged. Encrypted archives can't be extracted. The default is
+// false.
+func WithUnpack(unpack bool) JobOption {
+	return func(j *Job) { j.unpack = unpack }
+}
+
+// WithDeleteArchives sets whether the volumes of the archives are removed
+// once all of them have been extracted. The default is false.
+func WithDeleteArchives(del bool) JobOption {
+	return func(j *Job) { j.deleteArchives = del }
+}
+
+// UnpackError records an archive that couldn't be extracted.
+type UnpackError struct {
+	Archive string
+	Err     error
+}
+
+func (e *UnpackError) Error() string {
+	return "unpack " + e.Archive + ": " + e.Err.Error()
+}
+
+var (
+	// ErrDamaged is returned by Job.Wait when archives aren't extracted
+	// because the par2 files say that the files are damaged.
+	ErrDamaged = errors.New("download: files are damaged, not unpacking")
+	// errEncrypted is returned for encrypted zip archives, which can't be read.
+	errEncrypted = errors.New("encrypted zip archives are not supported")
+)
+
+// the kinds of archives that can be extracted
+const (
+	kindNone = iota
+	kindRAR
+	kindZip
+	kind7z
+)
+
+// magics are the bytes that the kinds of archives start with.
+var magics = []struct {
+	kind  int
+	magic string
+}{
+	{kindRAR, "Rar!\x1a\x07"},
+	{kindZip, "PK\x03\x04"},
+	{kind7z, "7z\xbc\xaf\x27\x1c"},
+}
+
+// sniff returns the kind of archive that r holds.
+func sniff(r io.ReaderAt) int {
+	var b [8]byte
+	n, _ := r.ReadAt(b[:], 0)
+	for _, m := range magics {
+		if strings.HasPrefix(string(b[:n]), m.magic) {
+			return m.kind
+		}
+	}
+	return kindNone
+}
+
+// archive is an archive in the job directory.
+type archive struct {
+	kind int
+	// the paths of the volumes of the archive, first volume first
+	volumes []string
+	// whether the volumes are pieces of a file that was split
+	split bool
+}
+
+// unpackAll extracts the archives in the job directory.
+func (j *Job) unpackAll() error {
+	if j.ParStatus() >= ParRepairable {
+		return ErrDamaged
+	}
+	archives, err := j.archives()
+	if err != nil {
+		return err
+	}
+	for _, a := range archives {
+		if j.stopped() {
+			return ErrStopped
+		}
+		// the files that direct unpack got out of the archive
+		// before it paused are already there.
+		var done map[string]bool
+		if j.direct != nil {
+			if j.direct.wasExtracted(a.volumes[0]) {
+				continue
+			}
+			done = j.direct.partlyExtracted(a.volumes[0])
+			if len(done) != 0 {
+				j.d.log.Printf("Continuing unpack of %q after %d files", filepath.Base(a.volumes[0]), len(done))
+			}
+		}
+		j.setPhase(PhaseUnpacking)
+		err = j.extract(a, done)
+		if err != nil {
+			return &UnpackError{Archive: filepath.Base(a.volumes[0]), Err: err}
+		}
+	}
+	if !j.deleteArchives {
+		return nil
+	}
+	for _, a := range archives {
+		for _, v := range a.volumes {
+			err = os.Remove(v)
+			if err != nil {
+				j.addErr(err)
+			}
+		}
+	}
+	return nil
+}
+
+// splitRegexp matches the pieces of split files, like example.7z.001.
+var splitRegexp = regexp.MustCompile(`^(.+)\.(\d{3})$`)
+
+// archiveExt matches the extensions of archive volumes: .rar, .r00,
+// .zip, .7z and .001.
+var archiveExt = regexp.MustCompile(`(?i)^\.(rar|r\d\d|zip|7z|\d{3})$`)
+
+// archiveName reports whether the file called name might be an archive
+// volume. Files without an extension might be archives with random
+// names. Formats like epub and docx are zip archives too, but they are
+// meant to be kept whole, so they are left alone.
+func archiveName(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == "" || archiveExt.MatchString(ext)
+}
+
+// archives returns the archives that the job downloaded. Only files named
+// like archives are looked at, and the kind of an archive is found from
+// the bytes it starts with. RAR archives also need to be named like a
+// first volume, so that the other volumes can be found. Files that were
+// extracted from archives aren't the job's own, so they are left alone.
+func (j *Job) archives() ([]*archive, error) {
+	fis, err := ioutil.ReadDir(j.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && archiveName(fi.Name()) && j.ownsName(fi.Name()) {
+			names[fi.Name()] = true
+		}
+	}
+	var archives []*archive
+	for _, fi := range fis {
+		name := fi.Name()
+		if !names[name] {
+			continue
+		}
+		if m := splitRegexp.FindStringSubmatch(name); m != nil {
+			if n, _ := strconv.Atoi(m[2]); n != 1 {
+				continue
+			}
+			a := &archive{split: true}
+			for n := 1; ; n++ {
+				v := fmt.Sprintf("%s.%03d", m[1], n)
+				if !names[v] {
+					break
+				}
+				a.volumes = append(a.volumes, filepath.Join(j.Dir, v))
+			}
+			a.kind, err = sniffVolumes(a.volumes)
+			if err != nil {
+				return nil, err
+			}
+			if a.kind != kindNone {
+				archives = append(archives, a)
+			}
+			continue
+		}
+		path := filepath.Join(j.Dir, name)
+		kind, err := sniffVolumes([]string{path})
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case kindNone:
+			continue
+		case kindRAR:
+			if !rar.IsFirstVolume(name) {
+				continue
+			}
+			a := &archive{kind: kindRAR}
+			for n := 0; ; n++ {
+				v := rar.VolumeName(name, n)
+				if !names[v] {
+					break
+				}
+				a.volumes = append(a.volumes, filepath.Join(j.Dir, v))
+			}
+			archives = append(archives, a)
+		default:
+			archives = append(archives, &archive{kind: kind, volumes: []string{path}})
+		}
+	}
+	sort.Slice(archives, func(i, k int) bool {
+		return archives[i].volumes[0] < archives[k].volumes[0]
+	})
+	return archives, nil
+}
+
+func sniffVolumes(paths []string) (int, error) {
+	v, err := openVolumes(paths)
+	if err != nil {
+		return kindNone, err
+	}
+	defer v.Close()
+	return sniff(v), nil
+}
+
+// volumeSet reads the volumes of a split file as if they were one file.
+type volumeSet struct {
+	files []*os.File
+	// where each volume starts
+	offsets []int64
+	size    int64
+}
+
+func openVolumes(paths []string) (*volumeSet, error) {
+	v := &volumeSet{}
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.files = append(v.files, f)
+		fi, err := f.Stat()
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.offsets = append(v.offsets, v.size)
+		v.size += fi.Size()
+	}
+	return v, nil
+}
+
+func (v *volumeSet) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	// the last volume starting at or before off
+	i := sort.Search(len(v.offsets), func(i int) bool { return v.offsets[i] > off }) - 1
+	if i < 0 {
+		i = 0
+	}
+	for ; i < len(v.files) && n < len(b); i++ {
+		c, err := v.files[i].ReadAt(b[n:], off-v.offsets[i])
+		n += c
+		off += int64(c)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+	}
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *volumeSet) Close() error {
+	var err error
+	for _, f := range v.files {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// archiveFile describes a file in an archive being extracted.
+type archiveFile struct {
+	name    string
+	isDir   bool
+	modTime time.Time
+}
+
+// archiveReader reads the files of an archive in order. next returns
+// io.EOF after the last file.
+type archiveReader interface {
+	io.ReadCloser
+	next() (*archiveFile, error)
+}
+
+// openArchive returns a reader for the files in a.
+func openArchive(a *archive) (archiveReader, error) {
+	if a.kind == kindRAR && !a.split {
+		r, err := rar.OpenReader(a.volumes[0])
+		if err != nil {
+			return nil, err
+		}
+		return &rarReader{r, r}, nil
+	}
+	v, err := openVolumes(a.volumes)
+	if err != nil {
+		return nil, err
+	}
+	var ar archiveReader
+	switch a.kind {
+	case kindRAR:
+		// the pieces of the split file make up a single volume
+		var r *rar.Reader
+		r, err = rar.NewReader(func(n int) (io.ReadCloser, error) {
+			if n > 0 {
+				return nil, os.ErrNotExist
+			}
+			return ioutil.NopCloser(io.NewSectionReader(v, 0, v.size)), nil
+		})
+		if err == nil {
+			ar = &rarReader{r, v}
+		}
+	case kindZip:
+		var r *zip.Reader
+		r, err = zip.NewReader(v, v.size)
+		if err == nil {
+			ar = &zipReader{r: r, c: v}
+		}
+	case kind7z:
+		var r *sevenzip.Reader
+		r, err = sevenzip.NewReader(v, v.size)
+		if err == nil {
+			ar = &sevenzipReader{r, v}
+		}
+	}
+	if err != nil {
+		v.Close()
+		return nil, err
+	}
+	return ar, nil
+}
+
+type rarReader struct {
+	*rar.Reader
+	c io.Closer
+}
+
+func (r *rarReader) next() (*archiveFile, error) {
+	hdr, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{hdr.Name, hdr.IsDir, hdr.ModTime}, nil
+}
+
+func (r *rarReader) Close() error {
+	return r.c.Close()
+}
+
+type sevenzipReader struct {
+	*sevenzip.Reader
+	io.Closer
+}
+
+func (r *sevenzipReader) next() (*archiveFile, error) {
+	hdr, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{hdr.Name, hdr.IsDir, hdr.ModTime}, nil
+}
+
+// zipReader reads the files of a zip archive in the order of its directory.
+type zipReader struct {
+	r  *zip.Reader
+	c  io.Closer
+	i  int
+	rc io.ReadCloser
+}
+
+// the flag that marks an encrypted file in a zip archive
+const zipEncrypted = 0x1
+
+func (z *zipReader) next() (*archiveFile, error) {
+	if z.rc != nil {
+		z.rc.Close()
+		z.rc = nil
+	}
+	if z.i == len(z.r.File) {
+		return nil, io.EOF
+	}
+	f := z.r.File[z.i]
+	z.i++
+	if f.Flags&zipEncrypted != 0 {
+		return nil, errEncrypted
+	}
+	af := &archiveFile{
+		name:    f.Name,
+		isDir:   f.FileInfo().IsDir(),
+		modTime: f.Modified,
+	}
+	if af.isDir {
+		return af, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	z.rc = rc
+	return af, nil
+}
+
+func (z *zipReader) Read(b []byte) (int, error) {
+	if z.rc == nil {
+		return 0, io.EOF
+	}
+	return z.rc.Read(b)
+}
+
+func (z *zipReader) Close() error {
+	if z.rc != nil {
+		z.rc.Close()
+	}
+	return z.c.Close()
+}
+
+// extract extracts archive a into the job directory,
+// leaving out the files at the paths in done.
+func (j *Job) extract(a *archive, done map[string]bool) error {
+	r, err := openArchive(a)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = j.extractFiles(r, done)
+	return err
+}
+
+// extractFiles extracts the files read from r into the job directory,
+// leaving out the files at the paths in done. It returns the paths of
+// the files written, even if not all of them could be.
+func (j *Job) extractFiles(r archiveReader, done map[string]bool) ([]string, error) {
+	var written []string
+	for {
+		hdr, err := r.next()
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+		if j.stopped() {
+			return written, ErrStopped
+		}
+		target, err := j.extractPath(hdr.name)
+		if err != nil {
+			return written, err
+		}
+		if hdr.isDir {
+			err = os.MkdirAll(target, os.ModePerm)
+			if err != nil {
+				return written, err
+			}
+			continue
+		}
+		if done[target] {
+			continue
+		}
+		err = writeExtracted(target, r)
+		if err != nil {
+			return written, err
+		}
+		written = append(written, target)
+		if !hdr.modTime.IsZero() {
+			os.Chtimes(target, hdr.modTime, hdr.modTime)
+		}
+	}
+}
+
+// extractPath returns where the file called name in an archive
+// is extracted to. Names that would end up outside the job directory
+// are rejected.
+func (j *Job) extractPath(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", errors.New("bad file name in archive: " + name)
+	}
+	return filepath.Join(j.Dir, clean), nil
+}
+
+// writeExtracted writes the contents of a file from an archive to path.
+// Nothing is left behind if the file can't be extracted.
+func writeExtracted(path string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,377 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package download_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/DanielMorsing/gonzbee/download"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/par2/par2test"
+	"github.com/DanielMorsing/gonzbee/rar"
+)
+
+// addArchive adds the volumes of a test archive from the rar package to s.
+func addArchive(t *testing.T, s *nntptest.Server, n *nzb.Nzb, names ...string) {
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join("..", "rar", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.File = append(n.File, s.AddFile(name, b, 5000))
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	addArchive(t, s, n, "multi5.part1.rar", "multi5.part2.rar", "multi5.part3.rar", "store4.rar")
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 30000 || crc32.ChecksumIEEE(b) != 0x8bd8dad2 {
+		t.Error("big.bin extracted wrong")
+	}
+	checkFile(t, filepath.Join(dir, "dir", "hello.txt"), []byte("Hello, world!\n"))
+	if job.Phase() != PhaseUnpacking {
+		t.Errorf("job ended in phase %v", job.Phase())
+	}
+}
+
+func TestUnpackEncryptedRar(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{Meta: []nzb.Meta{{Type: "password", Value: "secret"}}}
+	addArchive(t, s, n, "crypt5.rar")
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true))
+	err := job.Wait()
+	ue, ok := err.(*UnpackError)
+	if !ok || ue.Archive != "crypt5.rar" || ue.Err != rar.ErrEncrypted {
+		t.Fatalf("expected encryption error for crypt5.rar, got %v", err)
+	}
+	for _, name := range []string{"random.bin", filepath.Join("dir", "hello.txt")} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was left behind", name)
+		}
+	}
+}
+
+// makeZip returns a zip archive holding files, which map names to contents.
+func makeZip(t *testing.T, files map[string]string, flags uint16) []byte {
+	var b bytes.Buffer
+	w := zip.NewWriter(&b)
+	for name, contents := range files {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Flags: flags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(contents))
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func read7z(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("..", "sevenzip", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestUnpackZip7z(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	z := makeZip(t, map[string]string{"docs/readme.txt": "read me\n", "b.txt": "bee"}, 0)
+	n.File = append(n.File, s.AddFile("docs.zip", z, 5000))
+	// archives without an extension are found by their contents
+	n.File = append(n.File, s.AddFile("stuff", read7z(t, "lzma1.7z"), 5000))
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "docs", "readme.txt"), []byte("read me\n"))
+	checkFile(t, filepath.Join(dir, "b.txt"), []byte("bee"))
+	checkFile(t, filepath.Join(dir, "dir", "hello.txt"), []byte("Hello, world!\n"))
+	fi, err := os.Stat(filepath.Join(dir, "words.txt"))
+	if err != nil || fi.Size() != 50000 {
+		t.Errorf("words.txt extracted wrong: %v", err)
+	}
+	// the archives are kept
+	for _, name := range []string{"docs.zip", "stuff"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestUnpackKeepsDocuments(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	// an epub is a zip archive, but it is the file that was posted
+	book := makeZip(t, map[string]string{"mimetype": "application/epub+zip", "chapter1.xhtml": "<p>once</p>"}, 0)
+	n.File = append(n.File, s.AddFile("book.epub", book, 5000))
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true), WithDeleteArchives(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "book.epub"), book)
+	if _, err := os.Stat(filepath.Join(dir, "chapter1.xhtml")); !os.IsNotExist(err) {
+		t.Error("epub was extracted")
+	}
+}
+
+func TestUnpackSplit(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	b := read7z(t, "lzma2.7z")
+	names := []string{"files.7z.001", "files.7z.002", "files.7z.003"}
+	third := len(b) / 3
+	for i, name := range names {
+		piece := b[i*third:]
+		if i < 2 {
+			piece = piece[:third]
+		}
+		n.File = append(n.File, s.AddFile(name, piece, 5000))
+	}
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true), WithDeleteArchives(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFile(t, filepath.Join(dir, "dir", "hello.txt"), []byte("Hello, world!\n"))
+	checkFile(t, filepath.Join(dir, "empty.txt"), []byte{})
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not deleted", name)
+		}
+	}
+}
+
+func TestUnpackEncryptedZip(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	z := makeZip(t, map[string]string{"secret.txt": "hidden"}, 0x1)
+	n.File = append(n.File, s.AddFile("secret.zip", z, 5000))
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true), WithDeleteArchives(true))
+	err := job.Wait()
+	ue, ok := err.(*UnpackError)
+	if !ok || ue.Archive != "secret.zip" {
+		t.Fatalf("expected unpack error for secret.zip, got %v", err)
+	}
+	// archives are only deleted once everything is extracted
+	if _, err := os.Stat(filepath.Join(dir, "secret.zip")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDirectUnpack(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	addArchive(t, s, n, "multi5.part1.rar", "multi5.part2.rar", "multi5.part3.rar")
+	// the last volume arrives after the first ones can be extracted
+	for _, seg := range n.File[2].Segments {
+		s.Update(seg.MsgId, func(a *nntptest.Article) { a.Delay = 100 * time.Millisecond })
+	}
+
+	var logbuf bytes.Buffer
+	dir := t.TempDir()
+	d := newDownloader(s, WithLogger(log.New(&logbuf, "", 0)))
+	job := d.Download(n, dir, WithUnpack(true), WithDirectUnpack(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 30000 || crc32.ChecksumIEEE(b) != 0x8bd8dad2 {
+		t.Error("big.bin extracted wrong")
+	}
+	if !strings.Contains(logbuf.String(), `Done unpacking "multi5.part1.rar"`) {
+		t.Errorf("archive wasn't extracted while downloading:\n%s", logbuf.String())
+	}
+	// the archive isn't extracted again
+	if job.Phase() == PhaseUnpacking {
+		t.Error("job went through the unpacking phase")
+	}
+}
+
+func TestDirectUnpackDamaged(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	// the first volume holds whole files, and the start of big.bin
+	addArchive(t, s, n, "mixed5.part1.rar", "mixed5.part2.rar", "mixed5.part3.rar")
+	s.Update(n.File[1].Segments[1].MsgId, func(a *nntptest.Article) { a.Missing = true })
+	// the par2 files say that the job is damaged
+	var vols []par2test.File
+	for _, f := range n.File {
+		b, err := ioutil.ReadFile(filepath.Join("..", "rar", "testdata", f.Subject.Filename()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vols = append(vols, par2test.File{Name: f.Subject.Filename(), Data: b})
+	}
+	n.File = append(n.File, s.AddFile("mixed5.par2", par2test.Create(4096, vols...), 5000))
+
+	var logbuf bytes.Buffer
+	dir := t.TempDir()
+	d := newDownloader(s, WithLogger(log.New(&logbuf, "", 0)))
+	job := d.Download(n, dir, WithUnpack(true), WithDirectUnpack(true))
+	err := job.Wait()
+	if err != ErrDamaged {
+		t.Fatalf("expected ErrDamaged, got %v", err)
+	}
+	if !strings.Contains(logbuf.String(), `Pausing direct unpack of "mixed5.part1.rar"`) {
+		t.Errorf("direct unpack didn't pause at the damaged volume:\n%s", logbuf.String())
+	}
+	// the files extracted whole are kept, the one cut off isn't
+	checkFile(t, filepath.Join(dir, "dir", "hello.txt"), []byte("Hello, world!\n"))
+	if fi, err := os.Stat(filepath.Join(dir, "random.bin")); err != nil || fi.Size() != 10000 {
+		t.Errorf("random.bin not kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "big.bin")); !os.IsNotExist(err) {
+		t.Error("big.bin was left behind")
+	}
+}
+
+func TestDirectUnpackMisnamed(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	names := []string{"mixed5.part1.rar", "mixed5.part2.rar", "mixed5.part3.rar"}
+	addArchive(t, s, n, names...)
+	var vols []par2test.File
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join("..", "rar", "testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vols = append(vols, par2test.File{Name: name, Data: b})
+	}
+	// the second volume is posted under another name, so direct unpack
+	// can't find it until the par2 files have it renamed
+	b, err := ioutil.ReadFile(filepath.Join("..", "rar", "testdata", names[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.File[1] = s.AddFile("0a1b2c3d4e5f", b, 5000)
+	n.File = append(n.File, s.AddFile("mixed5.par2", par2test.Create(4096, vols...), 5000))
+
+	var logbuf bytes.Buffer
+	dir := t.TempDir()
+	d := newDownloader(s, WithLogger(log.New(&logbuf, "", 0)))
+	job := d.Download(n, dir, WithUnpack(true), WithDirectUnpack(true))
+	err = job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logbuf.String(), `Pausing direct unpack of "mixed5.part1.rar"`) {
+		t.Errorf("direct unpack didn't pause at the missing volume:\n%s", logbuf.String())
+	}
+	// the regular unpack picks up after the files already extracted
+	if !strings.Contains(logbuf.String(), `Continuing unpack of "mixed5.part1.rar" after 2 files`) {
+		t.Errorf("unpack didn't continue where direct unpack paused:\n%s", logbuf.String())
+	}
+	checkFile(t, filepath.Join(dir, "dir", "hello.txt"), []byte("Hello, world!\n"))
+	for name, size := range map[string]int64{"random.bin": 10000, "big.bin": 30000} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || fi.Size() != size {
+			t.Errorf("%s not extracted: %v", name, err)
+		}
+	}
+}
+
+func TestUnpackDamaged(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := makeZip(t, map[string]string{"inside.txt": "inside"}, 0)
+	n := &nzb.Nzb{File: []*nzb.File{
+		s.AddFile("stuff.par2", par2test.Create(4096, par2test.File{Name: "stuff.zip", Data: data}), 5000),
+		s.AddFile("stuff.zip", data, 100),
+	}}
+	s.Update(n.File[1].Segments[0].MsgId, func(a *nntptest.Article) { a.Missing = true })
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true), WithDeleteArchives(true))
+	err := job.Wait()
+	if err != ErrDamaged {
+		t.Fatalf("expected ErrDamaged, got %v", err)
+	}
+	if job.ParStatus() != ParUnrepairable {
+		t.Errorf("par status %v", job.ParStatus())
+	}
+	// the damaged archive is left for the user
+	if _, err := os.Stat(filepath.Join(dir, "inside.txt")); !os.IsNotExist(err) {
+		t.Error("damaged archive was extracted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stuff.zip")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnpackOnlyOwnArchives(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	n := &nzb.Nzb{}
+	// an archive that holds a zip archive
+	z := makeZip(t, map[string]string{"inner.txt": "inside"}, 0)
+	outer := makeZip(t, map[string]string{"inner.zip": string(z)}, 0)
+	n.File = append(n.File, s.AddFile("outer.zip", outer, 5000))
+
+	dir := t.TempDir()
+	job := newDownloader(s).Download(n, dir, WithUnpack(true), WithDeleteArchives(true))
+	err := job.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the archive extracted from the download is left as it is
+	checkFile(t, filepath.Join(dir, "inner.zip"), z)
+	if _, err := os.Stat(filepath.Join(dir, "inner.txt")); !os.IsNotExist(err) {
+		t.Error("archive extracted from an archive was extracted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outer.zip")); !os.IsNotExist(err) {
+		t.Error("downloaded archive was not deleted")
+	}
+}
@@ -4,8 +4,6 @@
 package main
 
 import (
-	"bytes"
-	"errors"
 	_ "expvar"
 	"flag"
 	"fmt"
@@ -14,16 +12,14 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof"
-	"net/textproto"
 	"os"
-	"path/filepath"
+	"os/signal"
 	"regexp"
-	"sync"
+	"syscall"
 
-	"github.com/DanielMorsing/gonzbee/nntp"
+	"github.com/DanielMorsing/gonzbee/download"
 	"github.com/DanielMorsing/gonzbee/nzb"
 	"github.com/DanielMorsing/gonzbee/par2"
-	"github.com/DanielMorsing/gonzbee/yenc"
 )
 
 var (
@@ -31,15 +27,17 @@ var (
 	saveDir  = flag.String("d", "", "Save to this directory")
 	par      = flag.Bool("par", false, "only download par2 files")
 	profAddr = flag.String("prof", "", "address to open profiling server on")
+	daemon   = flag.Bool("daemon", false, "keep running, downloading the jobs in the queue")
+	priority = flag.Int("priority", 0, "priority of the NZB files added to the queue in daemon mode")
+	apiAddr  = flag.String("api", "", "address to serve the HTTP API on in daemon mode")
+	category = flag.String("cat", "", "category of the NZB files given")
 )
 
 var extStrip = regexp.MustCompile(`\.nzb$`)
 
-var existErr = errors.New("file exists")
-
 func main() {
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if flag.NArg() == 0 && !*daemon {
 		fmt.Fprintln(os.Stderr, "No NZB files given")
 		os.Exit(1)
 	}
@@ -54,257 +52,166 @@ func main() {
 		}()
 	}
 
-	for _, path := range flag.Args() {
-		file, err := os.Open(path)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			continue
+	server, err := config.Server()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	total := download.NewLimiter(config.TotalRateLimit)
+	go reloadLimits(total, server.Limiter)
+	display := newProgressDisplay(os.Stdout)
+	// recent log output, shown in the web interface
+	logs := newLogBuffer(maxLogLines)
+	logger := log.New(io.MultiWriter(display, logs), "", 0)
+	d := download.New(
+		download.WithServer(server),
+		download.WithLimiter(total),
+		download.WithParOnly(*par),
+		download.WithLogger(logger),
+	)
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	// closed once stopSig is set
+	stopping := make(chan struct{})
+	var stopSig os.Signal
+	go func() {
+		stopSig = <-sigch
+		fmt.Fprintf(display, "Got %v, finishing requested segments. Send again to quit immediately\n", stopSig)
+		close(stopping)
+		d.Stop()
+		sig := <-sigch
+		os.Exit(signalStatus(sig))
+	}()
+
+	var status int
+	if *daemon {
+		r := &runner{
+			d:       d,
+			display: display,
+			log:     logger,
+			logs:    logs,
+			total:   total,
+			server:  server.Limiter,
 		}
+		status = runDaemon(r, stopping)
+	} else {
+		status = downloadArgs(d, display, logger, stopping)
+	}
+	display.close()
+	// sends QUIT to the server
+	d.Close()
+	select {
+	case <-stopping:
+		os.Exit(signalStatus(stopSig))
+	default:
+	}
+	os.Exit(status)
+}
 
-		nzb, err := nzb.Parse(file)
-		file.Close()
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			continue
+// downloadArgs downloads the NZB files given on the command line,
+// one after the other. It returns the exit status.
+func downloadArgs(d *download.Downloader, display *progressDisplay, logger *log.Logger, stopping <-chan struct{}) int {
+	status := 0
+nzbs:
+	for _, path := range flag.Args() {
+		select {
+		case <-stopping:
+			break nzbs
+		default:
 		}
-
-		err = downloadNzb(nzb, extStrip.ReplaceAllString(path, ""))
+		nzb, err := readNzb(path)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			continue
 		}
 
-		if *rm {
-			err = os.Remove(path)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, err)
-			}
+		cat := *category
+		if c := config.category(nzb.MetaValue("category")); cat == "" && c != nil {
+			cat = c.Name
 		}
-	}
-	filewg.Wait()
-}
-
-// download all the files contained in an nzb,
-func downloadNzb(nzbFile *nzb.Nzb, dir string) error {
-	if *saveDir != "" {
-		dir = *saveDir
-	}
-	err := os.Mkdir(dir, os.ModePerm)
-	// if the directory already exist, assume that it's an old download that was canceled
-	// and restarted.
-	if err != nil && !os.IsExist(err) {
-		return err
-	}
-	parfiles := filterPars(nzbFile)
-	// first download the parfiles
-	for file, _ := range parfiles {
-		err = downloadFile(dir, file)
-		if err == existErr {
-			continue
-		} else if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		dir := extStrip.ReplaceAllString(path, "")
+		if *saveDir != "" {
+			dir = *saveDir
+		} else if c := config.category(cat); c != nil && c.Dir != "" {
+			dir = config.jobDir(cat, nzbName(path))
 		}
-	}
-
-	if *par {
-		for _, pfiles := range parfiles {
-			for _, f := range pfiles {
-				err := downloadFile(dir, f.file)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-				}
-			}
+		// directories given with -d are the user's to name
+		opts := append(jobOptions(cat), download.WithRenameDir(*saveDir == ""))
+		job := d.Download(nzb, dir, opts...)
+		display.setJob(d, job)
+		err = job.Wait()
+		if err == download.ErrStopped {
+			break nzbs
 		}
-		return nil
-	}
-	// download the rest of the files.
-	for _, file := range nzbFile.File {
-		err = downloadFile(dir, file)
-		if err == existErr {
-			continue
-		} else if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+		dir = job.DoneDir()
+		if script := config.script(cat); script != "" {
+			s := &scriptJob{
+				name:     job.Name,
+				dir:      dir,
+				category: cat,
+				err:      err,
+				job:      job,
+			}
+			runScript(script, s, logger)
 		}
-	}
-
-	// create a list of files downloaded
-	var paths []string
-	for _, file := range nzbFile.File {
-		filename := file.Subject.Filename()
-		path := filepath.Join(dir, filename)
-		paths = append(paths, path)
-	}
-	filewg.Wait()
-	for fp, set := range parfiles {
-		var n int
-		paths, n, err = verifyPar(fp, dir, paths)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
+			status = 1
 			continue
 		}
-		files := selectPars(set, n)
+		if p := job.Progress(); p.SegmentsFailed != 0 {
+			fmt.Fprintf(os.Stderr, "%s: %d segments failed\n", job.Name, p.SegmentsFailed)
+			status = 1
+		}
+		for _, m := range job.ParResults() {
+			switch m.Status {
+			case par2.StatusDamaged:
+				fmt.Fprintf(os.Stderr, "%s: %s is damaged, %d blocks missing\n", job.Name, m.File.Name, len(m.Missing))
+			case par2.StatusMissing:
+				fmt.Fprintf(os.Stderr, "%s: %s is missing\n", job.Name, m.File.Name)
+			}
+		}
 
-		for _, file := range files {
-			err = downloadFile(dir, file)
-			if err == existErr {
-				continue
-			} else if err != nil {
+		if *rm {
+			err = os.Remove(path)
+			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 			}
 		}
 	}
-	return nil
+	return status
 }
 
-func verifyPar(fp *nzb.File, dir string, paths []string) ([]string, int, error) {
-	filename := fp.Subject.Filename()
-	path := filepath.Join(dir, filename)
-	f, err := os.Open(path)
+func readNzb(path string) (*nzb.Nzb, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		return paths, 0, err
-	}
-	defer f.Close()
-	fset := par2.NewFileset(f)
-	if !fset.CanVerify() {
-		return paths, 0, nil
-	}
-	pathSet := make(map[string]bool)
-	for _, s := range paths {
-		pathSet[s] = true
-	}
-	matches, blockNeeded := fset.Verify(paths)
-	for _, fm := range matches {
-		if pathSet[fm.Path] {
-			delete(pathSet, fm.Path)
-			par2path := filepath.Join(dir, fm.File.Name)
-			if par2path != fm.Path {
-				err := os.Rename(fm.Path, par2path)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-				}
-			}
-		}
-	}
-	retPaths := make([]string, 0, len(pathSet))
-	for s := range pathSet {
-		retPaths = append(retPaths, s)
+		return nil, err
 	}
-	return retPaths, blockNeeded, nil
+	defer file.Close()
+	return nzb.Parse(file)
 }
 
-// download a single file contained in an nzb.
-func downloadFile(dir string, nzbfile *nzb.File) error {
-	file, err := newFile(dir, nzbfile)
-	if err != nil {
-		return err
-	}
-	for _, f := range nzbfile.Segments {
-		c, err := getConn()
+// reloadLimits rereads the rate limits from the
+// config file whenever we get a SIGHUP.
+func reloadLimits(total, server *download.Limiter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := loadConfig()
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			continue
 		}
-		go decodeMsg(c, file, nzbfile.Groups, f.MsgId)
+		total.SetRate(c.TotalRateLimit)
+		server.SetRate(c.RateLimit)
 	}
-	return nil
 }
 
-// decodes an nntp message and writes it to a section of the file.
-func decodeMsg(c *nntp.Conn, f *file, groups []string, MsgId string) {
-	var err error
-	defer f.Done()
-	rc, err := c.GetMessage(MsgId)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "nntp error getting", MsgId, ":", err)
-		if _, ok := err.(*textproto.Error); ok {
-			putConn(c)
-		} else {
-			putBroken(c)
-		}
-		return
-	}
-	putConn(c)
-
-	yread, err := yenc.NewPart(bytes.NewBuffer(rc))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+// the exit status of a program killed by sig,
+// like shells report it.
+func signalStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
 	}
-	wr := f.WriterAt(yread.Begin)
-	_, err = io.Copy(wr, yread)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-	}
-}
-
-// waitgroup that keeps track if there are any files being downloaded.
-var filewg sync.WaitGroup
-
-type file struct {
-	name      string
-	path      string
-	file      *os.File
-	partsLeft int
-	mu        sync.Mutex
-}
-
-func newFile(dirname string, nzbfile *nzb.File) (*file, error) {
-	filename := nzbfile.Subject.Filename()
-	if filename == "" {
-		return nil, errors.New("bad subject")
-	}
-
-	path := filepath.Join(dirname, filename)
-	if _, err := os.Stat(path); err == nil {
-		return nil, existErr
-	}
-
-	temppath := path + ".gonztemp"
-	f, err := os.Create(temppath)
-	if err != nil {
-		return nil, err
-	}
-
-	ret := &file{
-		name:      filename,
-		path:      path,
-		partsLeft: len(nzbfile.Segments),
-		file:      f,
-	}
-	filewg.Add(1)
-	return ret, nil
-}
-
-func (f *file) WriterAt(offset int64) io.Writer {
-	return &fileWriter{
-		f:      f.file,
-		offset: offset,
-	}
-}
-
-func (f *file) Done() {
-	f.mu.Lock()
-	defer f.mu.Unlock()
-	f.partsLeft--
-	if f.partsLeft != 0 {
-		return
-	}
-	fmt.Printf("Done downloading file %q\n", f.name)
-	os.Rename(f.file.Name(), f.path)
-	f.file.Close()
-	filewg.Done()
-
-}
-
-// filewriter allows for multiple goroutines to write concurrently to
-// non-overlapping sections of a file
-type fileWriter struct {
-	f      *os.File
-	offset int64
-}
-
-func (f *fileWriter) Write(b []byte) (int, error) {
-	n, err := f.f.WriteAt(b, f.offset)
-	f.offset += int64(n)
-	return n, err
+	return 1
 }
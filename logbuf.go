@@ -0,0 +1,50 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of log lines kept for the web interface
+const maxLogLines = 500
+
+// logLine is a line of log output.
+type logLine struct {
+	Time time.Time
+	Text string
+}
+
+// logBuffer keeps the most recent lines written to it.
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []logLine
+	max   int
+}
+
+func newLogBuffer(max int) *logBuffer {
+	return &logBuffer{max: max}
+}
+
+func (l *logBuffer) Write(b []byte) (int, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, s := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		l.lines = append(l.lines, logLine{now, s})
+	}
+	if over := len(l.lines) - l.max; over > 0 {
+		l.lines = append(l.lines[:0], l.lines[over:]...)
+	}
+	return len(b), nil
+}
+
+// Lines returns the lines in the buffer, oldest first.
+func (l *logBuffer) Lines() []logLine {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]logLine(nil), l.lines...)
+}
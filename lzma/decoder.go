@@ -0,0 +1,438 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package lzma
+
+import (
+	"errors"
+	"io"
+)
+
+// errEndMarker is returned by decode at the end marker.
+var errEndMarker = errors.New("lzma: end marker")
+
+const (
+	numStates       = 12
+	maxPosBits      = 4
+	minMatchLen     = 2
+	maxMatchLen     = 273
+	numLenToPos     = 4
+	numAlignBits    = 4
+	startPosModel   = 4
+	endPosModel     = 14
+	numFullDistance = 1 << (endPosModel >> 1)
+)
+
+// prob is the probability of a bit being 0, out of 1<<11.
+type prob uint16
+
+const (
+	probBits    = 11
+	probInit    = 1 << probBits / 2
+	moveBits    = 5
+	topValue    = 1 << 24
+	literalSize = 0x300
+)
+
+// rangeDecoder decodes the bits of an LZMA stream.
+type rangeDecoder struct {
+	br   io.ByteReader
+	rng  uint32
+	code uint32
+	err  error
+}
+
+func (rc *rangeDecoder) init(br io.ByteReader) error {
+	rc.br = br
+	rc.rng = 0xffffffff
+	rc.code = 0
+	rc.err = nil
+	b, err := br.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if b != 0 {
+		return ErrCorrupt
+	}
+	for i := 0; i < 4; i++ {
+		b, err = br.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		rc.code = rc.code<<8 | uint32(b)
+	}
+	if rc.code == rc.rng {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < topValue {
+		b, err := rc.br.ReadByte()
+		if err != nil && rc.err == nil {
+			rc.err = unexpected(err)
+		}
+		rc.rng <<= 8
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *rangeDecoder) bit(p *prob) uint32 {
+	bound := (rc.rng >> probBits) * uint32(*p)
+	var b uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*p += (1<<probBits - *p) >> moveBits
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*p -= *p >> moveBits
+		b = 1
+	}
+	rc.normalize()
+	return b
+}
+
+func (rc *rangeDecoder) direct(n int) uint32 {
+	var res uint32
+	for ; n > 0; n-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		if rc.code == rc.rng {
+			rc.err = ErrCorrupt
+		}
+		rc.normalize()
+		res = res<<1 + t + 1
+	}
+	return res
+}
+
+// tree decodes a symbol of n bits, most significant bit first.
+func (rc *rangeDecoder) tree(probs []prob, n int) uint32 {
+	m := uint32(1)
+	for i := 0; i < n; i++ {
+		m = m<<1 | rc.bit(&probs[m])
+	}
+	return m - 1<<uint(n)
+}
+
+// reverse decodes a symbol of n bits, least significant bit first.
+func (rc *rangeDecoder) reverse(probs []prob, n int) uint32 {
+	m := uint32(1)
+	var sym uint32
+	for i := 0; i < n; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 | b
+		sym |= b << uint(i)
+	}
+	return sym
+}
+
+func initProbs(p []prob) {
+	for i := range p {
+		p[i] = probInit
+	}
+}
+
+// lenDecoder decodes match lengths.
+type lenDecoder struct {
+	choice  prob
+	choice2 prob
+	low     [1 << maxPosBits][1 << 3]prob
+	mid     [1 << maxPosBits][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (l *lenDecoder) init() {
+	l.choice = probInit
+	l.choice2 = probInit
+	for i := range l.low {
+		initProbs(l.low[i][:])
+		initProbs(l.mid[i][:])
+	}
+	initProbs(l.high[:])
+}
+
+func (l *lenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.tree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.tree(l.mid[posState][:], 3)
+	}
+	return 16 + rc.tree(l.high[:], 8)
+}
+
+// decoder holds the state of an LZMA decoder.
+type decoder struct {
+	props Props
+	rc    rangeDecoder
+	w     *window
+
+	state                  uint32
+	rep0, rep1, rep2, rep3 uint32
+
+	literal   []prob
+	isMatch   [numStates << maxPosBits]prob
+	isRep     [numStates]prob
+	isRepG0   [numStates]prob
+	isRepG1   [numStates]prob
+	isRepG2   [numStates]prob
+	isRep0Len [numStates << maxPosBits]prob
+	posSlot   [numLenToPos][1 << 6]prob
+	posSpec   [1 + numFullDistance - endPosModel]prob
+	align     [1 << numAlignBits]prob
+	lenDec    lenDecoder
+	repLenDec lenDecoder
+}
+
+// reset resets the decoder state and sets new properties.
+func (d *decoder) reset(p Props) {
+	d.props = p
+	n := literalSize << uint(p.LC+p.LP)
+	if cap(d.literal) >= n {
+		d.literal = d.literal[:n]
+	} else {
+		d.literal = make([]prob, n)
+	}
+	initProbs(d.literal)
+	initProbs(d.isMatch[:])
+	initProbs(d.isRep[:])
+	initProbs(d.isRepG0[:])
+	initProbs(d.isRepG1[:])
+	initProbs(d.isRepG2[:])
+	initProbs(d.isRep0Len[:])
+	for i := range d.posSlot {
+		initProbs(d.posSlot[i][:])
+	}
+	initProbs(d.posSpec[:])
+	initProbs(d.align[:])
+	d.lenDec.init()
+	d.repLenDec.init()
+	d.state = 0
+	d.rep0, d.rep1, d.rep2, d.rep3 = 0, 0, 0, 0
+}
+
+// decode decodes a literal or a match, writing at most limit bytes.
+func (d *decoder) decode(limit int) error {
+	rc := &d.rc
+	w := d.w
+	posState := uint32(w.total) & (1<<uint(d.props.PB) - 1)
+	s2 := d.state<<maxPosBits | posState
+	if rc.bit(&d.isMatch[s2]) == 0 {
+		d.decodeLiteral()
+		return rc.err
+	}
+	var length uint32
+	if rc.bit(&d.isRep[d.state]) == 0 {
+		d.rep3, d.rep2, d.rep1 = d.rep2, d.rep1, d.rep0
+		length = d.lenDec.decode(rc, posState)
+		if d.state < 7 {
+			d.state = 7
+		} else {
+			d.state = 10
+		}
+		d.rep0 = d.decodeDistance(length)
+		if d.rep0 == 0xffffffff {
+			if rc.err != nil {
+				return rc.err
+			}
+			return errEndMarker
+		}
+	} else {
+		if !w.has(d.rep0) {
+			return ErrCorrupt
+		}
+		if rc.bit(&d.isRepG0[d.state]) == 0 {
+			if rc.bit(&d.isRep0Len[s2]) == 0 {
+				// a single byte from rep0
+				if d.state < 7 {
+					d.state = 9
+				} else {
+					d.state = 11
+				}
+				w.put(w.get(d.rep0))
+				return rc.err
+			}
+		} else {
+			var dist uint32
+			if rc.bit(&d.isRepG1[d.state]) == 0 {
+				dist = d.rep1
+			} else {
+				if rc.bit(&d.isRepG2[d.state]) == 0 {
+					dist = d.rep2
+				} else {
+					dist = d.rep3
+					d.rep3 = d.rep2
+				}
+				d.rep2 = d.rep1
+			}
+			d.rep1 = d.rep0
+			d.rep0 = dist
+		}
+		length = d.repLenDec.decode(rc, posState)
+		if d.state < 7 {
+			d.state = 8
+		} else {
+			d.state = 11
+		}
+	}
+	if rc.err != nil {
+		return rc.err
+	}
+	n := int(length) + minMatchLen
+	if n > limit || !w.has(d.rep0) {
+		return ErrCorrupt
+	}
+	w.copyMatch(d.rep0, n)
+	return nil
+}
+
+func (d *decoder) decodeLiteral() {
+	rc := &d.rc
+	w := d.w
+	prev := uint32(w.last())
+	lp, lc := uint(d.props.LP), uint(d.props.LC)
+	litState := (uint32(w.total)&(1<<lp-1))<<lc | prev>>(8-lc)
+	probs := d.literal[literalSize*litState : literalSize*(litState+1)]
+	sym := uint32(1)
+	if d.state >= 7 {
+		match := uint32(w.get(d.rep0))
+		for sym < 0x100 {
+			matchBit := match >> 7 & 1
+			match <<= 1
+			b := rc.bit(&probs[(1+matchBit)<<8+sym])
+			sym = sym<<1 | b
+			if matchBit != b {
+				break
+			}
+		}
+	}
+	for sym < 0x100 {
+		sym = sym<<1 | rc.bit(&probs[sym])
+	}
+	w.put(byte(sym))
+	switch {
+	case d.state < 4:
+		d.state = 0
+	case d.state < 10:
+		d.state -= 3
+	default:
+		d.state -= 6
+	}
+}
+
+// decodeDistance decodes the distance of a match, counting from 0.
+func (d *decoder) decodeDistance(length uint32) uint32 {
+	rc := &d.rc
+	lenState := length
+	if lenState > numLenToPos-1 {
+		lenState = numLenToPos - 1
+	}
+	slot := rc.tree(d.posSlot[lenState][:], 6)
+	if slot < startPosModel {
+		return slot
+	}
+	direct := int(slot>>1) - 1
+	dist := (2 | slot&1) << uint(direct)
+	if slot < endPosModel {
+		return dist + rc.reverse(d.posSpec[dist-slot:], direct)
+	}
+	dist += rc.direct(direct-numAlignBits) << numAlignBits
+	return dist + rc.reverse(d.align[:], numAlignBits)
+}
+
+// window is the dictionary, holding the most recently decoded bytes.
+// Bytes are kept in it until they have been read.
+type window struct {
+	buf []byte
+	pos int
+	// the number of bytes decoded since the dictionary was reset
+	total int64
+	// the number of decoded bytes not yet read
+	pending int
+}
+
+func newWindow(size uint32) *window {
+	if size < minDictSize {
+		size = minDictSize
+	}
+	return &window{buf: make([]byte, size)}
+}
+
+// reset empties the dictionary. Bytes not yet read are kept.
+func (w *window) reset() {
+	w.total = 0
+}
+
+// room reports whether a full match can be decoded without
+// overwriting bytes that haven't been read.
+func (w *window) room() bool {
+	return w.pending+maxMatchLen <= len(w.buf)
+}
+
+func (w *window) put(b byte) {
+	w.buf[w.pos] = b
+	w.pos++
+	if w.pos == len(w.buf) {
+		w.pos = 0
+	}
+	w.total++
+	w.pending++
+}
+
+// has reports whether the byte dist+1 bytes back is in the dictionary.
+func (w *window) has(dist uint32) bool {
+	return int64(dist) < w.total && int(dist) < len(w.buf)
+}
+
+// get returns the byte dist+1 bytes back.
+func (w *window) get(dist uint32) byte {
+	i := w.pos - int(dist) - 1
+	if i < 0 {
+		i += len(w.buf)
+	}
+	return w.buf[i]
+}
+
+// last returns the last byte decoded, or 0 at the start.
+func (w *window) last() byte {
+	if w.total == 0 {
+		return 0
+	}
+	return w.get(0)
+}
+
+func (w *window) copyMatch(dist uint32, n int) {
+	for ; n > 0; n-- {
+		w.put(w.get(dist))
+	}
+}
+
+// read copies pending bytes to b.
+func (w *window) read(b []byte) int {
+	n := w.pending
+	if n > len(b) {
+		n = len(b)
+	}
+	start := w.pos - w.pending
+	if start < 0 {
+		start += len(w.buf)
+	}
+	c := copy(b[:n], w.buf[start:])
+	if c < n {
+		copy(b[c:n], w.buf)
+	}
+	w.pending -= n
+	return n
+}
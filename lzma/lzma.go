@@ -0,0 +1,135 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package lzma decompresses data in the LZMA and LZMA2 formats,
+// as used by 7z archives and .lzma files.
+package lzma
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrCorrupt is returned for compressed data that can't be decoded.
+	ErrCorrupt = errors.New("lzma: corrupt data")
+	// ErrProps is returned for invalid properties.
+	ErrProps = errors.New("lzma: invalid properties")
+)
+
+// Props are the parameters the data was compressed with.
+type Props struct {
+	// the number of literal context bits, literal position bits
+	// and position bits.
+	LC, LP, PB int
+	// DictSize is the size of the dictionary, in bytes.
+	DictSize uint32
+}
+
+// the smallest dictionary the decoder uses
+const minDictSize = 1 << 12
+
+// DecodeProps decodes the 5 byte form of the properties used by .lzma
+// files and 7z archives.
+func DecodeProps(b []byte) (Props, error) {
+	if len(b) < 5 {
+		return Props{}, ErrProps
+	}
+	p, err := decodeProps(b[0])
+	if err != nil {
+		return Props{}, err
+	}
+	p.DictSize = binary.LittleEndian.Uint32(b[1:])
+	return p, nil
+}
+
+// decodeProps decodes the byte that holds lc, lp and pb.
+func decodeProps(b byte) (Props, error) {
+	if b >= 9*5*5 {
+		return Props{}, ErrProps
+	}
+	d := int(b)
+	return Props{LC: d % 9, LP: d / 9 % 5, PB: d / 45}, nil
+}
+
+// NewReader returns a reader that decompresses the .lzma file read from r.
+func NewReader(r io.Reader) (io.Reader, error) {
+	var hdr [13]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	p, err := DecodeProps(hdr[:5])
+	if err != nil {
+		return nil, err
+	}
+	size := int64(binary.LittleEndian.Uint64(hdr[5:]))
+	return NewRawReader(r, p, size)
+}
+
+// NewRawReader returns a reader that decompresses LZMA data without
+// a header. Size is the size of the decompressed data, or -1 if the data
+// ends with an end marker.
+func NewRawReader(r io.Reader, p Props, size int64) (io.Reader, error) {
+	if p.LC > 8 || p.LP > 4 || p.PB > 4 {
+		return nil, ErrProps
+	}
+	br := byteReader(r)
+	d := &decoder{w: newWindow(p.DictSize)}
+	d.reset(p)
+	err := d.rc.init(br)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{d: d, size: size}, nil
+}
+
+// byteReader returns r as an io.ByteReader, buffering it if needed.
+func byteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return bufio.NewReader(r)
+}
+
+// reader reads an LZMA stream.
+type reader struct {
+	d *decoder
+	// bytes left to decode, or -1 if unknown
+	size int64
+	err  error
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	w := r.d.w
+	for w.pending < len(b) && w.room() && r.err == nil {
+		if r.size == 0 {
+			r.err = io.EOF
+			break
+		}
+		limit := int64(maxMatchLen)
+		if r.size > 0 && r.size < limit {
+			limit = r.size
+		}
+		before := w.total
+		err := r.d.decode(int(limit))
+		if r.size > 0 {
+			r.size -= w.total - before
+		}
+		if err == errEndMarker {
+			if r.size > 0 {
+				err = io.ErrUnexpectedEOF
+			} else {
+				err = io.EOF
+			}
+		}
+		r.err = err
+	}
+	n := w.read(b)
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
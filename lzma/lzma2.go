@@ -0,0 +1,200 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package lzma
+
+import (
+	"io"
+)
+
+// DictSize2 decodes the dictionary size property of LZMA2 data.
+func DictSize2(b byte) (uint32, error) {
+	if b > 40 {
+		return 0, ErrProps
+	}
+	if b == 40 {
+		return 0xffffffff, nil
+	}
+	return (2 | uint32(b)&1) << (b/2 + 11), nil
+}
+
+// NewReader2 returns a reader that decompresses LZMA2 data,
+// using a dictionary of dictSize bytes.
+func NewReader2(r io.Reader, dictSize uint32) io.Reader {
+	return &reader2{
+		br: byteReader(r),
+		d:  &decoder{w: newWindow(dictSize)},
+	}
+}
+
+// LZMA2 data is a sequence of chunks, each either stored or
+// compressed with LZMA. The control byte of a chunk says which,
+// and what state is reset before it.
+const (
+	chunkEnd          = 0x00
+	chunkStoredReset  = 0x01
+	chunkStored       = 0x02
+	chunkLZMA         = 0x80
+	chunkResetState   = 1
+	chunkResetProps   = 2
+	chunkResetDict    = 3
+	chunkUnpackedBits = 0x1f
+)
+
+type reader2 struct {
+	br io.ByteReader
+	d  *decoder
+	// the chunk being read
+	stored bool
+	// unpacked bytes left in the chunk
+	left int
+	// the compressed data of the chunk
+	packed *limitReader
+	// set once a dictionary reset has been seen
+	started  bool
+	hasProps bool
+	err      error
+}
+
+func (r *reader2) Read(b []byte) (int, error) {
+	w := r.d.w
+	for w.pending < len(b) && w.room() && r.err == nil {
+		if r.left == 0 {
+			r.err = r.nextChunk()
+			continue
+		}
+		before := w.total
+		if r.stored {
+			n := r.left
+			if n > maxMatchLen {
+				n = maxMatchLen
+			}
+			for i := 0; i < n; i++ {
+				c, err := r.br.ReadByte()
+				if err != nil {
+					r.err = unexpected(err)
+					break
+				}
+				w.put(c)
+			}
+		} else {
+			err := r.d.decode(r.left)
+			if err == errEndMarker {
+				// not allowed in LZMA2
+				err = ErrCorrupt
+			}
+			r.err = err
+		}
+		r.left -= int(w.total - before)
+		if r.left == 0 && !r.stored && r.packed.n != 0 {
+			r.err = ErrCorrupt
+		}
+	}
+	n := w.read(b)
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+// nextChunk reads the header of the next chunk.
+func (r *reader2) nextChunk() error {
+	c, err := r.br.ReadByte()
+	if err != nil {
+		return unexpected(err)
+	}
+	if c == chunkEnd {
+		return io.EOF
+	}
+	if c < chunkLZMA {
+		if c > chunkStored {
+			return ErrCorrupt
+		}
+		if c == chunkStoredReset {
+			r.d.w.reset()
+			r.started = true
+		} else if !r.started {
+			return ErrCorrupt
+		}
+		size, err := r.uint16()
+		if err != nil {
+			return err
+		}
+		r.stored = true
+		r.left = size + 1
+		return nil
+	}
+
+	reset := c >> 5 & 3
+	if reset == chunkResetDict {
+		r.d.w.reset()
+		r.started = true
+	} else if !r.started {
+		return ErrCorrupt
+	}
+	unpacked, err := r.uint16()
+	if err != nil {
+		return err
+	}
+	unpacked += int(c&chunkUnpackedBits)<<16 + 1
+	packed, err := r.uint16()
+	if err != nil {
+		return err
+	}
+	packed++
+	props := r.d.props
+	if reset >= chunkResetProps {
+		b, err := r.br.ReadByte()
+		if err != nil {
+			return unexpected(err)
+		}
+		p, err := decodeProps(b)
+		if err != nil {
+			return err
+		}
+		if p.LC+p.LP > 4 {
+			return ErrProps
+		}
+		props = p
+		r.hasProps = true
+	} else if !r.hasProps {
+		return ErrCorrupt
+	}
+	if reset >= chunkResetState {
+		r.d.reset(props)
+	}
+	r.packed = &limitReader{r.br, packed}
+	err = r.d.rc.init(r.packed)
+	if err != nil {
+		return err
+	}
+	r.stored = false
+	r.left = unpacked
+	return nil
+}
+
+func (r *reader2) uint16() (int, error) {
+	hi, err := r.br.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	lo, err := r.br.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	return int(hi)<<8 | int(lo), nil
+}
+
+// limitReader reads at most n bytes.
+type limitReader struct {
+	br io.ByteReader
+	n  int
+}
+
+func (l *limitReader) ReadByte() (byte, error) {
+	if l.n == 0 {
+		return 0, ErrCorrupt
+	}
+	l.n--
+	return l.br.ReadByte()
+}
@@ -0,0 +1,152 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package lzma_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/lzma"
+)
+
+// The files in testdata were compressed with liblzma from the data
+// made by words and noise.
+
+// words returns n bytes of random words, which compress well.
+func words(n int, seed uint32) []byte {
+	w := []string{"the ", "quick ", "brown ", "fox ", "jumps ", "over ", "lazy ", "dog ", "\n"}
+	var b []byte
+	x := seed
+	for len(b) < n {
+		x = x*1103515245 + 12345
+		b = append(b, w[(x>>16)%9]...)
+	}
+	return b[:n]
+}
+
+// noise returns n bytes that don't compress.
+func noise(n int, seed uint32) []byte {
+	b := make([]byte, n)
+	x := seed
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = byte(x >> 24)
+	}
+	return b
+}
+
+func TestLZMA(t *testing.T) {
+	f, err := os.Open("testdata/words.lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// the file has no size in its header, and ends with an end marker
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, words(200000, 1)) {
+		t.Error("decompressed data differs")
+	}
+}
+
+func TestLZMARaw(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/words.lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DecodeProps(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.LC != 3 || p.LP != 0 || p.PB != 2 || p.DictSize != 1<<16 {
+		t.Errorf("bad properties %+v", p)
+	}
+	// with a known size, reading stops before the end marker
+	r, err := NewRawReader(bytes.NewReader(b[13:]), p, 200000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, words(200000, 1)) {
+		t.Error("decompressed data differs")
+	}
+
+	// truncated data
+	r, err = NewRawReader(bytes.NewReader(b[13:len(b)/2]), p, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for truncated data, got %v", err)
+	}
+}
+
+func TestLZMA2(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/mixed.lzma2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(NewReader2(bytes.NewReader(b), 1<<16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := append(words(100000, 1), noise(66000, 2)...)
+	exp = append(exp, words(50000, 3)...)
+	if !bytes.Equal(got, exp) {
+		t.Error("decompressed data differs")
+	}
+}
+
+func TestLZMA2Stored(t *testing.T) {
+	chunks := []byte{
+		0x01, 0x00, 0x04, 'h', 'e', 'l', 'l', 'o',
+		0x02, 0x00, 0x00, '!',
+		0x00,
+	}
+	got, err := ioutil.ReadAll(NewReader2(bytes.NewReader(chunks), 1<<12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello!" {
+		t.Errorf("got %q", got)
+	}
+
+	// the first chunk has to reset the dictionary
+	_, err = ioutil.ReadAll(NewReader2(bytes.NewReader(chunks[8:]), 1<<12))
+	if err != ErrCorrupt {
+		t.Errorf("expected %v, got %v", ErrCorrupt, err)
+	}
+}
+
+func TestDictSize2(t *testing.T) {
+	tests := map[byte]uint32{
+		0:  4 << 10,
+		1:  6 << 10,
+		18: 2 << 20,
+		19: 3 << 20,
+		40: 0xffffffff,
+	}
+	for b, want := range tests {
+		got, err := DictSize2(b)
+		if err != nil || got != want {
+			t.Errorf("DictSize2(%d) = %d, %v, want %d", b, got, err, want)
+		}
+	}
+	if _, err := DictSize2(41); err != ErrProps {
+		t.Errorf("expected %v for 41, got %v", ErrProps, err)
+	}
+}
@@ -8,51 +8,81 @@ package nntp
 import (
 	"crypto/tls"
 	"errors"
+	"net"
 	"net/textproto"
 	"sync/atomic"
+	"time"
 )
 
 //Conn represents a NNTP connection
 type Conn struct {
 	*textproto.Conn
+	conn   net.Conn
 	closed uint32
 }
 
+//quitTimeout is how long Quit waits for the server to answer.
+const quitTimeout = 2 * time.Second
+
+//Dialer establishes the network connection underlying an NNTP connection.
+//*net.Dialer satisfies it, as do the dialers returned by ProxyDialer.
+type Dialer interface {
+	Dial(network, address string) (net.Conn, error)
+}
+
 //Dial will establish a connection to a NNTP server.
 //It returns the connection and an error, if any
 func Dial(address, user, pass string) (*Conn, error) {
-	n := new(Conn)
-	var err error
-	n.Conn, err = textproto.Dial("tcp", address)
+	return DialWith(new(net.Dialer), address, user, pass)
+}
+
+//DialTLS is like Dial, but connects using TLS.
+func DialTLS(address, user, pass string) (*Conn, error) {
+	return DialTLSWith(new(net.Dialer), address, user, pass)
+}
+
+//DialWith is like Dial, but uses d to establish the network connection.
+func DialWith(d Dialer, address, user, pass string) (*Conn, error) {
+	c, err := d.Dial("tcp", address)
 	if err != nil {
 		return nil, err
 	}
-	_, _, err = n.ReadCodeLine(20)
+	return newConn(c, user, pass)
+}
+
+//DialTLSWith is like DialTLS, but uses d to establish the network connection.
+//The TLS handshake happens on top of the connection d returns, so it works
+//through proxies.
+func DialTLSWith(d Dialer, address, user, pass string) (*Conn, error) {
+	c, err := d.Dial("tcp", address)
 	if err != nil {
-		n.Close()
 		return nil, err
 	}
-	err = n.authenticate(user, pass)
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	return n, nil
-}
-
-func DialTLS(address, user, pass string) (*Conn, error) {
-	n := new(Conn)
-	tlsConn, err := tls.Dial("tcp", address, nil)
+	tlsConn := tls.Client(c, &tls.Config{ServerName: host})
+	err = tlsConn.Handshake()
 	if err != nil {
+		c.Close()
 		return nil, err
 	}
-	n.Conn = textproto.NewConn(tlsConn)
-	_, _, err = n.ReadCodeLine(20)
+	return newConn(tlsConn, user, pass)
+}
+
+func newConn(c net.Conn, user, pass string) (*Conn, error) {
+	n := &Conn{conn: c}
+	n.Conn = textproto.NewConn(c)
+	_, _, err := n.ReadCodeLine(20)
 	if err != nil {
 		n.Close()
 		return nil, err
 	}
 	err = n.authenticate(user, pass)
 	if err != nil {
+		n.Close()
 		return nil, err
 	}
 	return n, nil
@@ -111,6 +141,36 @@ func (n *Conn) GetMessage(msgId string) ([]byte, error) {
 	return n.ReadDotBytes()
 }
 
+//Stat checks whether the server has the message with the supplied msgId.
+//It returns nil if it does and a *textproto.Error if it doesn't
+func (n *Conn) Stat(msgId string) error {
+	id, err := n.Cmd("STAT <%s>", msgId)
+	n.StartResponse(id)
+	defer n.EndResponse(id)
+	if err != nil {
+		return err
+	}
+	_, _, err = n.ReadCodeLine(223)
+	return err
+}
+
+//Quit politely ends the session with the QUIT command and closes the
+//connection. A server that doesn't answer quickly isn't waited for.
+func (n *Conn) Quit() error {
+	n.conn.SetDeadline(time.Now().Add(quitTimeout))
+	id, err := n.Cmd("QUIT")
+	if err == nil {
+		n.StartResponse(id)
+		_, _, err = n.ReadCodeLine(205)
+		n.EndResponse(id)
+	}
+	cerr := n.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
 func (n *Conn) Close() error {
 	if atomic.CompareAndSwapUint32(&n.closed, 0, 1) {
 		return n.Conn.Close()
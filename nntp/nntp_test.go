@@ -0,0 +1,193 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package nntp_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/DanielMorsing/gonzbee/nntp"
+	"github.com/DanielMorsing/gonzbee/nntp/nntptest"
+	"github.com/DanielMorsing/gonzbee/yenc"
+)
+
+func testData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i * 7)
+	}
+	return b
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := nntptest.NewUnstartedServer()
+	s.User, s.Pass = "user", "pass"
+	s.Start()
+	defer s.Close()
+
+	c, err := Dial(s.Addr, "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	_, err = Dial(s.Addr, "user", "wrong")
+	if _, ok := err.(*textproto.Error); !ok {
+		t.Errorf("expected protocol error for bad password, got %v", err)
+	}
+}
+
+func TestGetMessage(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	data := testData(10000)
+	f := s.AddFile("test.bin", data, 4000)
+
+	c, err := Dial(s.Addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var got []byte
+	for _, seg := range f.Segments {
+		b, err := c.GetMessage(seg.MsgId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := yenc.NewPart(bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, dec...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("decoded data differs")
+	}
+}
+
+func TestMissingArticle(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("test.bin", testData(100), 100)
+	msgId := f.Segments[0].MsgId
+	s.Update(msgId, func(a *nntptest.Article) { a.Missing = true })
+
+	c, err := Dial(s.Addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.GetMessage(msgId)
+	if e, ok := err.(*textproto.Error); !ok || e.Code != 430 {
+		t.Errorf("expected 430, got %v", err)
+	}
+	if err := c.Stat(msgId); err == nil {
+		t.Error("STAT succeeded for missing article")
+	}
+	if err := c.Stat("nonexistent@nntptest"); err == nil {
+		t.Error("STAT succeeded for nonexistent article")
+	}
+	// the connection should still be usable
+	s.Update(msgId, func(a *nntptest.Article) { a.Missing = false })
+	if err := c.Stat(msgId); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	s := nntptest.NewUnstartedServer()
+	s.Delay = 10 * time.Millisecond
+	s.Start()
+	defer s.Close()
+	f := s.AddFile("test.bin", testData(20000), 1000)
+
+	c, err := Dial(s.Addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for _, seg := range f.Segments {
+		wg.Add(1)
+		go func(msgId string) {
+			defer wg.Done()
+			_, err := c.GetMessage(msgId)
+			if err != nil {
+				t.Error(err)
+			}
+		}(seg.MsgId)
+	}
+	wg.Wait()
+	if s.Accepted() != 1 {
+		t.Errorf("expected 1 connection, server accepted %d", s.Accepted())
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	s := nntptest.NewServer()
+	defer s.Close()
+	f := s.AddFile("test.bin", testData(100), 100)
+	msgId := f.Segments[0].MsgId
+	s.Update(msgId, func(a *nntptest.Article) { a.Disconnect = true })
+
+	c, err := Dial(s.Addr, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, err = c.GetMessage(msgId)
+	if err == nil {
+		t.Fatal("expected error from dropped connection")
+	}
+	if _, ok := err.(*textproto.Error); ok {
+		t.Errorf("expected network error, got protocol error %v", err)
+	}
+}
+
+func TestQuitTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// greet and log in, and then never answer
+		tc := textproto.NewConn(c)
+		tc.PrintfLine("200 hello")
+		tc.ReadLine()
+		tc.PrintfLine("281 welcome")
+		ioutil.ReadAll(c)
+	}()
+
+	c, err := Dial(l.Addr().String(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Quit() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error from a server that doesn't answer QUIT")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Quit is still waiting for the server")
+	}
+}
@@ -0,0 +1,274 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package nntptest provides an in-process NNTP server for use in tests.
+//
+// The server understands enough of the protocol to serve binaries:
+// the greeting, AUTHINFO, BODY, STAT and QUIT. Commands may be pipelined.
+// Individual articles can be made to fail, stall or drop the connection.
+package nntptest
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Article is an article served by the Server.
+type Article struct {
+	// Body is sent in response to BODY. It should not be dot-stuffed
+	// and lines should end with \n.
+	Body []byte
+	// Missing makes the server answer 430 for this article, as if it
+	// had expired.
+	Missing bool
+	// Delay is waited before answering a request for this article.
+	Delay time.Duration
+	// Disconnect makes the server drop the connection instead of answering.
+	Disconnect bool
+}
+
+// Server is an NNTP server listening on a loopback address.
+type Server struct {
+	// Addr is the address the server is listening on, in host:port form.
+	Addr string
+
+	// User and Pass, if User is non-empty, are the credentials
+	// that clients must send with AUTHINFO.
+	User, Pass string
+	// Greeting is the code sent when a client connects. 200 if zero.
+	Greeting int
+	// Delay is waited before answering every BODY and STAT command.
+	// Set it before Start, or with SetDelay once the server is running.
+	Delay time.Duration
+	// DisconnectAfter, if non-zero, drops each connection after it has
+	// served that many BODY commands.
+	DisconnectAfter int
+
+	l        net.Listener
+	mu       sync.Mutex
+	articles map[string]*Article
+	conns    map[net.Conn]bool
+	requests map[string]int
+	accepted int
+	files    int
+	wg       sync.WaitGroup
+}
+
+// NewServer starts and returns a new Server.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server that isn't listening yet,
+// so that its configuration can be changed before calling Start.
+func NewUnstartedServer() *Server {
+	return &Server{
+		articles: make(map[string]*Article),
+		conns:    make(map[net.Conn]bool),
+		requests: make(map[string]int),
+	}
+}
+
+// Start starts a server from NewUnstartedServer.
+func (s *Server) Start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("nntptest: failed to listen: %v", err))
+	}
+	s.l = l
+	s.Addr = l.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close shuts down the server and all connections to it.
+func (s *Server) Close() {
+	s.l.Close()
+	s.CloseClientConnections()
+	s.wg.Wait()
+}
+
+// CloseClientConnections drops every open client connection.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+}
+
+// SetDelay changes the Delay of a running server.
+func (s *Server) SetDelay(d time.Duration) {
+	s.mu.Lock()
+	s.Delay = d
+	s.mu.Unlock()
+}
+
+// Add adds an article with the given message id, replacing any
+// existing one. The id should be given without angle brackets.
+func (s *Server) Add(msgId string, a *Article) {
+	s.mu.Lock()
+	s.articles[msgId] = a
+	s.mu.Unlock()
+}
+
+// Update calls fn with the article stored under msgId, if any,
+// so that the behavior of subsequent requests for it can be changed.
+func (s *Server) Update(msgId string, fn func(a *Article)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if a := s.articles[msgId]; a != nil {
+		fn(a)
+	}
+}
+
+// Requests returns the number of BODY requests made for msgId.
+func (s *Server) Requests(msgId string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[msgId]
+}
+
+// Accepted returns the number of connections the server has accepted.
+func (s *Server) Accepted() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Open returns the number of currently open connections.
+func (s *Server) Open() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[c] = true
+		s.accepted++
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+			c.Close()
+		}()
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	tc := textproto.NewConn(c)
+	greeting := s.Greeting
+	if greeting == 0 {
+		greeting = 200
+	}
+	tc.PrintfLine("%d nntptest ready", greeting)
+	if greeting >= 400 {
+		return
+	}
+
+	authed := s.User == ""
+	var user string
+	served := 0
+	for {
+		line, err := tc.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i != -1 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		switch strings.ToUpper(cmd) {
+		case "AUTHINFO":
+			sub, val := arg, ""
+			if i := strings.IndexByte(arg, ' '); i != -1 {
+				sub, val = arg[:i], arg[i+1:]
+			}
+			switch strings.ToUpper(sub) {
+			case "USER":
+				user = val
+				if s.User == "" {
+					authed = true
+					tc.PrintfLine("281 authentication accepted")
+				} else {
+					tc.PrintfLine("381 password required")
+				}
+			case "PASS":
+				if user == "" {
+					tc.PrintfLine("482 authentication commands issued out of sequence")
+				} else if user == s.User && val == s.Pass {
+					authed = true
+					tc.PrintfLine("281 authentication accepted")
+				} else {
+					tc.PrintfLine("481 authentication failed")
+				}
+			default:
+				tc.PrintfLine("501 syntax error")
+			}
+		case "BODY", "STAT":
+			if !authed {
+				tc.PrintfLine("480 authentication required")
+				continue
+			}
+			isBody := strings.ToUpper(cmd) == "BODY"
+			msgId := strings.TrimSuffix(strings.TrimPrefix(arg, "<"), ">")
+			s.mu.Lock()
+			a := s.articles[msgId]
+			var art Article
+			if a != nil {
+				art = *a
+			}
+			if isBody {
+				s.requests[msgId]++
+			}
+			delay := s.Delay
+			s.mu.Unlock()
+			time.Sleep(delay + art.Delay)
+			if a != nil && art.Disconnect {
+				return
+			}
+			if a == nil || art.Missing {
+				tc.PrintfLine("430 no such article")
+				continue
+			}
+			if !isBody {
+				tc.PrintfLine("223 0 <%s>", msgId)
+				continue
+			}
+			tc.PrintfLine("222 0 <%s>", msgId)
+			dw := tc.DotWriter()
+			dw.Write(art.Body)
+			err = dw.Close()
+			if err != nil {
+				return
+			}
+			served++
+			if s.DisconnectAfter != 0 && served >= s.DisconnectAfter {
+				return
+			}
+		case "QUIT":
+			tc.PrintfLine("205 bye")
+			return
+		default:
+			tc.PrintfLine("500 unknown command")
+		}
+	}
+}
@@ -0,0 +1,59 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package nntptest
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/DanielMorsing/gonzbee/nzb"
+	"github.com/DanielMorsing/gonzbee/yenc"
+)
+
+// AddFile yEnc encodes data as a binary posted in parts of at most
+// partSize bytes, adds the articles to the server and returns the
+// nzb.File describing them.
+func (s *Server) AddFile(name string, data []byte, partSize int) *nzb.File {
+	s.mu.Lock()
+	s.files++
+	fileno := s.files
+	s.mu.Unlock()
+
+	numParts := (len(data) + partSize - 1) / partSize
+	if numParts == 0 {
+		numParts = 1
+	}
+	f := &nzb.File{
+		Poster:  "nntptest <nntptest@example.com>",
+		Subject: nzb.Subject(fmt.Sprintf("%q yEnc (1/%d)", name, numParts)),
+		Groups:  []string{"alt.binaries.test"},
+	}
+	for i := 0; i < numParts; i++ {
+		begin := i * partSize
+		end := begin + partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		h := &yenc.Header{Filename: name}
+		if numParts > 1 {
+			h.Size = int64(len(data))
+			h.Begin = int64(begin)
+			h.Number = i + 1
+			h.NumParts = numParts
+		}
+		var buf bytes.Buffer
+		err := yenc.Encode(&buf, h, data[begin:end])
+		if err != nil {
+			panic(err)
+		}
+		msgId := fmt.Sprintf("part%d.file%d@nntptest", i+1, fileno)
+		s.Add(msgId, &Article{Body: buf.Bytes()})
+		f.Segments = append(f.Segments, &nzb.Segment{
+			Bytes:  buf.Len(),
+			Number: i + 1,
+			MsgId:  msgId,
+		})
+	}
+	return f
+}
@@ -0,0 +1,269 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains dialers that tunnel NNTP connections
+// through SOCKS5 and HTTP CONNECT proxies.
+
+package nntp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ProxyDialer returns a Dialer that connects through the proxy described by
+// rawurl, using forward to reach the proxy itself. Supported schemes are
+// socks5, socks5h and http. With socks5, host names are resolved locally
+// and the proxy is given the address; with socks5h, the proxy resolves
+// them. User information in the URL is used to authenticate with the proxy.
+func ProxyDialer(rawurl string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("nntp: proxy url %q has no host", rawurl)
+	}
+	var user, pass string
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &socks5Dialer{
+			addr:    u.Host,
+			user:    user,
+			pass:    pass,
+			resolve: u.Scheme == "socks5",
+			forward: forward,
+		}, nil
+	case "http":
+		return &connectDialer{addr: u.Host, user: user, pass: pass, forward: forward}, nil
+	}
+	return nil, fmt.Errorf("nntp: unsupported proxy scheme %q", u.Scheme)
+}
+
+// ErrProxy is returned when a SOCKS5 proxy refuses to connect
+// to the server.
+var ErrProxy = errors.New("nntp: proxy refused connection")
+
+type socks5Dialer struct {
+	addr       string
+	user, pass string
+	// whether host names are resolved here rather than by the proxy
+	resolve bool
+	forward Dialer
+}
+
+const (
+	socks5Version   = 5
+	socks5NoAuth    = 0
+	socks5UserPass  = 2
+	socks5NoMethod  = 0xff
+	socks5Connect   = 1
+	socks5IPv4      = 1
+	socks5Domain    = 3
+	socks5IPv6      = 4
+	socks5Succeeded = 0
+)
+
+func (s *socks5Dialer) Dial(network, address string) (net.Conn, error) {
+	host, portstr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, fmt.Errorf("nntp: bad port in %q", address)
+	}
+	if s.resolve && net.ParseIP(host) == nil {
+		host, err = lookupHost(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c, err := s.forward.Dial(network, s.addr)
+	if err != nil {
+		return nil, err
+	}
+	err = s.handshake(c, host, port)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// lookupHost resolves host to a single address, preferring IPv4.
+func lookupHost(host string) (string, error) {
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			return a, nil
+		}
+	}
+	return addrs[0], nil
+}
+
+func (s *socks5Dialer) handshake(c net.Conn, host string, port int) error {
+	buf := make([]byte, 0, 6+len(host))
+	if s.user != "" {
+		buf = append(buf, socks5Version, 2, socks5NoAuth, socks5UserPass)
+	} else {
+		buf = append(buf, socks5Version, 1, socks5NoAuth)
+	}
+	_, err := c.Write(buf)
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(c, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("nntp: proxy is not a SOCKS5 server")
+	}
+	switch reply[1] {
+	case socks5NoAuth:
+	case socks5UserPass:
+		if s.user == "" {
+			return errors.New("nntp: SOCKS5 proxy requires authentication")
+		}
+		err = s.authenticate(c)
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.New("nntp: no acceptable SOCKS5 authentication method")
+	}
+
+	buf = append(buf[:0], socks5Version, socks5Connect, 0)
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("nntp: hostname too long for SOCKS5")
+		}
+		buf = append(buf, socks5Domain, byte(len(host)))
+		buf = append(buf, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, socks5IPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, socks5IPv6)
+		buf = append(buf, ip...)
+	}
+	buf = append(buf, byte(port>>8), byte(port))
+	_, err = c.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	// reply is VER REP RSV ATYP followed by a bound address we don't care about
+	var hdr [4]byte
+	_, err = io.ReadFull(c, hdr[:])
+	if err != nil {
+		return err
+	}
+	if hdr[1] != socks5Succeeded {
+		return ErrProxy
+	}
+	var addrlen int
+	switch hdr[3] {
+	case socks5IPv4:
+		addrlen = net.IPv4len
+	case socks5IPv6:
+		addrlen = net.IPv6len
+	case socks5Domain:
+		var l [1]byte
+		_, err = io.ReadFull(c, l[:])
+		if err != nil {
+			return err
+		}
+		addrlen = int(l[0])
+	default:
+		return errors.New("nntp: malformed SOCKS5 reply")
+	}
+	_, err = io.ReadFull(c, make([]byte, addrlen+2))
+	return err
+}
+
+// username/password authentication as described in RFC 1929
+func (s *socks5Dialer) authenticate(c net.Conn) error {
+	if len(s.user) > 255 || len(s.pass) > 255 {
+		return errors.New("nntp: SOCKS5 credentials too long")
+	}
+	buf := []byte{1, byte(len(s.user))}
+	buf = append(buf, s.user...)
+	buf = append(buf, byte(len(s.pass)))
+	buf = append(buf, s.pass...)
+	_, err := c.Write(buf)
+	if err != nil {
+		return err
+	}
+	var reply [2]byte
+	_, err = io.ReadFull(c, reply[:])
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("nntp: SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+type connectDialer struct {
+	addr       string
+	user, pass string
+	forward    Dialer
+}
+
+func (h *connectDialer) Dial(network, address string) (net.Conn, error) {
+	c, err := h.forward.Dial(network, h.addr)
+	if err != nil {
+		return nil, err
+	}
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+	if h.user != "" {
+		cred := base64.StdEncoding.EncodeToString([]byte(h.user + ":" + h.pass))
+		req += "Proxy-Authorization: Basic " + cred + "\r\n"
+	}
+	req += "\r\n"
+	_, err = io.WriteString(c, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("nntp: proxy CONNECT failed: %s", resp.Status)
+	}
+	// the server greeting might already be sitting in the buffer
+	return &bufferedConn{Conn: c, r: br}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
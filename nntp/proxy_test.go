@@ -0,0 +1,272 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package nntp_test
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/nntp"
+)
+
+// greeter is a minimal NNTP server that sends a greeting and
+// accepts any credentials.
+func greeter(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.WriteString(c, "200 welcome\r\n")
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "AUTHINFO USER") {
+						io.WriteString(c, "281 ok\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+// socksServer is a SOCKS5 stand-in that supports CONNECT and
+// optionally username/password authentication. Every target address
+// it connects to is sent on targets.
+type socksServer struct {
+	l          net.Listener
+	user, pass string
+	targets    chan string
+}
+
+func newSocksServer(t *testing.T, user, pass string) *socksServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{l: l, user: user, pass: pass, targets: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *socksServer) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil || hdr[0] != 5 {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return
+	}
+	want := byte(0)
+	if s.user != "" {
+		want = 2
+	}
+	if strings.IndexByte(string(methods), want) == -1 {
+		c.Write([]byte{5, 0xff})
+		return
+	}
+	c.Write([]byte{5, want})
+	if want == 2 {
+		ver, _ := br.ReadByte()
+		ulen, _ := br.ReadByte()
+		user := make([]byte, ulen)
+		io.ReadFull(br, user)
+		plen, _ := br.ReadByte()
+		pass := make([]byte, plen)
+		io.ReadFull(br, pass)
+		if ver != 1 || string(user) != s.user || string(pass) != s.pass {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+	var req [4]byte
+	if _, err := io.ReadFull(br, req[:]); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 4:
+		ip := make([]byte, 16)
+		io.ReadFull(br, ip)
+		host = net.IP(ip).String()
+	case 3:
+		l, _ := br.ReadByte()
+		name := make([]byte, l)
+		io.ReadFull(br, name)
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	io.ReadFull(br, port[:])
+	target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	s.targets <- target
+	up, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer up.Close()
+	c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(up, br)
+	io.Copy(c, up)
+}
+
+func TestSocks5Dial(t *testing.T) {
+	g := greeter(t)
+	defer g.Close()
+	s := newSocksServer(t, "", "")
+	defer s.l.Close()
+
+	d, err := ProxyDialer("socks5://"+s.l.Addr().String(), new(net.Dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialWith(d, g.Addr().String(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if target := <-s.targets; target != g.Addr().String() {
+		t.Errorf("proxy connected to %s, expected %s", target, g.Addr())
+	}
+}
+
+func TestSocks5Resolve(t *testing.T) {
+	g := greeter(t)
+	defer g.Close()
+	s := newSocksServer(t, "", "")
+	defer s.l.Close()
+	_, port, err := net.SplitHostPort(g.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("localhost", port)
+
+	// socks5 resolves the name itself, socks5h leaves it to the proxy
+	tests := map[string]string{
+		"socks5":  g.Addr().String(),
+		"socks5h": addr,
+	}
+	for scheme, want := range tests {
+		d, err := ProxyDialer(scheme+"://"+s.l.Addr().String(), new(net.Dialer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := DialWith(d, addr, "user", "pass")
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		c.Close()
+		if target := <-s.targets; target != want {
+			t.Errorf("%s: proxy connected to %s, expected %s", scheme, target, want)
+		}
+	}
+}
+
+func TestSocks5Auth(t *testing.T) {
+	g := greeter(t)
+	defer g.Close()
+	s := newSocksServer(t, "proxyuser", "secret")
+	defer s.l.Close()
+
+	d, err := ProxyDialer("socks5://proxyuser:secret@"+s.l.Addr().String(), new(net.Dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialWith(d, g.Addr().String(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	d, err = ProxyDialer("socks5://proxyuser:wrong@"+s.l.Addr().String(), new(net.Dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = DialWith(d, g.Addr().String(), "user", "pass")
+	if err == nil {
+		t.Error("expected failure with wrong proxy password")
+	}
+}
+
+func TestHTTPConnectDial(t *testing.T) {
+	g := greeter(t)
+	defer g.Close()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != "CONNECT" {
+			return
+		}
+		up, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+			return
+		}
+		defer up.Close()
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go io.Copy(up, br)
+		io.Copy(c, up)
+	}()
+
+	d, err := ProxyDialer("http://"+l.Addr().String(), new(net.Dialer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := DialWith(d, g.Addr().String(), "user", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+func TestProxyBadScheme(t *testing.T) {
+	_, err := ProxyDialer("ftp://localhost:21", new(net.Dialer))
+	if err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+}
@@ -58,13 +58,33 @@ type File struct {
 	Segments []*Segment `xml:"segments>segment"`
 }
 
+//Meta is an entry in the head of an NZB file, like the category or
+//the password of the archives.
+type Meta struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
 //Nzb represents the top level for a NZB file
 //It's just a dumb struct to contain all the files.
 type Nzb struct {
+	//The metadata in the head of the NZB file
+	Meta []Meta `xml:"head>meta"`
 	//The files described in the NZB file
 	File []*File `xml:"file"`
 }
 
+//MetaValue returns the value of the first meta entry with the given type,
+//or "" if there is none. Types are compared case-insensitively.
+func (n *Nzb) MetaValue(typ string) string {
+	for _, m := range n.Meta {
+		if strings.EqualFold(m.Type, typ) {
+			return strings.TrimSpace(m.Value)
+		}
+	}
+	return ""
+}
+
 //Parse parses an nzb document from the reader and returns
 //a Nzb struct and an error if any.
 func Parse(r io.Reader) (n *Nzb, err error) {
@@ -33,7 +33,7 @@ var invalid string = `<?xml version="1.0" encoding="iso-8859-1" ?>
 </file>
 </nzb>`
 
-var topnzb Nzb = Nzb{[]*File{
+var topnzb Nzb = Nzb{File: []*File{
 	{
 		Poster:   "Joe Example <Joe@Example.com>",
 		Date:     2000000000,
@@ -75,3 +75,35 @@ func TestFilename(t *testing.T) {
 		t.Errorf("Invalid filename, Expected: \"example.rar\" Got: %q", nzb)
 	}
 }
+
+var withMeta string = `<?xml version="1.0" encoding="iso-8859-1" ?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+<head>
+<meta type="category">TV</meta>
+<meta type="password">secret</meta>
+</head>
+<file poster="Joe Example &lt;Joe@Example.com&gt;" date="2000000000" subject="Here is your file &quot;example.rar&quot; yEnc (1/1)">
+<groups>
+<group>alt.binaries.example</group>
+</groups>
+<segments>
+<segment bytes="14043" number="1">4f08c1ce$0$32047$c3e8da3$853bf72e@news.astraweb.com</segment>
+</segments>
+</file>
+</nzb>`
+
+func TestMeta(t *testing.T) {
+	nzb, err := Parse(strings.NewReader(withMeta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := nzb.MetaValue("Category"); c != "TV" {
+		t.Errorf("Expected category \"TV\", Got: %q", c)
+	}
+	if p := nzb.MetaValue("password"); p != "secret" {
+		t.Errorf("Expected password \"secret\", Got: %q", p)
+	}
+	if v := nzb.MetaValue("title"); v != "" {
+		t.Errorf("Expected no title, Got: %q", v)
+	}
+}
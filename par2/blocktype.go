@@ -9,4 +9,7 @@ const (
 	typeIFSC
 	typeRecvSlic
 	typeCreator
+	typeUniFileN
+	typeCommASCI
+	typeCommUni
 )
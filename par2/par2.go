@@ -10,21 +10,57 @@ import (
 	"hash"
 	"io"
 	"math/big"
-	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"unicode/utf16"
 )
 
 type Fileset struct {
+	// Workers is how many files, or pieces of large files, Verify
+	// hashes at once. If it is 0, it is the number of CPUs.
+	Workers int
+
 	setID     [16]byte
 	slicelen  uint64
 	complete  bool
 	files     map[[16]byte]*File
 	checksums map[[16]byte]chksum
+	// the CRC32s of the blocks
+	crcs map[uint32]struct{}
+	// made once the set is complete, so that
+	// concurrent calls to Verify only read it
+	rolling *rollingCRC
+
+	creator        string
+	comment        string
+	unicodeComment string
+	// the exponents of the recovery slices read
+	exponents map[int]bool
 }
 
 type File struct {
 	Name      string
 	length    uint64
+	hash16k   [16]byte
+	hashFull  [16]byte
 	checksums [][16]byte
+	// set once the FileDesc packet for the file has been read
+	described bool
+	// set if the name came from a Unicode filename packet
+	unicodeName    bool
+	nonRecoverable bool
+}
+
+// Size returns the size of the file in bytes.
+func (f *File) Size() int64 {
+	return int64(f.length)
+}
+
+// Recoverable reports whether the file is in the recovery set. Files
+// that aren't can be verified, but not repaired.
+func (f *File) Recoverable() bool {
+	return !f.nonRecoverable
 }
 
 func (f *File) numBlocks(fset *Fileset) int {
@@ -43,8 +79,21 @@ type chksum struct {
 // NewFileset reads r and returns a Fileset that can be used for verification and recovery of the files.
 func NewFileset(r io.Reader) *Fileset {
 	fset := &Fileset{}
-	fset.files = make(map[[16]byte]*File)
-	fset.checksums = make(map[[16]byte]chksum)
+	fset.Add(r)
+	return fset
+}
+
+// Add reads the packets in r into the set. Every par2 file of a set
+// holds the packets needed to verify it, so if one is damaged, the
+// packets missing from it can be added from another. Packets of other
+// sets are ignored. The zero Fileset is empty and ready to be added to.
+func (fset *Fileset) Add(r io.Reader) {
+	if fset.files == nil {
+		fset.files = make(map[[16]byte]*File)
+		fset.checksums = make(map[[16]byte]chksum)
+		fset.crcs = make(map[uint32]struct{})
+		fset.exponents = make(map[int]bool)
+	}
 	bufr := bufio.NewReader(r)
 	for {
 		hdr, err := readHeader(bufr)
@@ -54,8 +103,10 @@ func NewFileset(r io.Reader) *Fileset {
 		if fset.setID == ([16]byte{}) {
 			fset.setID = hdr.setID
 		} else if hdr.setID != fset.setID {
-			// this is weird and shouldn't happen
-			return fset
+			// this is weird and shouldn't happen. Skip the
+			// packet, the search for the next header will
+			// get past its contents.
+			continue
 		}
 		switch hdr.typ {
 		case typeFileDesc:
@@ -63,28 +114,29 @@ func NewFileset(r io.Reader) *Fileset {
 			if f == nil {
 				continue
 			}
-			fi, ok := fset.files[id]
-			if ok {
-				if fi.Name == "" {
-					// file was discovered through some means
-					// that didn't include the file info, usually IFSC
-					// pkt. Fill in the information now that we know what file this is.
+			// the file might have been discovered through some
+			// means that didn't include the file info, usually
+			// IFSC pkt. Fill in the information now that we know
+			// what file this is.
+			fi := fset.file(id)
+			if !fi.described {
+				fi.described = true
+				fi.length = f.length
+				fi.hash16k = f.hash16k
+				fi.hashFull = f.hashFull
+				if !fi.unicodeName {
 					fi.Name = f.Name
-					fi.length = fi.length
 				}
-			} else {
-				fset.files[id] = f
 			}
 		case typeIFSC:
-			chksums, id := readIFSC(hdr, bufr)
+			chksums, crcs, id := readIFSC(hdr, bufr)
 			if chksums == nil {
 				continue
 			}
-			fi, ok := fset.files[id]
-			if !ok {
-				fi = new(File)
-				fset.files[id] = fi
+			for _, crc := range crcs {
+				fset.crcs[crc] = struct{}{}
 			}
+			fi := fset.file(id)
 			if fi.checksums == nil {
 				fi.checksums = chksums
 			}
@@ -95,18 +147,81 @@ func NewFileset(r io.Reader) *Fileset {
 				}
 			}
 		case typeMain:
-			slicelen, ids := readMain(hdr, bufr)
+			slicelen, ids, nonrec := readMain(hdr, bufr)
 			for _, id := range ids {
-				if _, ok := fset.files[id]; !ok {
-					fset.files[id] = new(File)
-				}
+				fset.file(id)
+			}
+			for _, id := range nonrec {
+				fset.file(id).nonRecoverable = true
 			}
 			fset.slicelen = slicelen
+		case typeUniFileN:
+			name, id, ok := readUniFileN(hdr, bufr)
+			if ok && name != "" {
+				// the name in the FileDesc packet might have
+				// lost the characters that ASCII doesn't have.
+				fi := fset.file(id)
+				fi.Name = name
+				fi.unicodeName = true
+			}
+		case typeCreator:
+			if buf, err := readPkt(hdr, bufr); err == nil {
+				fset.creator = string(bytes.TrimRight(buf, "\x00"))
+			}
+		case typeCommASCI:
+			if buf, err := readPkt(hdr, bufr); err == nil {
+				fset.comment = string(bytes.TrimRight(buf, "\x00"))
+			}
+		case typeCommUni:
+			if buf, err := readPkt(hdr, bufr); err == nil && len(buf) >= 16 {
+				fset.unicodeComment = decodeUTF16(buf[16:])
+			}
+		case typeRecvSlic:
+			exp, err := readRecvSlic(hdr, bufr)
+			if err == nil {
+				fset.exponents[int(exp)] = true
+			}
 		default:
 		}
 	}
 	fset.CanVerify()
-	return fset
+}
+
+// file returns the file with id, adding it to the set if it isn't in it.
+func (f *Fileset) file(id [16]byte) *File {
+	fi, ok := f.files[id]
+	if !ok {
+		fi = new(File)
+		f.files[id] = fi
+	}
+	return fi
+}
+
+// Creator returns the name of the program that created the set,
+// or "" if it isn't known.
+func (f *Fileset) Creator() string {
+	return f.creator
+}
+
+// Comment returns the comment on the set, or "" if it has none.
+// If there is both a Unicode and an ASCII comment, the Unicode one is returned.
+func (f *Fileset) Comment() string {
+	if f.unicodeComment != "" {
+		return f.unicodeComment
+	}
+	return f.comment
+}
+
+// Exponents returns the exponents of the recovery slices that have been
+// read, in increasing order. Each exponent identifies a slice, and
+// slices with the same exponent in different volumes are copies.
+func (f *Fileset) Exponents() []int {
+	exps := make([]int, 0, len(f.exponents))
+	for exp := range f.exponents {
+		exps = append(exps, exp)
+	}
+	sort.Ints(exps)
+	return exps
 }
 
 // CanVerify returns whether the current fileset can be
@@ -119,106 +234,148 @@ func (f *Fileset) CanVerify() bool {
 		return false
 	}
 	for _, file := range f.files {
-		if file.Name == "" || file.checksums == nil {
+		if !file.described || file.Name == "" {
+			return false
+		}
+		// files outside the recovery set don't need block checksums
+		if file.checksums == nil && !file.nonRecoverable {
 			return false
 		}
 	}
+	f.rolling = newRollingCRC(int(f.slicelen))
 	f.complete = true
 	return true
 }
 
-// Verify verifies the files at paths against the fileset.
-// It returns a list of matches and how many blocks are needed in order to repair.
-func (f *Fileset) Verify(paths []string) ([]*FileMatch, int) {
-	if !f.complete {
-		return nil, 0
-	}
-	files := make(map[*File]struct{}, len(f.files))
-	for _, v := range f.files {
-		files[v] = struct{}{}
-	}
-	matches := make([]*FileMatch, 0, len(paths))
-	blocksNeeded := 0
-	for _, s := range paths {
-		fm, blocksmissing := f.verifyfile(s)
-		if fm != nil && fm.File != nil {
-			delete(files, fm.File)
-			blocksNeeded += blocksmissing
-			matches = append(matches, fm)
-		}
-	}
-	for fi := range files {
-		matches = append(matches, &FileMatch{Err: ErrMissing, File: fi})
-		blocksNeeded += fi.numBlocks(f)
+var ErrMissing = errors.New("par2: file missing")
+
+// the amount of data at the start of a file that FileDesc packets hash
+const hash16kSize = 16 * 1024
+
+// Identify returns the file in the set that is size bytes long and whose
+// first 16KiB hash the same as those read from r, or nil if there is none.
+// It finds files that were given other names without reading all of them.
+func (f *Fileset) Identify(r io.Reader, size int64) *File {
+	h := md5.New()
+	_, err := io.CopyN(h, r, hash16kSize)
+	if err != nil && err != io.EOF {
+		return nil
 	}
-	return matches, blocksNeeded
+	var sum [16]byte
+	h.Sum(sum[:0])
+	return f.identify(sum, size)
 }
 
-var ErrMissing = errors.New("par2: file missing")
+func (f *Fileset) identify(hash16k [16]byte, size int64) *File {
+	for _, file := range f.files {
+		if file.described && file.length == uint64(size) && file.hash16k == hash16k {
+			return file
+		}
+	}
+	return nil
+}
 
-func (fset *Fileset) verifyfile(s string) (*FileMatch, int) {
-	file, err := os.Open(s)
+// QuickMatch returns the file in the set that the size bytes read from r
+// are a complete and undamaged copy of, or nil if they aren't one.
+// The file is identified by its size and first 16KiB, and confirmed by
+// hashing all of it, which is much cheaper than checking every block.
+// Nothing more than the first 16KiB is read if no file matches those.
+func (f *Fileset) QuickMatch(r io.Reader, size int64) *File {
+	file, full := f.candidate(r, size)
+	if file == nil {
+		return nil
+	}
+	_, err := io.Copy(full, r)
 	if err != nil {
-		return &FileMatch{Err: err}, 0
+		return nil
 	}
-	defer file.Close()
-
-	match := &FileMatch{}
-	for {
-		mdchk := md5.New()
-		n, err := io.CopyN(mdchk, file, int64(fset.slicelen))
-		if n == 0 {
-			break
-		}
-		if uint64(n) < fset.slicelen {
-			// we have a partial block. par2 spec says that we should
-			// fill the remainder with 0s
-			// Ugh.
-			for i := uint64(0); i < fset.slicelen-uint64(n); i++ {
-				// can't fail.
-				mdchk.Write(zero)
-			}
-		}
-		var md5sum [16]byte
-		mdchk.Sum(md5sum[:0])
-		if f, ok := fset.checksums[md5sum]; ok {
-			if match.File == nil {
-				// ok we have a match, init the block bitmap
-				match.blocks = &big.Int{}
-				match.File = f.File
-				match.Path = s
-			} else if match.File != f.File {
-				// we already decided on one file and now we have
-				// another file with the same block.
-				//
-				// Effort.
-				continue
-			}
-			match.blocks.SetBit(match.blocks, f.blockno, 1)
-		}
-		if err != nil {
-			break
-		}
+	var sum [16]byte
+	full.Sum(sum[:0])
+	if sum != file.hashFull {
+		return nil
 	}
-	if match.File == nil {
-		// not part of the recovery set.
-		return nil, 0
+	return file
+}
+
+// candidate reads the first 16KiB of the size bytes read from r and
+// returns the file in the set they could be a copy of, or nil if there
+// is none. The hash returned has been given what was read, so that the
+// rest can be added to hash all of it.
+func (f *Fileset) candidate(r io.Reader, size int64) (*File, hash.Hash) {
+	full := md5.New()
+	h := md5.New()
+	_, err := io.CopyN(io.MultiWriter(h, full), r, hash16kSize)
+	if err != nil && err != io.EOF {
+		return nil, nil
 	}
-	blockcount := match.File.numBlocks(fset)
-	blocksmissing := 0
-	for i := 0; i < blockcount; i++ {
-		if match.blocks.Bit(i) == 0 {
-			blocksmissing++
-		}
+	var sum [16]byte
+	h.Sum(sum[:0])
+	return f.identify(sum, size), full
+}
+
+// Status is the state that Verify found a file of the set in.
+type Status int
+
+const (
+	// the file is whole and has the name recorded in the set
+	StatusComplete Status = iota
+	// blocks of the file are missing or damaged
+	StatusDamaged
+	// the file wasn't found
+	StatusMissing
+	// the file is whole, but has another name than the one recorded in the set
+	StatusMisnamed
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusComplete:
+		return "complete"
+	case StatusDamaged:
+		return "damaged"
+	case StatusMissing:
+		return "missing"
+	case StatusMisnamed:
+		return "misnamed"
 	}
-	return match, blocksmissing
+	return "Status(" + strconv.Itoa(int(s)) + ")"
 }
 
+// FileMatch is the result of verifying a file of the set.
+// The name and size it should have are those of File.
 type FileMatch struct {
+	// Err is ErrMissing for missing files
 	Err    error
-	Path   string
-	File   *File
-	blocks *big.Int
+	Status Status
+	// where the file was found
+	Path string
+	File *File
+	// the indexes of the blocks of the file that were found, and those
+	// that need to be repaired, in order.
+	Found   []int
+	Missing []int
+}
+
+// setBlocks fills in the blocks found and missing from the bitmap
+// blocks, and the status that follows from them.
+func (m *FileMatch) setBlocks(fset *Fileset, blocks *big.Int) {
+	for i := 0; i < m.File.numBlocks(fset); i++ {
+		if blocks.Bit(i) == 0 {
+			m.Missing = append(m.Missing, i)
+		} else {
+			m.Found = append(m.Found, i)
+		}
+	}
+	switch {
+	case m.Err == ErrMissing:
+		m.Status = StatusMissing
+	case len(m.Missing) != 0:
+		m.Status = StatusDamaged
+	case filepath.Base(m.Path) != m.File.Name:
+		m.Status = StatusMisnamed
+	default:
+		m.Status = StatusComplete
+	}
 }
 
 type hdr struct {
@@ -275,6 +432,12 @@ func readHeader(r *bufio.Reader) (h hdr, err error) {
 		h.typ = typeRecvSlic
 	case magicCreator:
 		h.typ = typeCreator
+	case magicUniFileN:
+		h.typ = typeUniFileN
+	case magicCommASCI:
+		h.typ = typeCommASCI
+	case magicCommUni:
+		h.typ = typeCommUni
 	default:
 		h.typ = typeUnknown
 	}
@@ -282,14 +445,15 @@ func readHeader(r *bufio.Reader) (h hdr, err error) {
 	return h, nil
 }
 
-// These are all the required types.
-// Going to leave it at that
 var (
 	magicMain     = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'M', 'a', 'i', 'n', 0, 0, 0, 0}
 	magicFiledesc = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'F', 'i', 'l', 'e', 'D', 'e', 's', 'c'}
 	magicIFSC     = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'I', 'F', 'S', 'C', 0, 0, 0, 0}
 	magicRecvSlic = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'R', 'e', 'c', 'v', 'S', 'l', 'i', 'c'}
 	magicCreator  = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'C', 'r', 'e', 'a', 't', 'o', 'r', 0}
+	magicUniFileN = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'U', 'n', 'i', 'F', 'i', 'l', 'e', 'N'}
+	magicCommASCI = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'C', 'o', 'm', 'm', 'A', 'S', 'C', 'I'}
+	magicCommUni  = [16]byte{'P', 'A', 'R', ' ', '2', '.', '0', 0, 'C', 'o', 'm', 'm', 'U', 'n', 'i', 0}
 )
 
 // corruption might cause the header
@@ -325,8 +489,8 @@ func readFileDesc(h hdr, r *bufio.Reader) (f *File, id [16]byte) {
 	}
 	f = new(File)
 	id, buf = readmd5(buf)
-	_, buf = readmd5(buf)
-	_, buf = readmd5(buf)
+	f.hashFull, buf = readmd5(buf)
+	f.hash16k, buf = readmd5(buf)
 	f.length, buf = readint(buf)
 
 	// rest of block is name, trim 0 padding.
@@ -335,40 +499,93 @@ func readFileDesc(h hdr, r *bufio.Reader) (f *File, id [16]byte) {
 	return f, id
 }
 
-var zero = []byte{0}
-
-func readIFSC(h hdr, r *bufio.Reader) (ss [][16]byte, id [16]byte) {
+func readIFSC(h hdr, r *bufio.Reader) (ss [][16]byte, crcs []uint32, id [16]byte) {
 	buf, err := readPkt(h, r)
 	if err != nil {
-		return nil, id
+		return nil, nil, id
 	}
 	id, buf = readmd5(buf)
 	ss = make([][16]byte, 0, len(buf)/20)
-	for len(buf) > 0 {
+	crcs = make([]uint32, 0, len(buf)/20)
+	for len(buf) >= 20 {
 		var md5h [16]byte
+		var crc uint32
 		md5h, buf = readmd5(buf)
-		// don't care about the crc, just that it gets consumed
-		_, buf = readcrc(buf)
+		crc, buf = readcrc(buf)
 		ss = append(ss, md5h)
+		crcs = append(crcs, crc)
 	}
-	return ss, id
+	return ss, crcs, id
 }
 
-func readMain(h hdr, r *bufio.Reader) (slicesize uint64, ids [][16]byte) {
+func readMain(h hdr, r *bufio.Reader) (slicesize uint64, ids, nonrec [][16]byte) {
 	buf, err := readPkt(h, r)
-	if err != nil {
-		return 0, nil
+	if err != nil || len(buf) < 12 {
+		return 0, nil, nil
 	}
 	slicesize, buf = readint(buf)
 	numfiles, buf := readcrc(buf)
+	if uint64(numfiles) > uint64(len(buf)/16) {
+		return 0, nil, nil
+	}
 	ids = make([][16]byte, 0, numfiles)
 	for i := uint32(0); i < numfiles; i++ {
 		var nid [16]byte
 		nid, buf = readmd5(buf)
 		ids = append(ids, nid)
 	}
+	// the rest are the files that aren't in the recovery set
+	for len(buf) >= 16 {
+		var nid [16]byte
+		nid, buf = readmd5(buf)
+		nonrec = append(nonrec, nid)
+	}
+	return slicesize, ids, nonrec
+}
 
-	return slicesize, ids
+func readUniFileN(h hdr, r *bufio.Reader) (name string, id [16]byte, ok bool) {
+	buf, err := readPkt(h, r)
+	if err != nil || len(buf) < 16 {
+		return "", id, false
+	}
+	id, buf = readmd5(buf)
+	return decodeUTF16(buf), id, true
+}
+
+// readRecvSlic reads the exponent of a recovery slice. The recovery data
+// isn't kept, but it has to be read to check the packet.
+func readRecvSlic(h hdr, r *bufio.Reader) (uint32, error) {
+	if h.length < 4 {
+		return 0, errors.New("short recovery slice packet")
+	}
+	var buf [4]byte
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return 0, err
+	}
+	h.partialhash.Write(buf[:])
+	_, err = io.CopyN(h.partialhash, r, int64(h.length-4))
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(h.partialhash.Sum(nil), h.hash[:]) {
+		return 0, errors.New("mismatch packet md5 and packet contents")
+	}
+	exp, _ := readcrc(buf[:])
+	return exp, nil
+}
+
+// decodeUTF16 decodes the little endian UTF-16 in b, without the zeros
+// that pad it.
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for ; len(b) >= 2; b = b[2:] {
+		u = append(u, binary.LittleEndian.Uint16(b))
+	}
+	for len(u) > 0 && u[len(u)-1] == 0 {
+		u = u[:len(u)-1]
+	}
+	return string(utf16.Decode(u))
 }
 
 func readmd5(b []byte) ([16]byte, []byte) {
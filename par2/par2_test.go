@@ -0,0 +1,384 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package par2_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	. "github.com/DanielMorsing/gonzbee/par2"
+	"github.com/DanielMorsing/gonzbee/par2/par2test"
+)
+
+const sliceSize = 4096
+
+func randomData(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// testFiles returns the files of the par2 set used in the tests.
+func testFiles() []par2test.File {
+	return []par2test.File{
+		{Name: "movie.mkv", Data: randomData(100000, 1)},
+		{Name: "movie.nfo", Data: randomData(3000, 2)},
+		{Name: "empty.txt", Data: nil},
+	}
+}
+
+func newFileset(t *testing.T, files []par2test.File) *Fileset {
+	fset := NewFileset(bytes.NewReader(par2test.Create(sliceSize, files...)))
+	if !fset.CanVerify() {
+		t.Fatal("can't verify with fileset")
+	}
+	return fset
+}
+
+// mapFS returns a file system with files under the names given.
+func mapFS(names []string, files []par2test.File) fstest.MapFS {
+	fsys := make(fstest.MapFS)
+	for i, f := range files {
+		fsys[names[i]] = &fstest.MapFile{Data: f.Data}
+	}
+	return fsys
+}
+
+func TestQuickMatch(t *testing.T) {
+	files := testFiles()
+	fset := newFileset(t, files)
+	for _, f := range files {
+		m := fset.QuickMatch(bytes.NewReader(f.Data), int64(len(f.Data)))
+		if m == nil || m.Name != f.Name {
+			t.Errorf("%s: got %v", f.Name, m)
+		}
+	}
+
+	damaged := append([]byte(nil), files[0].Data...)
+	damaged[50000] ^= 1
+	if m := fset.QuickMatch(bytes.NewReader(damaged), int64(len(damaged))); m != nil {
+		t.Errorf("damaged file matched %s", m.Name)
+	}
+	other := randomData(3000, 3)
+	if m := fset.QuickMatch(bytes.NewReader(other), int64(len(other))); m != nil {
+		t.Errorf("unrelated file matched %s", m.Name)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	files := testFiles()
+	fset := newFileset(t, files)
+	// the nfo has been renamed, and the empty file is gone
+	names := []string{"movie.mkv", "renamed.nfo"}
+	matches, needed := fset.VerifyFS(mapFS(names, files[:2]), names)
+	if needed != 0 {
+		t.Errorf("%d blocks needed, expected 0", needed)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("got %d matches, expected 3", len(matches))
+	}
+	want := map[string]Status{
+		"movie.mkv": StatusComplete,
+		"movie.nfo": StatusMisnamed,
+		"empty.txt": StatusMissing,
+	}
+	for _, m := range matches {
+		if m.Status != want[m.File.Name] {
+			t.Errorf("%s: got %v, expected %v", m.File.Name, m.Status, want[m.File.Name])
+		}
+		if m.Status == StatusMissing && m.Err != ErrMissing {
+			t.Errorf("%s: got error %v for missing file", m.File.Name, m.Err)
+		}
+	}
+	if m := matches[0]; len(m.Found) != 25 || len(m.Missing) != 0 || m.File.Size() != 100000 {
+		t.Errorf("complete file has %d blocks found, %d missing, size %d", len(m.Found), len(m.Missing), m.File.Size())
+	}
+	if m := matches[1]; m.File.Name != "movie.nfo" || m.Path != names[1] {
+		t.Errorf("renamed file matched as %s at %s", m.File.Name, m.Path)
+	}
+}
+
+func TestVerifyDamaged(t *testing.T) {
+	files := testFiles()
+	fset := newFileset(t, files)
+	for block, off := range map[int]int{0: 100, 12: 50000} {
+		damaged := []par2test.File{{Data: append([]byte(nil), files[0].Data...)}, files[1], files[2]}
+		damaged[0].Data[off] ^= 1
+		names := []string{"movie.mkv", "movie.nfo", "empty.txt"}
+		matches, needed := fset.VerifyFS(mapFS(names, damaged), names)
+		if needed != 1 {
+			t.Errorf("damage at %d: %d blocks needed, expected 1", off, needed)
+		}
+		if len(matches) != 3 || matches[0].File.Name != "movie.mkv" {
+			t.Fatalf("damage at %d: damaged file not matched", off)
+		}
+		m := matches[0]
+		if m.Status != StatusDamaged || len(m.Missing) != 1 || m.Missing[0] != block || len(m.Found) != 24 {
+			t.Errorf("damage at %d: got %v, missing blocks %v", off, m.Status, m.Missing)
+		}
+	}
+}
+
+func TestVerifyShifted(t *testing.T) {
+	files := testFiles()
+	fset := newFileset(t, files)
+	data := files[0].Data
+	for _, tc := range []struct {
+		name    string
+		damaged []byte
+	}{
+		{"inserted", append(append(append([]byte(nil), data[:50000]...), make([]byte, 10)...), data[50000:]...)},
+		{"lost", append(append([]byte(nil), data[:50000]...), data[50010:]...)},
+		{"truncated", data[:len(data)-500]},
+	} {
+		damaged := []par2test.File{{Data: tc.damaged}, files[1], files[2]}
+		names := []string{"movie.mkv", "movie.nfo", "empty.txt"}
+		// only the block where the data changed is lost,
+		// the ones after it are found at their new offsets.
+		_, needed := fset.VerifyFS(mapFS(names, damaged), names)
+		if needed != 1 {
+			t.Errorf("%s: %d blocks needed, expected 1", tc.name, needed)
+		}
+	}
+}
+
+func TestVerifyReaders(t *testing.T) {
+	files := testFiles()
+	fset := newFileset(t, files)
+	// a file that is still being written, with only the first
+	// blocks in place.
+	data := files[0].Data
+	partial := make([]byte, len(data))
+	copy(partial, data[:3*sliceSize])
+	matches, needed := fset.VerifyReaders([]Source{
+		{Name: "movie.mkv", Data: bytes.NewReader(partial), Size: int64(len(partial))},
+		{Name: "movie.nfo", Data: bytes.NewReader(files[1].Data), Size: int64(len(files[1].Data))},
+		{Name: "empty.txt", Data: bytes.NewReader(nil)},
+	})
+	if len(matches) != 3 {
+		t.Fatalf("got %d matches, expected 3", len(matches))
+	}
+	if m := matches[0]; m.Status != StatusDamaged || !reflect.DeepEqual(m.Found, []int{0, 1, 2}) {
+		t.Errorf("partial file: got %v with blocks %v", m.Status, m.Found)
+	}
+	if needed != 22 {
+		t.Errorf("%d blocks needed, expected 22", needed)
+	}
+	for _, m := range matches[1:] {
+		if m.Status != StatusComplete {
+			t.Errorf("%s: %v", m.File.Name, m.Status)
+		}
+	}
+}
+
+// summary is what tests compare of a FileMatch.
+type summary struct {
+	Name    string
+	Path    string
+	Status  Status
+	Found   []int
+	Missing []int
+}
+
+func summarize(matches []*FileMatch) []summary {
+	var s []summary
+	for _, m := range matches {
+		s = append(s, summary{m.File.Name, m.Path, m.Status, m.Found, m.Missing})
+	}
+	return s
+}
+
+// largeSet returns files of a set with files large enough to be
+// verified in pieces, and writes them to dir, damaging one.
+func largeSet(t testing.TB, dir string) ([]par2test.File, []string) {
+	files := []par2test.File{
+		{Name: "big1.bin", Data: randomData(10<<20, 4)},
+		{Name: "big2.bin", Data: randomData(9<<20+100, 5)},
+		{Name: "small.bin", Data: randomData(70000, 6)},
+		{Name: "gone.bin", Data: randomData(5000, 7)},
+	}
+	damaged := append([]byte(nil), files[1].Data...)
+	damaged[6<<20] ^= 1
+	onDisk := []par2test.File{files[0], {Data: damaged}, files[2]}
+	var paths []string
+	for i, f := range onDisk {
+		path := filepath.Join(dir, files[i].Name)
+		err := ioutil.WriteFile(path, f.Data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return files, paths
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	files, paths := largeSet(t, t.TempDir())
+	var want []summary
+	wantNeeded := 0
+	for _, workers := range []int{1, 2, 8} {
+		fset := newFileset(t, files)
+		fset.Workers = workers
+		matches, needed := fset.Verify(paths)
+		got := summarize(matches)
+		if workers == 1 {
+			want, wantNeeded = got, needed
+			if needed != 3 {
+				t.Errorf("%d blocks needed, expected 3", needed)
+			}
+			continue
+		}
+		if needed != wantNeeded || !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: results differ from 1 worker", workers)
+		}
+	}
+}
+
+func TestVerifyConcurrent(t *testing.T) {
+	files, paths := largeSet(t, t.TempDir())
+	fset := newFileset(t, files)
+	want, _ := fset.Verify(paths)
+	results := make([][]*FileMatch, 4)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = fset.Verify(paths)
+		}(i)
+	}
+	wg.Wait()
+	for i, got := range results {
+		if !reflect.DeepEqual(summarize(got), summarize(want)) {
+			t.Errorf("call %d: results differ", i)
+		}
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	files, paths := largeSet(b, b.TempDir())
+	var size int64
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += fi.Size()
+	}
+	fset := NewFileset(bytes.NewReader(par2test.Create(sliceSize, files...)))
+	fset.CanVerify()
+	// one worker hashes everything in turn, like Verify did before
+	// it was concurrent.
+	counts := []int{1, 2, 4}
+	if n := runtime.NumCPU(); n > 4 {
+		counts = append(counts, n)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			fset.Workers = workers
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				fset.Verify(paths)
+			}
+		})
+	}
+}
+
+func TestPackets(t *testing.T) {
+	files := testFiles()
+	extra := par2test.File{Name: "sample.mkv", Data: randomData(5000, 8)}
+	// larger than the pieces that files are checked in, but without
+	// block checksums to check them with.
+	large := par2test.File{Name: "large.iso", Data: randomData(6<<20, 10)}
+	set := &par2test.Set{
+		SliceSize:      sliceSize,
+		Files:          files,
+		NonRecoverable: []par2test.File{extra, large},
+		UnicodeNames:   true,
+		Creator:        "gonzbee test",
+		Comment:        "a comment",
+		UnicodeComment: "en kommentar på dansk",
+		Exponents:      []int{3, 0, 7},
+	}
+	b := set.Bytes()
+	// a Unicode name that ASCII can't hold
+	id := par2test.FileID(files[1])
+	name := []byte{}
+	for _, c := range "film på dansk.nfo" {
+		name = append(name, byte(c), byte(c>>8))
+	}
+	b = append(b, par2test.Packet(set.ID(), "PAR 2.0\x00UniFileN", append(id[:], name...))...)
+
+	fset := NewFileset(bytes.NewReader(b))
+	if !fset.CanVerify() {
+		t.Fatal("can't verify with fileset")
+	}
+	if c := fset.Creator(); c != "gonzbee test" {
+		t.Errorf("creator %q", c)
+	}
+	if c := fset.Comment(); c != "en kommentar på dansk" {
+		t.Errorf("comment %q", c)
+	}
+	if exps := fset.Exponents(); !reflect.DeepEqual(exps, []int{0, 3, 7}) {
+		t.Errorf("exponents %v", exps)
+	}
+
+	names := []string{"movie.mkv", "film på dansk.nfo", "empty.txt", "large.iso"}
+	fsys := mapFS(names, append(append([]par2test.File(nil), files...), large))
+	matches, needed := fset.VerifyFS(fsys, names)
+	if needed != 0 {
+		t.Errorf("%d blocks needed, expected 0", needed)
+	}
+	if len(matches) != 5 {
+		t.Fatalf("got %d matches, expected 5", len(matches))
+	}
+	for _, m := range matches[:3] {
+		if m.Status != StatusComplete || !m.File.Recoverable() {
+			t.Errorf("%s: %v", m.File.Name, m.Status)
+		}
+	}
+	if m := matches[3]; m.File.Name != "large.iso" || m.Status != StatusComplete || m.File.Recoverable() {
+		t.Errorf("large non-recoverable file: %s %v", m.File.Name, m.Status)
+	}
+	// the file outside the recovery set is missing,
+	// but no blocks can be used to repair it.
+	if m := matches[4]; m.File.Name != "sample.mkv" || m.Status != StatusMissing || m.File.Recoverable() {
+		t.Errorf("non-recoverable file: %s %v", m.File.Name, m.Status)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	files := testFiles()
+	index := par2test.Create(sliceSize, files...)
+	// the index has lost its second half
+	fset := NewFileset(bytes.NewReader(index[:len(index)/2]))
+	if fset.CanVerify() {
+		t.Fatal("can verify with half an index")
+	}
+	vol := &par2test.Set{SliceSize: sliceSize, Files: files, Exponents: []int{0, 1}}
+	fset.Add(bytes.NewReader(vol.Bytes()))
+	if !fset.CanVerify() {
+		t.Fatal("can't verify after adding a volume")
+	}
+	if exps := fset.Exponents(); !reflect.DeepEqual(exps, []int{0, 1}) {
+		t.Errorf("exponents %v", exps)
+	}
+	// packets of other sets are left out
+	other := par2test.Create(sliceSize, par2test.File{Name: "other.bin", Data: randomData(5000, 9)})
+	fset.Add(bytes.NewReader(other))
+	names := []string{"movie.mkv", "movie.nfo", "empty.txt"}
+	matches, needed := fset.VerifyFS(mapFS(names, files), names)
+	if len(matches) != 3 || needed != 0 {
+		t.Errorf("got %d matches and %d blocks needed", len(matches), needed)
+	}
+}
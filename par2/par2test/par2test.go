@@ -0,0 +1,175 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package par2test creates par2 files for use in tests.
+//
+// The files hold the packets needed to verify a set of files. Recovery
+// slices can be added, but their data is zeros rather than real
+// recovery data.
+package par2test
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"hash/crc32"
+	"unicode/utf16"
+)
+
+// File is a file protected by a par2 set.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// Set describes a par2 set.
+type Set struct {
+	SliceSize int
+	// the files in the recovery set
+	Files []File
+	// files that are described by the set, but can't be recovered
+	NonRecoverable []File
+	// if set, the names of the files are also written in Unicode
+	// filename packets.
+	UnicodeNames bool
+	Creator      string
+	// written in an ASCII comment packet
+	Comment string
+	// written in a Unicode comment packet
+	UnicodeComment string
+	// a recovery slice is written for each exponent
+	Exponents []int
+}
+
+// Packet returns a par2 packet of type typ with body in the set setID.
+// typ is padded with zeros to 16 bytes.
+func Packet(setID [16]byte, typ string, body []byte) []byte {
+	var t [16]byte
+	copy(t[:], typ)
+	h := md5.New()
+	h.Write(setID[:])
+	h.Write(t[:])
+	h.Write(body)
+	b := []byte("PAR2\x00PKT")
+	b = binary.LittleEndian.AppendUint64(b, uint64(64+len(body)))
+	b = h.Sum(b)
+	b = append(b, setID[:]...)
+	b = append(b, t[:]...)
+	return append(b, body...)
+}
+
+// FileID returns the id that par2 sets give f.
+func FileID(f File) [16]byte {
+	hash16k := md5.Sum(first16k(f.Data))
+	b := binary.LittleEndian.AppendUint64(hash16k[:], uint64(len(f.Data)))
+	return md5.Sum(append(b, f.Name...))
+}
+
+// SetID returns the id of the par2 set with slices sliceSize bytes
+// long for files.
+func SetID(sliceSize int, files ...File) [16]byte {
+	s := &Set{SliceSize: sliceSize, Files: files}
+	return s.ID()
+}
+
+// Create returns a par2 file with the Main, FileDesc and IFSC packets
+// of the set with slices sliceSize bytes long for files.
+func Create(sliceSize int, files ...File) []byte {
+	s := &Set{SliceSize: sliceSize, Files: files}
+	return s.Bytes()
+}
+
+// ID returns the id of the set.
+func (s *Set) ID() [16]byte {
+	return md5.Sum(s.mainBody())
+}
+
+// Bytes returns a par2 file holding the packets of the set.
+func (s *Set) Bytes() []byte {
+	setID := s.ID()
+	b := Packet(setID, "PAR 2.0\x00Main", s.mainBody())
+	for _, f := range s.Files {
+		b = append(b, s.describe(setID, f)...)
+		id := FileID(f)
+		ifsc := id[:]
+		for off := 0; off < len(f.Data); off += s.SliceSize {
+			slice := make([]byte, s.SliceSize)
+			copy(slice, f.Data[off:])
+			sum := md5.Sum(slice)
+			ifsc = append(ifsc, sum[:]...)
+			ifsc = binary.LittleEndian.AppendUint32(ifsc, crc32.ChecksumIEEE(slice))
+		}
+		b = append(b, Packet(setID, "PAR 2.0\x00IFSC", ifsc)...)
+	}
+	for _, f := range s.NonRecoverable {
+		b = append(b, s.describe(setID, f)...)
+	}
+	if s.Creator != "" {
+		b = append(b, Packet(setID, "PAR 2.0\x00Creator", pad([]byte(s.Creator)))...)
+	}
+	var asciiSum [16]byte
+	if s.Comment != "" {
+		comment := pad([]byte(s.Comment))
+		asciiSum = md5.Sum(comment)
+		b = append(b, Packet(setID, "PAR 2.0\x00CommASCI", comment)...)
+	}
+	if s.UnicodeComment != "" {
+		body := append(asciiSum[:], unicode(s.UnicodeComment)...)
+		b = append(b, Packet(setID, "PAR 2.0\x00CommUni", body)...)
+	}
+	for _, exp := range s.Exponents {
+		body := binary.LittleEndian.AppendUint32(nil, uint32(exp))
+		body = append(body, make([]byte, s.SliceSize)...)
+		b = append(b, Packet(setID, "PAR 2.0\x00RecvSlic", body)...)
+	}
+	return b
+}
+
+// describe returns the packets that describe f.
+func (s *Set) describe(setID [16]byte, f File) []byte {
+	id := FileID(f)
+	full := md5.Sum(f.Data)
+	hash16k := md5.Sum(first16k(f.Data))
+	desc := append(id[:], full[:]...)
+	desc = append(desc, hash16k[:]...)
+	desc = binary.LittleEndian.AppendUint64(desc, uint64(len(f.Data)))
+	b := Packet(setID, "PAR 2.0\x00FileDesc", append(desc, pad([]byte(f.Name))...))
+	if s.UnicodeNames {
+		b = append(b, Packet(setID, "PAR 2.0\x00UniFileN", append(id[:], unicode(f.Name)...))...)
+	}
+	return b
+}
+
+func (s *Set) mainBody() []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(s.SliceSize))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(s.Files)))
+	files := append(append([]File(nil), s.Files...), s.NonRecoverable...)
+	for _, f := range files {
+		id := FileID(f)
+		b = append(b, id[:]...)
+	}
+	return b
+}
+
+// pad pads b with zeros to a multiple of 4 bytes, like strings in packets are.
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// unicode returns s in little endian UTF-16, padded.
+func unicode(s string) []byte {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = binary.LittleEndian.AppendUint16(b, u)
+	}
+	return pad(b)
+}
+
+func first16k(b []byte) []byte {
+	if len(b) > 16*1024 {
+		return b[:16*1024]
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package par2
+
+import (
+	"crypto/md5"
+	"hash/crc32"
+	"io"
+	"math/big"
+)
+
+// rollingCRC computes the CRC32 of a window of bytes that slides along a
+// file one byte at a time, without going over the whole window each time.
+type rollingCRC struct {
+	window int
+	// out[b] takes byte b out of the front of the window
+	out [256]uint32
+}
+
+func newRollingCRC(window int) *rollingCRC {
+	// The CRC is linear, so taking out the front byte is xoring with the
+	// CRC of the byte followed by zeros for the rest of the window, adjusted
+	// for the bits that the standard CRC32 flips at the start and end.
+	// That is worked out once for each bit and combined for every byte.
+	zeros := make([]byte, window)
+	withBit := func(b byte) uint32 {
+		crc := crc32.Update(0, crc32.IEEETable, []byte{b})
+		return crc32.Update(crc, crc32.IEEETable, zeros)
+	}
+	z0 := crc32.ChecksumIEEE(zeros)
+	z1 := withBit(0)
+	var bits [8]uint32
+	for i := range bits {
+		bits[i] = withBit(1<<uint(i)) ^ z1
+	}
+	r := &rollingCRC{window: window}
+	for b := range r.out {
+		crc := z1 ^ z0
+		for i := range bits {
+			if b&(1<<uint(i)) != 0 {
+				crc ^= bits[i]
+			}
+		}
+		r.out[b] = crc
+	}
+	return r
+}
+
+// roll returns the CRC of the window moved a byte on, given the CRC of
+// the window, the byte leaving it at the front and the one entering it.
+func (r *rollingCRC) roll(crc uint32, out, in byte) uint32 {
+	// crc32.Update for a single byte, without making a slice of it
+	crc = ^crc
+	crc = crc32.IEEETable[byte(crc)^in] ^ crc>>8
+	return ^crc ^ r.out[out]
+}
+
+// scan looks for the blocks of the set anywhere in the data read from r,
+// not just at the offsets of whole blocks, so that blocks are found in
+// files that have had bytes added or lost. Like par2cmdline, it slides a
+// window along the data and only hashes it when its CRC is one in the set.
+func (fset *Fileset) scan(r io.Reader, path string) (*FileMatch, int, error) {
+	L := int(fset.slicelen)
+	// room for two windows and the zeros that pad the last block
+	buf := make([]byte, 3*L)
+	pos, end := 0, 0
+	// where the data ends in buf, once all of it has been read
+	eof, dataEnd := false, 0
+	var crc uint32
+	fresh := true
+
+	match := &FileMatch{}
+	var blocks *big.Int
+	for {
+		if end-pos <= L && !eof {
+			copy(buf, buf[pos:end])
+			end -= pos
+			pos = 0
+			n, err := io.ReadFull(r, buf[end:2*L])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// the par2 spec says that the last block
+				// of a file is padded with zeros.
+				eof, dataEnd = true, end
+				for i := end; i < end+L-1; i++ {
+					buf[i] = 0
+				}
+				end += L - 1
+			} else if err != nil {
+				return nil, 0, err
+			}
+		}
+		if pos+L > end || (eof && pos >= dataEnd) {
+			break
+		}
+		window := buf[pos : pos+L]
+		if fresh {
+			crc = crc32.ChecksumIEEE(window)
+			fresh = false
+		}
+		if _, ok := fset.crcs[crc]; ok {
+			if f, ok := fset.checksums[md5.Sum(window)]; ok && (match.File == nil || match.File == f.File) {
+				if match.File == nil {
+					// ok we have a match, init the block bitmap
+					blocks = &big.Int{}
+					match.File = f.File
+					match.Path = path
+				}
+				blocks.SetBit(blocks, f.blockno, 1)
+				pos += L
+				fresh = true
+				continue
+			}
+		}
+		if pos+L == end {
+			break
+		}
+		crc = fset.rolling.roll(crc, buf[pos], buf[pos+L])
+		pos++
+	}
+	if match.File == nil {
+		// not part of the recovery set.
+		return nil, 0, nil
+	}
+	match.setBlocks(fset, blocks)
+	return match, len(match.Missing), nil
+}
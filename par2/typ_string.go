@@ -4,9 +4,9 @@ package par2
 
 import "fmt"
 
-const _typ_name = "typeUnknowntypeMaintypeFileDesctypeIFSCtypeRecvSlictypeCreator"
+const _typ_name = "typeUnknowntypeMaintypeFileDesctypeIFSCtypeRecvSlictypeCreatortypeUniFileNtypeCommASCItypeCommUni"
 
-var _typ_index = [...]uint8{11, 19, 31, 39, 51, 62}
+var _typ_index = [...]uint8{11, 19, 31, 39, 51, 62, 74, 86, 97}
 
 func (i typ) String() string {
 	if i < 0 || i >= typ(len(_typ_index)) {
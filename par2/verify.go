@@ -0,0 +1,254 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package par2
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Verify verifies the files at paths against the fileset.
+// It returns a list of matches and how many blocks are needed in order to
+// repair. Files outside the recovery set are reported, but aren't counted
+// in the blocks needed, since they can't be repaired.
+// Files that are complete are found by their first 16KiB and confirmed by
+// their hashes, only the rest are scanned for blocks, which are found even
+// if they have moved. Files are verified concurrently, and so are the
+// blocks of large files, but the results are the same as if they weren't.
+func (f *Fileset) Verify(paths []string) ([]*FileMatch, int) {
+	return f.verify(len(paths), func(i int) (*source, error) {
+		file, err := os.Open(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &source{paths[i], file, fi.Size(), file}, nil
+	})
+}
+
+// VerifyFS is like Verify, but verifies the files with names in fsys.
+// Files that can't be read at an offset, because they don't implement
+// io.ReaderAt, are read into memory.
+func (f *Fileset) VerifyFS(fsys fs.FS, names []string) ([]*FileMatch, int) {
+	return f.verify(len(names), func(i int) (*source, error) {
+		file, err := fsys.Open(names[i])
+		if err != nil {
+			return nil, err
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if r, ok := file.(io.ReaderAt); ok {
+			return &source{names[i], r, fi.Size(), file}, nil
+		}
+		defer file.Close()
+		b, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, err
+		}
+		return &source{names[i], bytes.NewReader(b), int64(len(b)), nil}, nil
+	})
+}
+
+// Source is data to be verified by VerifyReaders.
+type Source struct {
+	// Name is the name of the file the data is from.
+	// It is the Path of the FileMatch for the data.
+	Name string
+	Data io.ReaderAt
+	Size int64
+}
+
+// VerifyReaders is like Verify, but verifies the data in sources. It can
+// be used for files that are in memory, or that are still being written.
+func (f *Fileset) VerifyReaders(sources []Source) ([]*FileMatch, int) {
+	return f.verify(len(sources), func(i int) (*source, error) {
+		s := sources[i]
+		return &source{s.Name, s.Data, s.Size, nil}, nil
+	})
+}
+
+// source is a file being verified.
+type source struct {
+	name string
+	r    io.ReaderAt
+	size int64
+	// closed when the file has been verified, if not nil
+	closer io.Closer
+}
+
+// verify verifies n files, opening the i'th with open.
+func (f *Fileset) verify(n int, open func(i int) (*source, error)) ([]*FileMatch, int) {
+	if !f.complete {
+		return nil, 0
+	}
+	workers := f.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	v := &verifier{
+		fset: f,
+		sem:  make(chan struct{}, workers),
+	}
+	results := make([]*FileMatch, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = v.verifyfile(func() (*source, error) { return open(i) })
+		}(i)
+	}
+	wg.Wait()
+
+	files := make(map[*File]struct{}, len(f.files))
+	for _, v := range f.files {
+		files[v] = struct{}{}
+	}
+	matches := make([]*FileMatch, 0, n)
+	blocksNeeded := 0
+	for _, fm := range results {
+		if fm != nil && fm.File != nil {
+			delete(files, fm.File)
+			if fm.File.Recoverable() {
+				blocksNeeded += len(fm.Missing)
+			}
+			matches = append(matches, fm)
+		}
+	}
+	missing := make([]*File, 0, len(files))
+	for fi := range files {
+		missing = append(missing, fi)
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i].Name < missing[j].Name })
+	for _, fi := range missing {
+		fm := &FileMatch{Err: ErrMissing, Status: StatusMissing, File: fi}
+		fm.setBlocks(f, &big.Int{})
+		matches = append(matches, fm)
+		if fi.Recoverable() {
+			blocksNeeded += len(fm.Missing)
+		}
+	}
+	return matches, blocksNeeded
+}
+
+// files larger than this are checked in pieces this large,
+// rounded to whole blocks, instead of being hashed in one go.
+const chunkSize = 4 << 20
+
+// verifier verifies files concurrently.
+type verifier struct {
+	fset *Fileset
+	// held while reading and hashing, to limit how much is done at once.
+	sem chan struct{}
+}
+
+func (v *verifier) acquire() { v.sem <- struct{}{} }
+func (v *verifier) release() { <-v.sem }
+
+// verifyfile verifies the file opened by open.
+func (v *verifier) verifyfile(open func() (*source, error)) *FileMatch {
+	v.acquire()
+	defer v.release()
+	fset := v.fset
+	src, err := open()
+	if err != nil {
+		return &FileMatch{Err: err}
+	}
+	if src.closer != nil {
+		defer src.closer.Close()
+	}
+
+	// most files are fine, so try to avoid scanning for blocks.
+	r := io.NewSectionReader(src.r, 0, src.size)
+	if f, full := fset.candidate(r, src.size); f != nil {
+		var ok bool
+		if src.size > chunkSize && len(f.checksums) == f.numBlocks(fset) {
+			// an MD5 of all of the file can't be split up,
+			// so check that every block is where it should be instead.
+			// Files outside the recovery set have no block checksums,
+			// so they are hashed in one go whatever their size.
+			v.release()
+			ok = v.checkBlocks(io.NewSectionReader(src.r, 0, src.size), f)
+			v.acquire()
+		} else if _, err := io.Copy(full, r); err == nil {
+			var sum [16]byte
+			full.Sum(sum[:0])
+			ok = sum == f.hashFull
+		}
+		if ok {
+			blocks := new(big.Int).Lsh(big.NewInt(1), uint(f.numBlocks(fset)))
+			blocks.Sub(blocks, big.NewInt(1))
+			match := &FileMatch{Path: src.name, File: f}
+			match.setBlocks(fset, blocks)
+			return match
+		}
+	}
+
+	match, _, err := fset.scan(io.NewSectionReader(src.r, 0, src.size), src.name)
+	if err != nil {
+		return &FileMatch{Err: err}
+	}
+	return match
+}
+
+// checkBlocks reports whether every block of f is found at its offset
+// in r. Pieces of the file are checked concurrently.
+func (v *verifier) checkBlocks(r io.ReaderAt, f *File) bool {
+	fset := v.fset
+	n := f.numBlocks(fset)
+	if len(f.checksums) != n {
+		return false
+	}
+	per := int(chunkSize / fset.slicelen)
+	if per == 0 {
+		per = 1
+	}
+	var failed int32
+	var wg sync.WaitGroup
+	for first := 0; first < n; first += per {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+			v.acquire()
+			defer v.release()
+			buf := make([]byte, fset.slicelen)
+			for b := first; b < first+per && b < n; b++ {
+				if atomic.LoadInt32(&failed) != 0 {
+					return
+				}
+				m, err := r.ReadAt(buf, int64(b)*int64(fset.slicelen))
+				if err != nil && err != io.EOF {
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+				// the last block is padded with zeros
+				for i := m; i < len(buf); i++ {
+					buf[i] = 0
+				}
+				if md5.Sum(buf) != f.checksums[b] {
+					atomic.StoreInt32(&failed, 1)
+					return
+				}
+			}
+		}(first)
+	}
+	wg.Wait()
+	return failed == 0
+}
@@ -0,0 +1,215 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the progress display. On a terminal, it redraws a
+// block of status lines in place. Otherwise it prints a plain status
+// line every once in a while.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/download"
+)
+
+const (
+	ttyInterval   = 500 * time.Millisecond
+	plainInterval = 10 * time.Second
+	// the window that download speed is averaged over
+	speedWindow = 5 * time.Second
+	// the maximum number of unfinished files shown
+	maxFileLines = 5
+	maxLineLen   = 79
+)
+
+type sample struct {
+	t     time.Time
+	bytes int64
+}
+
+type progressDisplay struct {
+	mu      sync.Mutex
+	out     *os.File
+	tty     bool
+	d       *download.Downloader
+	job     *download.Job
+	lines   int
+	samples []sample
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newProgressDisplay(out *os.File) *progressDisplay {
+	p := &progressDisplay{
+		out:     out,
+		tty:     isTerminal(out),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// setJob makes the display show progress for j.
+func (p *progressDisplay) setJob(d *download.Downloader, j *download.Job) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.d = d
+	p.job = j
+	p.samples = p.samples[:0]
+}
+
+// Write lets the display be used for log output. On a terminal, the
+// output is printed above the status lines, otherwise it goes to stderr.
+func (p *progressDisplay) Write(b []byte) (int, error) {
+	if !p.tty {
+		return os.Stderr.Write(b)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.out.Write(b)
+	p.draw(time.Now())
+	return n, err
+}
+
+// close stops the display, printing the final status.
+func (p *progressDisplay) close() {
+	close(p.stop)
+	<-p.stopped
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	p.draw(time.Now())
+	p.lines = 0
+}
+
+func (p *progressDisplay) run() {
+	defer close(p.stopped)
+	interval := plainInterval
+	if p.tty {
+		interval = ttyInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-tick.C:
+			p.mu.Lock()
+			p.clear()
+			p.draw(now)
+			p.mu.Unlock()
+		}
+	}
+}
+
+// clear removes the status lines from the terminal.
+func (p *progressDisplay) clear() {
+	if !p.tty || p.lines == 0 {
+		return
+	}
+	fmt.Fprintf(p.out, "\x1b[%dA\x1b[J", p.lines)
+	p.lines = 0
+}
+
+func (p *progressDisplay) draw(now time.Time) {
+	if p.job == nil {
+		return
+	}
+	prog := p.job.Progress()
+	p.samples = append(p.samples, sample{now, prog.BytesDone})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].t) > speedWindow {
+		p.samples = p.samples[1:]
+	}
+	var speed float64
+	if first := p.samples[0]; now.After(first.t) {
+		speed = float64(prog.BytesDone-first.bytes) / now.Sub(first.t).Seconds()
+	}
+	status := statusLine(p.job.Name, prog, speed, p.d.Connections())
+	if !p.tty {
+		fmt.Fprintln(p.out, status)
+		return
+	}
+
+	lines := []string{status}
+	for _, f := range prog.FileProgress {
+		if f.Done {
+			continue
+		}
+		if len(lines) > maxFileLines {
+			lines = append(lines, "  ...")
+			break
+		}
+		line := fmt.Sprintf("  %s %s/%s %s", percent(f.BytesDone, f.Bytes),
+			humanBytes(f.BytesDone), humanBytes(f.Bytes), f.Name)
+		if f.SegmentsFailed != 0 {
+			line += fmt.Sprintf(" (%d failed)", f.SegmentsFailed)
+		}
+		lines = append(lines, line)
+	}
+	for i, l := range lines {
+		// wrapped lines would throw off clearing
+		if len(l) > maxLineLen {
+			lines[i] = l[:maxLineLen-3] + "..."
+		}
+	}
+	fmt.Fprintln(p.out, strings.Join(lines, "\n"))
+	p.lines = len(lines)
+}
+
+// statusLine returns the line summing up the progress of the job called
+// name, downloading at speed bytes per second over conns connections.
+func statusLine(name string, prog download.Progress, speed float64, conns int) string {
+	status := fmt.Sprintf("%s: %s %s/%s %s/s ETA %s, %d/%d files, %d connections",
+		name, percent(prog.BytesDone, prog.Bytes),
+		humanBytes(prog.BytesDone), humanBytes(prog.Bytes), humanBytes(int64(speed)),
+		eta(prog.Bytes-prog.BytesDone, speed), prog.FilesDone, prog.Files, conns)
+	if prog.SegmentsFailed != 0 {
+		status += fmt.Sprintf(", %d segments failed", prog.SegmentsFailed)
+	}
+	return status
+}
+
+// eta returns how long it takes to download left bytes at speed
+// bytes per second, in whole seconds.
+func eta(left int64, speed float64) string {
+	if speed <= 0 {
+		return "--"
+	}
+	return (time.Duration(float64(left)/speed) * time.Second).String()
+}
+
+func percent(n, total int64) string {
+	if total == 0 {
+		return "  0.0%"
+	}
+	return fmt.Sprintf("%5.1f%%", float64(n)*100/float64(total))
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,92 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"testing"
+
+	"github.com/DanielMorsing/gonzbee/download"
+)
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		n, total int64
+		want     string
+	}{
+		{0, 0, "  0.0%"},
+		{0, 100, "  0.0%"},
+		{1, 3, " 33.3%"},
+		{100, 100, "100.0%"},
+	}
+	for _, tt := range tests {
+		if got := percent(tt.n, tt.total); got != tt.want {
+			t.Errorf("percent(%d, %d) = %q, expected %q", tt.n, tt.total, got, tt.want)
+		}
+	}
+}
+
+func TestHumanBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{1 << 40, "1.0 TiB"},
+	}
+	for _, tt := range tests {
+		if got := humanBytes(tt.n); got != tt.want {
+			t.Errorf("humanBytes(%d) = %q, expected %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestETA(t *testing.T) {
+	tests := []struct {
+		left  int64
+		speed float64
+		want  string
+	}{
+		{1000, 0, "--"},
+		{1000, -1, "--"},
+		{0, 100, "0s"},
+		{1000, 100, "10s"},
+		// parts of a second are dropped
+		{1050, 100, "10s"},
+		{3 << 20, 1024, "51m12s"},
+		{36000, 10, "1h0m0s"},
+	}
+	for _, tt := range tests {
+		if got := eta(tt.left, tt.speed); got != tt.want {
+			t.Errorf("eta(%d, %v) = %q, expected %q", tt.left, tt.speed, got, tt.want)
+		}
+	}
+}
+
+func TestStatusLine(t *testing.T) {
+	prog := download.Progress{
+		Files:     4,
+		FilesDone: 1,
+		Bytes:     4 << 20,
+		BytesDone: 1 << 20,
+	}
+	want := "show:  25.0% 1.0 MiB/4.0 MiB 512.0 KiB/s ETA 6s, 1/4 files, 8 connections"
+	if got := statusLine("show", prog, 512*1024, 8); got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	prog.SegmentsFailed = 3
+	want += ", 3 segments failed"
+	if got := statusLine("show", prog, 512*1024, 8); got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	// nothing downloaded yet
+	want = "show:   0.0% 0 B/0 B 0 B/s ETA --, 0/0 files, 0 connections"
+	if got := statusLine("show", download.Progress{}, 0, 0); got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
@@ -0,0 +1,326 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package queue implements a persistent queue of NZB jobs.
+//
+// The queue lives in a directory, holding a copy of every queued NZB and
+// a state file that is rewritten on every change, so that the queue
+// survives restarts.
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Status is the stage a queued job is in.
+type Status string
+
+const (
+	Pending     Status = "pending"
+	Paused      Status = "paused" // stays in the queue, but isn't picked by Next
+	Downloading Status = "downloading"
+	Verifying   Status = "verifying"
+	Repairing   Status = "repairing"
+	Unpacking   Status = "unpacking"
+	Done        Status = "done"
+	Failed      Status = "failed"
+)
+
+// Active reports whether a job in this status is being worked on.
+func (s Status) Active() bool {
+	return s == Downloading || s == Verifying || s == Repairing || s == Unpacking
+}
+
+// Finished reports whether a job in this status is in the history.
+func (s Status) Finished() bool {
+	return s == Done || s == Failed
+}
+
+// Item is a job in the queue.
+type Item struct {
+	ID   int64
+	Name string
+	// Dir is the directory the job downloads to.
+	Dir      string
+	Category string `json:",omitempty"`
+	// Source is the path the NZB was picked up from, if it came from
+	// a watched directory.
+	Source string `json:",omitempty"`
+	// Bytes is the size of the job, as given by the NZB.
+	Bytes int64 `json:",omitempty"`
+	// Jobs with a higher priority are processed first.
+	// Jobs with the same priority are processed in the order they were added.
+	Priority int
+	Status   Status
+	// Error is set for failed jobs.
+	Error    string
+	Added    time.Time
+	Finished time.Time `json:",omitempty"`
+	// ScriptLog is the output of the script run after the job finished.
+	ScriptLog string `json:",omitempty"`
+}
+
+// ErrNotFound is returned for operations on items that aren't in the queue.
+var ErrNotFound = errors.New("queue: no such job")
+
+const stateFile = "queue.json"
+
+// Queue is a persistent job queue. It is safe for concurrent use.
+type Queue struct {
+	dir string
+
+	mu      sync.Mutex
+	nextID  int64
+	items   []*Item
+	changed chan struct{}
+}
+
+type state struct {
+	NextID int64
+	Items  []*Item
+}
+
+// Open opens the queue in dir, creating it if needed.
+// Jobs that were active when the queue was last saved are set back to pending,
+// so that they are picked up again.
+func Open(dir string) (*Queue, error) {
+	err := os.MkdirAll(filepath.Join(dir, "nzb"), 0777)
+	if err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:     dir,
+		nextID:  1,
+		changed: make(chan struct{}),
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var st state
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return nil, err
+	}
+	q.items = st.Items
+	q.nextID = st.NextID
+	for _, it := range q.items {
+		if it.Status.Active() {
+			it.Status = Pending
+		}
+		if it.ID >= q.nextID {
+			q.nextID = it.ID + 1
+		}
+	}
+	return q, nil
+}
+
+// Add adds a job for the NZB contents in nzb. The name, directory,
+// priority, category and source are taken from it.
+func (q *Queue) Add(it Item, nzb []byte) (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it.ID = q.nextID
+	it.Status = Pending
+	it.Error = ""
+	it.Added = time.Now()
+	it.Finished = time.Time{}
+	it.ScriptLog = ""
+	err := ioutil.WriteFile(q.nzbPath(it.ID), nzb, 0666)
+	if err != nil {
+		return Item{}, err
+	}
+	q.nextID++
+	q.items = append(q.items, &it)
+	return it, q.save()
+}
+
+// NZBPath returns the path of the stored NZB for the job with id.
+func (q *Queue) NZBPath(id int64) string {
+	return q.nzbPath(id)
+}
+
+func (q *Queue) nzbPath(id int64) string {
+	return filepath.Join(q.dir, "nzb", strconv.FormatInt(id, 10)+".nzb")
+}
+
+// Get returns the job with id.
+func (q *Queue) Get(id int64) (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.find(id)
+	if it == nil {
+		return Item{}, ErrNotFound
+	}
+	return *it, nil
+}
+
+// Items returns every job, unfinished jobs first in the order they will
+// be processed, followed by the history with the most recent first.
+func (q *Queue) Items() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]Item, 0, len(q.items))
+	for _, it := range q.items {
+		items = append(items, *it)
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		a, b := &items[i], &items[j]
+		if a.Status.Finished() != b.Status.Finished() {
+			return !a.Status.Finished()
+		}
+		if a.Status.Finished() {
+			return a.Finished.After(b.Finished)
+		}
+		if a.Status.Active() != b.Status.Active() {
+			return a.Status.Active()
+		}
+		return before(a, b)
+	})
+	return items
+}
+
+// before reports whether a should be processed before b.
+func before(a, b *Item) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.ID < b.ID
+}
+
+// Next returns the pending job that should be processed next
+// and marks it as downloading. ok is false if there are no pending jobs.
+func (q *Queue) Next() (it Item, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var next *Item
+	for _, it := range q.items {
+		if it.Status != Pending {
+			continue
+		}
+		if next == nil || before(it, next) {
+			next = it
+		}
+	}
+	if next == nil {
+		return Item{}, false, nil
+	}
+	next.Status = Downloading
+	return *next, true, q.save()
+}
+
+// SetStatus changes the status of the job with id. msg is recorded as
+// the error message of failed jobs.
+func (q *Queue) SetStatus(id int64, s Status, msg string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.find(id)
+	if it == nil {
+		return ErrNotFound
+	}
+	if it.Status == s && it.Error == msg {
+		return nil
+	}
+	it.Status = s
+	it.Error = msg
+	if s.Finished() {
+		it.Finished = time.Now()
+	} else {
+		it.Finished = time.Time{}
+	}
+	return q.save()
+}
+
+// SetPriority changes the priority of the job with id.
+func (q *Queue) SetPriority(id int64, priority int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.find(id)
+	if it == nil {
+		return ErrNotFound
+	}
+	it.Priority = priority
+	return q.save()
+}
+
+// SetDir changes the directory of the job with id, for jobs whose
+// directory was renamed.
+func (q *Queue) SetDir(id int64, dir string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.find(id)
+	if it == nil {
+		return ErrNotFound
+	}
+	it.Dir = dir
+	return q.save()
+}
+
+// SetScriptLog records the output of the script run for the job with id.
+func (q *Queue) SetScriptLog(id int64, log string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.find(id)
+	if it == nil {
+		return ErrNotFound
+	}
+	it.ScriptLog = log
+	return q.save()
+}
+
+// Remove removes the job with id and its stored NZB.
+func (q *Queue) Remove(id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, it := range q.items {
+		if it.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			os.Remove(q.nzbPath(id))
+			return q.save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Changed returns a channel that is closed the next time the queue changes.
+func (q *Queue) Changed() <-chan struct{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.changed
+}
+
+func (q *Queue) find(id int64) *Item {
+	for _, it := range q.items {
+		if it.ID == id {
+			return it
+		}
+	}
+	return nil
+}
+
+// save writes the state file. It must be called with q.mu held.
+func (q *Queue) save() error {
+	close(q.changed)
+	q.changed = make(chan struct{})
+	b, err := json.MarshalIndent(state{NextID: q.nextID, Items: q.items}, "", "\t")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.dir, stateFile)
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,112 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package queue_test
+
+import (
+	"io/ioutil"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/queue"
+)
+
+func openQueue(t *testing.T, dir string) *Queue {
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func add(t *testing.T, q *Queue, name string, priority int) Item {
+	it, err := q.Add(Item{Name: name, Dir: "/tmp/" + name, Priority: priority}, []byte("<nzb/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return it
+}
+
+func TestPriorityOrder(t *testing.T) {
+	q := openQueue(t, t.TempDir())
+	add(t, q, "low", 0)
+	add(t, q, "high", 10)
+	add(t, q, "low2", 0)
+	add(t, q, "high2", 10)
+
+	var order []string
+	for {
+		it, ok, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		if it.Status != Downloading {
+			t.Errorf("expected next job to be downloading, was %s", it.Status)
+		}
+		order = append(order, it.Name)
+	}
+	exp := []string{"high", "high2", "low", "low2"}
+	for i := range exp {
+		if i >= len(order) || order[i] != exp[i] {
+			t.Fatalf("expected order %v, got %v", exp, order)
+		}
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir := t.TempDir()
+	q := openQueue(t, dir)
+	a := add(t, q, "a", 0)
+	b := add(t, q, "b", 0)
+	c := add(t, q, "c", 0)
+	q.Next()
+	q.SetStatus(a.ID, Verifying, "")
+	q.SetStatus(b.ID, Failed, "no server")
+
+	q = openQueue(t, dir)
+	items := q.Items()
+	if len(items) != 3 {
+		t.Fatalf("expected 3 items, got %d", len(items))
+	}
+	it, err := q.Get(a.ID)
+	if err != nil || it.Status != Pending {
+		t.Errorf("interrupted job should be pending after reopen, got %+v %v", it, err)
+	}
+	it, err = q.Get(b.ID)
+	if err != nil || it.Status != Failed || it.Error != "no server" || it.Finished.IsZero() {
+		t.Errorf("failed job should stay failed, got %+v %v", it, err)
+	}
+	d := add(t, q, "d", 0)
+	if d.ID <= c.ID {
+		t.Errorf("reused id %d", d.ID)
+	}
+	b2, err := ioutil.ReadFile(q.NZBPath(c.ID))
+	if err != nil || string(b2) != "<nzb/>" {
+		t.Errorf("stored nzb lost: %q %v", b2, err)
+	}
+
+	err = q.Remove(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Get(c.ID); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	q := openQueue(t, t.TempDir())
+	ch := q.Changed()
+	select {
+	case <-ch:
+		t.Fatal("changed before any change")
+	default:
+	}
+	it := add(t, q, "a", 0)
+	<-ch
+	ch = q.Changed()
+	q.SetPriority(it.ID, 5)
+	<-ch
+}
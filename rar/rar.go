@@ -0,0 +1,454 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package rar reads RAR archives in the RAR 4 and RAR 5 formats.
+//
+// Archives can span several volumes. Only files stored without compression
+// can be extracted, which is how archives posted to Usenet are usually made.
+// Compressed files are listed, but reading them returns ErrUnsupported.
+// Encryption isn't supported: encrypted files are listed, but reading them
+// returns ErrEncrypted, as does opening an archive whose headers are encrypted.
+//
+// A Reader works like an archive/tar Reader:
+//
+//	r, err := rar.OpenReader("example.part1.rar")
+//	if err != nil {
+//		return err
+//	}
+//	defer r.Close()
+//	for {
+//		hdr, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		// read the contents of hdr.Name from r
+//	}
+package rar
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrFormat is returned for data that isn't a RAR archive, or that is damaged.
+	ErrFormat = errors.New("rar: not a valid RAR archive")
+	// ErrUnsupported is returned when reading files compressed with a method
+	// that this package doesn't implement.
+	ErrUnsupported = errors.New("rar: unsupported compression method")
+	// ErrEncrypted is returned for archives whose headers are encrypted,
+	// and when reading encrypted files.
+	ErrEncrypted = errors.New("rar: encrypted archives are not supported")
+	// ErrChecksum is returned when the contents of a file don't match its checksum.
+	ErrChecksum = errors.New("rar: checksum error")
+)
+
+// FileHeader describes a file in an archive.
+type FileHeader struct {
+	// Name is the path of the file in the archive, with forward slashes.
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+	// Encrypted is set for files whose contents are encrypted.
+	// They can't be read.
+	Encrypted bool
+	// Stored is set for files that aren't compressed. Only those can be read.
+	Stored bool
+}
+
+// A VolumeOpener opens the volume with number n of an archive,
+// counting from 0.
+type VolumeOpener func(n int) (io.ReadCloser, error)
+
+// Reader reads the files of an archive in order.
+type Reader struct {
+	open VolumeOpener
+
+	volNum int
+	vol    *volume
+
+	// the part of the current file in the current volume
+	cur *block
+	// packed bytes of cur left to read
+	left int64
+	// reads the unpacked contents of the current file
+	file io.Reader
+	err  error
+}
+
+// NewReader returns a Reader for the archive whose volumes are opened by open.
+func NewReader(open VolumeOpener) (*Reader, error) {
+	r := &Reader{open: open}
+	err := r.openVolume(0)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OpenReader opens the archive whose first volume is the file called name.
+// The following volumes are found with VolumeName.
+func OpenReader(name string) (*Reader, error) {
+	return NewReader(func(n int) (io.ReadCloser, error) {
+		return os.Open(VolumeName(name, n))
+	})
+}
+
+var (
+	partRegexp = regexp.MustCompile(`(?i)\.part(\d+)\.rar$`)
+	rarRegexp  = regexp.MustCompile(`(?i)\.rar$`)
+)
+
+// VolumeName returns the name of volume n of the archive whose first volume
+// is called first. Archives named like example.part01.rar are numbered by
+// their part number. Otherwise, volumes are named in the old style, where
+// example.rar is followed by example.r00, example.r01 and so on.
+func VolumeName(first string, n int) string {
+	dir, base := filepath.Split(first)
+	if m := partRegexp.FindStringSubmatchIndex(base); m != nil {
+		digits := m[3] - m[2]
+		num := fmt.Sprintf("%0*d", digits, n+1)
+		return dir + base[:m[2]] + num + base[m[3]:]
+	}
+	if n == 0 {
+		return first
+	}
+	stem := base
+	ext := "r"
+	if m := rarRegexp.FindStringIndex(base); m != nil {
+		stem = base[:m[0]]
+		if base[m[0]+1] == 'R' {
+			ext = "R"
+		}
+	}
+	// after .r99 comes .s00
+	letter := ext[0] + byte((n-1)/100)
+	return fmt.Sprintf("%s%s.%c%02d", dir, stem, letter, (n-1)%100)
+}
+
+// IsFirstVolume reports whether name looks like the first volume of an
+// archive, according to the naming rules of VolumeName.
+func IsFirstVolume(name string) bool {
+	base := filepath.Base(name)
+	if m := partRegexp.FindStringSubmatch(base); m != nil {
+		n, err := strconv.Atoi(m[1])
+		return err == nil && n == 1
+	}
+	return rarRegexp.MatchString(base)
+}
+
+// VolumeInfo describes a volume of an archive.
+type VolumeInfo struct {
+	// Multi is set for volumes of archives with several volumes.
+	Multi bool
+	// Number is the number of the volume, counting from 0. It is -1 if
+	// the volume doesn't record it, as with RAR 4 volumes after the first.
+	Number int
+}
+
+// ReadVolumeInfo reads the main header of the volume read from r.
+// Together with IsFirstVolume and VolumeName, it can be used to
+// name volumes whose names have been lost. ErrEncrypted is returned
+// for archives whose headers are encrypted.
+func ReadVolumeInfo(r io.Reader) (*VolumeInfo, error) {
+	v, err := newVolume(ioutil.NopCloser(r))
+	if err != nil {
+		return nil, err
+	}
+	return v.info()
+}
+
+func (r *Reader) openVolume(n int) error {
+	rc, err := r.open(n)
+	if err != nil {
+		return err
+	}
+	v, err := newVolume(rc)
+	if err != nil {
+		rc.Close()
+		return err
+	}
+	if r.vol != nil {
+		r.vol.rc.Close()
+	}
+	r.vol = v
+	r.volNum = n
+	return nil
+}
+
+// Next advances to the next file in the archive, skipping what is
+// left of the current one. It returns io.EOF at the end of the archive.
+func (r *Reader) Next() (*FileHeader, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if r.cur != nil {
+		// skip the rest of the current file, including the
+		// parts of it in the next volumes.
+		_, err := io.Copy(ioutil.Discard, packedReader{r})
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		r.cur = nil
+	}
+	r.file = nil
+	for {
+		b, err := r.vol.next()
+		if err == io.EOF {
+			r.err = io.EOF
+			return nil, io.EOF
+		}
+		if err != nil {
+			r.err = err
+			return nil, err
+		}
+		if b.end {
+			if !b.nextVolume {
+				r.err = io.EOF
+				return nil, io.EOF
+			}
+			err = r.openVolume(r.volNum + 1)
+			if err != nil {
+				r.err = err
+				return nil, err
+			}
+			continue
+		}
+		if b.service || b.splitBefore {
+			// not a file, or the rest of a file that started
+			// in a volume before the first one we read.
+			err = r.vol.skip(b.packSize)
+			if err != nil {
+				r.err = err
+				return nil, err
+			}
+			continue
+		}
+		r.cur = b
+		r.left = b.packSize
+		err = r.startFile(b)
+		if err != nil {
+			// the header can still be returned, but
+			// reading the contents fails.
+			r.file = errReader{err}
+		}
+		hdr := b.FileHeader
+		return &hdr, nil
+	}
+}
+
+// startFile sets up the reader for the contents of the file starting at b.
+func (r *Reader) startFile(b *block) error {
+	if b.IsDir {
+		r.file = eofReader{}
+		return nil
+	}
+	if b.Encrypted {
+		return ErrEncrypted
+	}
+	if !b.Stored {
+		return ErrUnsupported
+	}
+	r.file = &checkReader{
+		r:    io.LimitReader(packedReader{r}, b.Size),
+		h:    crc32.NewIEEE(),
+		size: b.Size,
+		rd:   r,
+	}
+	return nil
+}
+
+// Read reads from the current file. It returns io.EOF at the end of
+// the file, and ErrChecksum if the file is damaged.
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.file == nil {
+		return 0, io.EOF
+	}
+	return r.file.Read(b)
+}
+
+// Close closes the open volume.
+func (r *Reader) Close() error {
+	r.err = errors.New("rar: reader closed")
+	if r.vol == nil {
+		return nil
+	}
+	return r.vol.rc.Close()
+}
+
+// packedReader reads the packed data of the current file,
+// moving on to the next volume when the file continues there.
+type packedReader struct {
+	r *Reader
+}
+
+func (p packedReader) Read(b []byte) (int, error) {
+	r := p.r
+	for r.left == 0 {
+		if !r.cur.splitAfter {
+			return 0, io.EOF
+		}
+		err := r.nextPart()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > r.left {
+		b = b[:r.left]
+	}
+	n, err := r.vol.br.Read(b)
+	r.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// nextPart opens the next volume and finds the continuation of the current file.
+func (r *Reader) nextPart() error {
+	err := r.openVolume(r.volNum + 1)
+	if err != nil {
+		return err
+	}
+	for {
+		b, err := r.vol.next()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if b.end {
+			return fmt.Errorf("rar: volume %d doesn't continue %s", r.volNum, r.cur.Name)
+		}
+		if b.service {
+			err = r.vol.skip(b.packSize)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !b.splitBefore || b.Name != r.cur.Name {
+			return fmt.Errorf("rar: volume %d doesn't continue %s", r.volNum, r.cur.Name)
+		}
+		r.cur = b
+		r.left = b.packSize
+		return nil
+	}
+}
+
+// checkReader checks the checksum of a file once it has been read.
+type checkReader struct {
+	r    io.Reader
+	h    hash.Hash32
+	size int64
+	n    int64
+	rd   *Reader
+}
+
+func (c *checkReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.h.Write(b[:n])
+	c.n += int64(n)
+	if err == io.EOF {
+		if c.n != c.size {
+			return n, io.ErrUnexpectedEOF
+		}
+		// the header of the last part has the checksum of the whole
+		// file. Skip any padding left, which might be in a new part.
+		if _, err := io.Copy(ioutil.Discard, packedReader{c.rd}); err != nil {
+			return n, err
+		}
+		last := c.rd.cur
+		if last.hasCRC && c.h.Sum32() != last.crc {
+			return n, ErrChecksum
+		}
+	}
+	return n, err
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// block is a header in a volume, in a form shared by both formats.
+type block struct {
+	FileHeader
+	// end is set for the end of archive header
+	end bool
+	// for end headers, whether there is another volume
+	nextVolume bool
+	// service is set for headers that don't describe a file
+	service bool
+
+	packSize    int64
+	splitBefore bool
+	splitAfter  bool
+	hasCRC      bool
+	crc         uint32
+}
+
+// volume reads the headers of a single volume.
+type volume struct {
+	rc io.ReadCloser
+	br *bufio.Reader
+	// the format specific header readers
+	next func() (*block, error)
+	info func() (*VolumeInfo, error)
+}
+
+func (v *volume) skip(n int64) error {
+	_, err := io.CopyN(ioutil.Discard, v.br, n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+var (
+	sig4 = []byte("Rar!\x1a\x07\x00")
+	sig5 = []byte("Rar!\x1a\x07\x01\x00")
+)
+
+func newVolume(rc io.ReadCloser) (*volume, error) {
+	v := &volume{rc: rc, br: bufio.NewReader(rc)}
+	sig, err := v.br.Peek(len(sig5))
+	if err != nil && len(sig) < len(sig4) {
+		return nil, ErrFormat
+	}
+	switch {
+	case string(sig) == string(sig5):
+		v.br.Discard(len(sig5))
+		h := &reader5{v: v}
+		v.next, v.info = h.next, h.info
+	case string(sig[:len(sig4)]) == string(sig4):
+		v.br.Discard(len(sig4))
+		h := &reader4{v: v}
+		v.next, v.info = h.next, h.info
+	default:
+		return nil, ErrFormat
+	}
+	return v, nil
+}
@@ -0,0 +1,298 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package rar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// RAR 4 header types
+const (
+	head4Main    = 0x73
+	head4File    = 0x74
+	head4Service = 0x7a
+	head4End     = 0x7b
+)
+
+// RAR 4 header flags
+const (
+	// main header
+	main4Volume   = 0x01
+	main4Password = 0x80
+	main4First    = 0x100
+
+	// file header
+	file4SplitBefore = 0x01
+	file4SplitAfter  = 0x02
+	file4Password    = 0x04
+	file4Dir         = 0xe0
+	file4Large       = 0x100
+	file4Unicode     = 0x200
+
+	// end of archive header
+	end4NextVolume = 0x01
+
+	// any header with data following it
+	head4LongBlock = 0x8000
+)
+
+const (
+	// the size of the fields common to all RAR 4 headers
+	head4Size = 7
+	// the size of the fixed fields of a file header
+	file4Size = 32
+	// the store method
+	method4Store = 0x30
+)
+
+// reader4 reads the headers of a volume in the RAR 4 format.
+type reader4 struct {
+	v *volume
+	// set if the headers after the main header are encrypted
+	encrypted bool
+}
+
+func (h *reader4) next() (*block, error) {
+	for {
+		hdr, err := h.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		typ := hdr[2]
+		flags := binary.LittleEndian.Uint16(hdr[3:])
+		switch typ {
+		case head4Main:
+			h.encrypted = flags&main4Password != 0
+		case head4File, head4Service:
+			return h.fileBlock(hdr, typ == head4Service)
+		case head4End:
+			return &block{end: true, nextVolume: flags&end4NextVolume != 0}, nil
+		default:
+			if flags&head4LongBlock != 0 {
+				if len(hdr) < head4Size+4 {
+					return nil, ErrFormat
+				}
+				err = h.v.skip(int64(binary.LittleEndian.Uint32(hdr[head4Size:])))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+}
+
+func (h *reader4) info() (*VolumeInfo, error) {
+	hdr, err := h.readHeader()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr[2] != head4Main {
+		return nil, ErrFormat
+	}
+	flags := binary.LittleEndian.Uint16(hdr[3:])
+	info := &VolumeInfo{Multi: flags&main4Volume != 0}
+	if info.Multi && flags&main4First == 0 {
+		// only the first volume is marked
+		info.Number = -1
+	}
+	return info, nil
+}
+
+// readHeader reads a complete header.
+func (h *reader4) readHeader() ([]byte, error) {
+	if h.encrypted {
+		return nil, ErrEncrypted
+	}
+	base, err := h.v.br.Peek(head4Size)
+	if err != nil {
+		if len(base) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	size := int(binary.LittleEndian.Uint16(base[5:]))
+	if size < head4Size {
+		return nil, ErrFormat
+	}
+	hdr := make([]byte, size)
+	_, err = io.ReadFull(h.v.br, hdr)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if !check4(hdr) {
+		return nil, ErrFormat
+	}
+	return hdr, nil
+}
+
+// check4 checks the checksum of a header.
+func check4(hdr []byte) bool {
+	return uint16(crc32.ChecksumIEEE(hdr[2:])) == binary.LittleEndian.Uint16(hdr)
+}
+
+func (h *reader4) fileBlock(hdr []byte, service bool) (*block, error) {
+	if len(hdr) < file4Size {
+		return nil, ErrFormat
+	}
+	flags := binary.LittleEndian.Uint16(hdr[3:])
+	le := binary.LittleEndian
+	packSize := int64(le.Uint32(hdr[7:]))
+	size := int64(le.Uint32(hdr[11:]))
+	hostOS := hdr[15]
+	crc := le.Uint32(hdr[16:])
+	mtime := le.Uint32(hdr[20:])
+	method := hdr[25]
+	nameSize := int(le.Uint16(hdr[26:]))
+	p := hdr[file4Size:]
+	if flags&file4Large != 0 {
+		if len(p) < 8 {
+			return nil, ErrFormat
+		}
+		packSize |= int64(le.Uint32(p)) << 32
+		size |= int64(le.Uint32(p[4:])) << 32
+		p = p[8:]
+	}
+	if len(p) < nameSize {
+		return nil, ErrFormat
+	}
+	name := p[:nameSize]
+
+	b := &block{
+		FileHeader: FileHeader{
+			Name:      decodeName4(name, flags&file4Unicode != 0, hostOS),
+			Size:      size,
+			ModTime:   dosTime(mtime),
+			IsDir:     flags&file4Dir == file4Dir,
+			Encrypted: flags&file4Password != 0,
+			Stored:    method == method4Store,
+		},
+		service:     service,
+		packSize:    packSize,
+		splitBefore: flags&file4SplitBefore != 0,
+		splitAfter:  flags&file4SplitAfter != 0,
+		hasCRC:      true,
+		crc:         crc,
+	}
+	if b.IsDir {
+		b.Size = 0
+	}
+	return b, nil
+}
+
+// the host OSes that use backslashes to separate paths
+const (
+	hostMSDOS = 0
+	hostOS2   = 1
+	hostWin32 = 2
+)
+
+// decodeName4 decodes the name of a file in a RAR 4 file header.
+func decodeName4(name []byte, unicode bool, hostOS byte) string {
+	var s string
+	if unicode {
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			s = decodeUnicode(name[:i], name[i+1:])
+		} else {
+			s = string(name)
+		}
+	} else if utf8.Valid(name) {
+		s = string(name)
+	} else {
+		// an unknown code page. Latin-1 keeps the name readable.
+		r := make([]rune, len(name))
+		for i, c := range name {
+			r[i] = rune(c)
+		}
+		s = string(r)
+	}
+	if hostOS <= hostWin32 {
+		s = strings.Replace(s, `\`, "/", -1)
+	}
+	return s
+}
+
+// decodeUnicode decodes the compact encoding RAR 4 uses for non-ASCII
+// names. The encoding refers back to the plain name stored before it.
+func decodeUnicode(plain, enc []byte) string {
+	var out []uint16
+	if len(enc) == 0 {
+		return string(plain)
+	}
+	high := uint16(enc[0])
+	pos := 1
+	var flags byte
+	flagBits := 0
+	for pos < len(enc) {
+		if flagBits == 0 {
+			flags = enc[pos]
+			pos++
+			flagBits = 8
+		}
+		switch flags >> 6 {
+		case 0:
+			if pos >= len(enc) {
+				break
+			}
+			out = append(out, uint16(enc[pos]))
+			pos++
+		case 1:
+			if pos >= len(enc) {
+				break
+			}
+			out = append(out, uint16(enc[pos])|high<<8)
+			pos++
+		case 2:
+			if pos+1 >= len(enc) {
+				break
+			}
+			out = append(out, uint16(enc[pos])|uint16(enc[pos+1])<<8)
+			pos += 2
+		case 3:
+			if pos >= len(enc) {
+				break
+			}
+			n := int(enc[pos])
+			pos++
+			if n&0x80 != 0 {
+				if pos >= len(enc) {
+					break
+				}
+				correction := enc[pos]
+				pos++
+				for n = n&0x7f + 2; n > 0 && len(out) < len(plain); n-- {
+					out = append(out, uint16(plain[len(out)]+correction)|high<<8)
+				}
+			} else {
+				for n += 2; n > 0 && len(out) < len(plain); n-- {
+					out = append(out, uint16(plain[len(out)]))
+				}
+			}
+		}
+		flags <<= 2
+		flagBits -= 2
+	}
+	return string(utf16.Decode(out))
+}
+
+// dosTime converts an MS-DOS date and time.
+func dosTime(t uint32) time.Time {
+	return time.Date(
+		int(t>>25&0x7f)+1980,
+		time.Month(t>>21&0x0f),
+		int(t>>16&0x1f),
+		int(t>>11&0x1f),
+		int(t>>5&0x3f),
+		int(t&0x1f)*2,
+		0, time.Local)
+}
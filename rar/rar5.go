@@ -0,0 +1,297 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package rar
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// RAR 5 header types
+const (
+	head5Main    = 1
+	head5File    = 2
+	head5Service = 3
+	head5Crypt   = 4
+	head5End     = 5
+)
+
+// RAR 5 flags
+const (
+	// any header
+	head5Extra       = 0x01
+	head5Data        = 0x02
+	head5SplitBefore = 0x08
+	head5SplitAfter  = 0x10
+
+	// main header
+	main5Volume       = 0x01
+	main5VolumeNumber = 0x02
+
+	// file header
+	file5Dir   = 0x01
+	file5MTime = 0x02
+	file5CRC   = 0x04
+
+	// file time record
+	time5Unix  = 0x01
+	time5MTime = 0x02
+
+	// end of archive header
+	end5NextVolume = 0x01
+)
+
+// RAR 5 file extra record types
+const (
+	extra5Crypt = 1
+	extra5Time  = 3
+)
+
+const (
+	// the largest header RAR 5 allows
+	maxHeader5 = 2 << 20
+)
+
+// reader5 reads the headers of a volume in the RAR 5 format.
+type reader5 struct {
+	v *volume
+}
+
+func (h *reader5) next() (*block, error) {
+	for {
+		hdr, err := h.readHeader()
+		if err != nil {
+			return nil, err
+		}
+		f := fields{b: hdr}
+		typ := f.vint()
+		flags := f.vint()
+		var extraSize, dataSize uint64
+		if flags&head5Extra != 0 {
+			extraSize = f.vint()
+		}
+		if flags&head5Data != 0 {
+			dataSize = f.vint()
+		}
+		if f.err != nil || extraSize > uint64(len(f.b)) || dataSize > 1<<62 {
+			return nil, ErrFormat
+		}
+		body := fields{b: f.b[:len(f.b)-int(extraSize)]}
+		extra := f.b[len(f.b)-int(extraSize):]
+		switch typ {
+		case head5File, head5Service:
+			b, err := h.fileBlock(&body, extra)
+			if err != nil {
+				return nil, err
+			}
+			b.service = typ == head5Service
+			b.packSize = int64(dataSize)
+			b.splitBefore = flags&head5SplitBefore != 0
+			b.splitAfter = flags&head5SplitAfter != 0
+			return b, nil
+		case head5Crypt:
+			// the rest of the headers are encrypted
+			return nil, ErrEncrypted
+		case head5End:
+			endFlags := body.vint()
+			if body.err != nil {
+				return nil, ErrFormat
+			}
+			return &block{end: true, nextVolume: endFlags&end5NextVolume != 0}, nil
+		}
+		if typ != head5File && typ != head5Service && dataSize > 0 {
+			err = h.v.skip(int64(dataSize))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (h *reader5) info() (*VolumeInfo, error) {
+	hdr, err := h.readHeader()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	f := fields{b: hdr}
+	typ := f.vint()
+	flags := f.vint()
+	if flags&head5Extra != 0 {
+		f.vint()
+	}
+	if flags&head5Data != 0 {
+		f.vint()
+	}
+	if typ == head5Crypt {
+		// the main header is encrypted
+		return nil, ErrEncrypted
+	}
+	if typ != head5Main {
+		return nil, ErrFormat
+	}
+	archFlags := f.vint()
+	info := &VolumeInfo{Multi: archFlags&main5Volume != 0}
+	if archFlags&main5VolumeNumber != 0 {
+		info.Number = int(f.vint())
+	}
+	if f.err != nil {
+		return nil, ErrFormat
+	}
+	return info, nil
+}
+
+// readHeader reads a header and returns it without the checksum and
+// size fields.
+func (h *reader5) readHeader() ([]byte, error) {
+	var start [16]byte
+	p, err := h.v.br.Peek(len(start))
+	if len(p) == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	copy(start[:], p)
+	f := fields{b: start[4:]}
+	size := f.vint()
+	if f.err != nil || size == 0 || size > maxHeader5 {
+		return nil, ErrFormat
+	}
+	// the checksum covers the size field too
+	total := len(start) - len(f.b) + int(size)
+	buf := make([]byte, total)
+	_, err = io.ReadFull(h.v.br, buf)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(buf[4:]) != binary.LittleEndian.Uint32(buf) {
+		return nil, ErrFormat
+	}
+	return buf[total-int(size):], nil
+}
+
+func (h *reader5) fileBlock(f *fields, extra []byte) (*block, error) {
+	flags := f.vint()
+	size := f.vint()
+	f.vint() // attributes
+	var mtime, crc uint32
+	if flags&file5MTime != 0 {
+		mtime = f.uint32()
+	}
+	if flags&file5CRC != 0 {
+		crc = f.uint32()
+	}
+	comp := f.vint()
+	f.vint() // host OS
+	nameSize := f.vint()
+	name := f.bytes(int(nameSize))
+	if f.err != nil || size > 1<<62 {
+		return nil, ErrFormat
+	}
+	b := &block{
+		FileHeader: FileHeader{
+			Name:   string(name),
+			Size:   int64(size),
+			IsDir:  flags&file5Dir != 0,
+			Stored: comp>>7&7 == 0,
+		},
+		hasCRC: flags&file5CRC != 0,
+		crc:    crc,
+	}
+	if flags&file5MTime != 0 {
+		b.ModTime = time.Unix(int64(mtime), 0)
+	}
+	if b.IsDir {
+		b.Size = 0
+	}
+	e := fields{b: extra}
+	for len(e.b) > 0 && e.err == nil {
+		n := e.vint()
+		rec := fields{b: e.bytes(int(n))}
+		if e.err != nil {
+			break
+		}
+		switch rec.vint() {
+		case extra5Crypt:
+			b.Encrypted = true
+		case extra5Time:
+			timeRecord(b, &rec)
+		}
+		if rec.err != nil {
+			return nil, ErrFormat
+		}
+	}
+	if e.err != nil {
+		return nil, ErrFormat
+	}
+	return b, nil
+}
+
+// the difference between the Windows and Unix epochs, in 100ns units
+const windowsEpoch = 116444736000000000
+
+// timeRecord reads the modification time from a file time record.
+func timeRecord(b *block, f *fields) {
+	flags := f.vint()
+	if flags&time5MTime == 0 {
+		return
+	}
+	if flags&time5Unix != 0 {
+		b.ModTime = time.Unix(int64(f.uint32()), 0)
+		return
+	}
+	ft := int64(f.uint64()) - windowsEpoch
+	b.ModTime = time.Unix(ft/1e7, ft%1e7*100)
+}
+
+// fields reads the fields of a header. Reading past the end sets err,
+// so that it only needs to be checked once all fields are read.
+type fields struct {
+	b   []byte
+	err error
+}
+
+// vint reads a variable length integer.
+func (f *fields) vint() uint64 {
+	var v uint64
+	for i := 0; i < len(f.b) && i < 10; i++ {
+		v |= uint64(f.b[i]&0x7f) << (7 * uint(i))
+		if f.b[i]&0x80 == 0 {
+			f.b = f.b[i+1:]
+			return v
+		}
+	}
+	f.err = ErrFormat
+	f.b = nil
+	return 0
+}
+
+func (f *fields) bytes(n int) []byte {
+	if n < 0 || n > len(f.b) {
+		f.err = ErrFormat
+		f.b = nil
+		return nil
+	}
+	p := f.b[:n]
+	f.b = f.b[n:]
+	return p
+}
+
+func (f *fields) uint32() uint32 {
+	p := f.bytes(4)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(p)
+}
+
+func (f *fields) uint64() uint64 {
+	p := f.bytes(8)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(p)
+}
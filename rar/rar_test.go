@@ -0,0 +1,305 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package rar_test
+
+import (
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/DanielMorsing/gonzbee/rar"
+)
+
+// The test archives are written by testdata/gen.go.
+
+type entry struct {
+	name  string
+	size  int64
+	crc   uint32
+	isDir bool
+}
+
+var smallFiles = []entry{
+	{name: "dir", isDir: true},
+	{name: "dir/hello.txt", size: 14, crc: 0x7b55a718},
+	{name: "random.bin", size: 10000, crc: 0x4cd9c7ae},
+}
+
+var bigFile = []entry{
+	{name: "big.bin", size: 30000, crc: 0x8bd8dad2},
+}
+
+func readAll(t *testing.T, name string) []entry {
+	r, err := OpenReader(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer r.Close()
+	var got []entry
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: reading %s: %v", name, hdr.Name, err)
+		}
+		if int64(len(b)) != hdr.Size {
+			t.Errorf("%s: %s has size %d, read %d bytes", name, hdr.Name, hdr.Size, len(b))
+		}
+		e := entry{name: hdr.Name, size: hdr.Size, isDir: hdr.IsDir}
+		if !hdr.IsDir {
+			e.crc = crc32.ChecksumIEEE(b)
+		}
+		got = append(got, e)
+	}
+	return got
+}
+
+func checkEntries(t *testing.T, name string, got, want []entry) {
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d files, want %d: %v", name, len(got), len(want), got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("%s: file %d is %+v, want %+v", name, i, got[i], want[i])
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name string
+		want []entry
+	}{
+		{"store4.rar", smallFiles},
+		{"store5.rar", smallFiles},
+		{"multi4.part1.rar", bigFile},
+		{"multi5.part1.rar", bigFile},
+		{"old.rar", bigFile},
+		{"unicode4.rar", []entry{{name: "héllo wörld.txt", size: 8, crc: 0x7fb6d67f}}},
+	}
+	for _, tt := range tests {
+		checkEntries(t, tt.name, readAll(t, tt.name), tt.want)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	for _, name := range []string{"multi4.part1.rar", "multi5.part1.rar"} {
+		r, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		// read a bit, then skip the rest of the file in the next volumes
+		if _, err := io.ReadFull(r, make([]byte, 100)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Errorf("%s: got %v after skipping the last file, want EOF", name, err)
+		}
+		r.Close()
+	}
+}
+
+func TestEncrypted(t *testing.T) {
+	for _, name := range []string{"crypt4.rar", "crypt5.rar", "cryptmulti5.part1.rar"} {
+		r, err := OpenReader(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// encrypted files are listed, but can't be read
+		var files int
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			files++
+			if hdr.IsDir {
+				continue
+			}
+			if !hdr.Encrypted {
+				t.Errorf("%s: %s isn't encrypted", name, hdr.Name)
+			}
+			if _, err := ioutil.ReadAll(r); err != ErrEncrypted {
+				t.Errorf("%s: reading %s: got %v, want %v", name, hdr.Name, err, ErrEncrypted)
+			}
+		}
+		if files == 0 {
+			t.Errorf("%s: no files listed", name)
+		}
+		r.Close()
+	}
+	for _, name := range []string{"crypt4hp.rar", "crypt5hp.rar"} {
+		r, err := OpenReader(filepath.Join("testdata", name))
+		if err == nil {
+			_, err = r.Next()
+			r.Close()
+		}
+		if err != ErrEncrypted {
+			t.Errorf("%s: got %v, want %v", name, err, ErrEncrypted)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	r, err := OpenReader("testdata/badcrc4.rar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrChecksum {
+		t.Errorf("got %v, want %v", err, ErrChecksum)
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	r, err := OpenReader("testdata/method4.rar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	hdr, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Stored {
+		t.Error("compressed file is marked as stored")
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != ErrUnsupported {
+		t.Errorf("got %v, want %v", err, ErrUnsupported)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("got %v after the compressed file, want EOF", err)
+	}
+}
+
+func TestMissingVolume(t *testing.T) {
+	errMissing := errors.New("missing")
+	r, err := NewReader(func(n int) (io.ReadCloser, error) {
+		if n > 1 {
+			return nil, errMissing
+		}
+		return os.Open(VolumeName("testdata/multi5.part1.rar", n))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(r)
+	if err != errMissing {
+		t.Errorf("got %v, want %v", err, errMissing)
+	}
+}
+
+func TestNotRar(t *testing.T) {
+	_, err := OpenReader("testdata/gen.go")
+	if err != ErrFormat {
+		t.Errorf("got %v, want %v", err, ErrFormat)
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	tests := []struct {
+		first string
+		n     int
+		want  string
+	}{
+		{"a/b.part1.rar", 0, "a/b.part1.rar"},
+		{"a/b.part1.rar", 1, "a/b.part2.rar"},
+		{"b.part01.rar", 9, "b.part10.rar"},
+		{"b.PART001.RAR", 2, "b.PART003.RAR"},
+		{"b.rar", 0, "b.rar"},
+		{"b.rar", 1, "b.r00"},
+		{"b.rar", 100, "b.r99"},
+		{"b.rar", 101, "b.s00"},
+		{"b.RAR", 2, "b.R01"},
+	}
+	for _, tt := range tests {
+		if got := VolumeName(tt.first, tt.n); got != tt.want {
+			t.Errorf("VolumeName(%q, %d) = %q, want %q", tt.first, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestIsFirstVolume(t *testing.T) {
+	tests := map[string]bool{
+		"b.rar":         true,
+		"b.part1.rar":   true,
+		"b.part01.rar":  true,
+		"b.part02.rar":  false,
+		"b.part10.rar":  false,
+		"b.r00":         false,
+		"b.RAR":         true,
+		"b.par2":        false,
+		"dir/b.part1.r": false,
+	}
+	for name, want := range tests {
+		if got := IsFirstVolume(name); got != want {
+			t.Errorf("IsFirstVolume(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestReadVolumeInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		multi  bool
+		number int
+	}{
+		{"store4.rar", false, 0},
+		{"store5.rar", false, 0},
+		{"multi4.part1.rar", true, 0},
+		{"multi4.part2.rar", true, -1},
+		{"multi5.part1.rar", true, 0},
+		{"multi5.part3.rar", true, 2},
+		{"crypt4hp.rar", false, 0},
+	}
+	for _, tt := range tests {
+		f, err := os.Open(filepath.Join("testdata", tt.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadVolumeInfo(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if info.Multi != tt.multi || info.Number != tt.number {
+			t.Errorf("%s: got %+v, want multi %v, number %d", tt.name, info, tt.multi, tt.number)
+		}
+	}
+
+	f, err := os.Open("testdata/crypt5hp.rar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := ReadVolumeInfo(f); err != ErrEncrypted {
+		t.Errorf("expected %v for encrypted headers, got %v", ErrEncrypted, err)
+	}
+}
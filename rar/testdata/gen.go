@@ -0,0 +1,489 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+//go:build ignore
+
+// This program writes the test archives, since rar itself isn't free.
+// The archives without encryption have been checked against libarchive.
+// The encrypted ones only serve to check that encryption is detected and
+// refused: nothing has checked that rar would decrypt them.
+//
+//	go run gen.go
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const password = "secret"
+
+var (
+	rnd   = rand.New(rand.NewSource(1))
+	mtime = time.Date(2013, 5, 17, 14, 32, 10, 0, time.UTC)
+)
+
+type file struct {
+	name string
+	data []byte
+	dir  bool
+	// method is the RAR 4 compression method, 0 for store.
+	method byte
+}
+
+func random(n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func main() {
+	files := []file{
+		{name: "dir", dir: true},
+		{name: "dir/hello.txt", data: []byte("Hello, world!\n")},
+		{name: "random.bin", data: random(10000)},
+	}
+	big := []file{{name: "big.bin", data: random(30000)}}
+
+	write("store4.rar", 1, archive4(files, 0, false, false)...)
+	write("store5.rar", 1, archive5(files, 0, false, false)...)
+	write("multi4.part%d.rar", 1, archive4(big, 12000, false, false)...)
+	write("multi5.part%d.rar", 1, archive5(big, 12000, false, false)...)
+	write("crypt4.rar", 1, archive4(files, 0, true, false)...)
+	write("crypt4hp.rar", 1, archive4(files, 0, true, true)...)
+	write("crypt5.rar", 1, archive5(files, 0, true, false)...)
+	write("crypt5hp.rar", 1, archive5(files, 0, true, true)...)
+	write("cryptmulti5.part%d.rar", 1, archive5(big, 12000, true, false)...)
+	old := archive4(big, 12000, false, false)
+	write("old.rar", 1, old[0])
+	write("old.r%02d", 0, old[1:]...)
+
+	unicode := []file{{name: "héllo wörld.txt", data: []byte("unicode\n")}}
+	write("unicode4.rar", 1, archive4(unicode, 0, false, false)...)
+	packed := []file{{name: "packed.bin", data: []byte("not really packed"), method: 3}}
+	write("method4.rar", 1, archive4(packed, 0, false, false)...)
+
+	bad := archive4(files[1:2], 0, false, false)[0]
+	i := bytes.Index(bad, []byte("Hello"))
+	bad[i] = 'J'
+	write("badcrc4.rar", 1, bad)
+
+	// several files, the last of them spanning the volumes
+	mixed := append(append([]file(nil), files...), file{name: "big.bin", data: random(30000)})
+	write("mixed5.part%d.rar", 1, archive5(mixed, 12000, false, false)...)
+}
+
+// write writes volumes to files. Names with a verb are numbered from first.
+func write(name string, first int, vols ...[]byte) {
+	for i, v := range vols {
+		n := name
+		if strings.Contains(name, "%") {
+			n = fmt.Sprintf(name, first+i)
+		}
+		if err := ioutil.WriteFile(n, v, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// split divides packed data into the parts stored in each volume.
+func split(data []byte, volSize int) [][]byte {
+	if volSize == 0 || len(data) <= volSize {
+		return [][]byte{data}
+	}
+	var parts [][]byte
+	for len(data) > volSize {
+		parts = append(parts, data[:volSize])
+		data = data[volSize:]
+	}
+	return append(parts, data)
+}
+
+func encrypt(key, iv, data []byte) []byte {
+	data = append([]byte(nil), data...)
+	for len(data)%16 != 0 {
+		data = append(data, 0)
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(b, iv).CryptBlocks(data, data)
+	return data
+}
+
+// key30 derives the RAR 3 key and IV with a plain SHA-1,
+// which is the same as RAR's for short passwords.
+func key30(salt []byte) (key, iv []byte) {
+	var raw []byte
+	for _, c := range utf16.Encode([]rune(password)) {
+		raw = append(raw, byte(c), byte(c>>8))
+	}
+	raw = append(raw, salt...)
+	h := sha1.New()
+	const rounds = 0x40000
+	iv = make([]byte, 16)
+	for i := 0; i < rounds; i++ {
+		h.Write(raw)
+		h.Write([]byte{byte(i), byte(i >> 8), byte(i >> 16)})
+		if i%(rounds/16) == 0 {
+			iv[i/(rounds/16)] = h.Sum(nil)[19]
+		}
+	}
+	d := h.Sum(nil)
+	key = make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 4; j++ {
+			key[i*4+j] = d[i*4+3-j]
+		}
+	}
+	return key, iv
+}
+
+func dosTime(t time.Time) uint32 {
+	return uint32(t.Year()-1980)<<25 | uint32(t.Month())<<21 | uint32(t.Day())<<16 |
+		uint32(t.Hour())<<11 | uint32(t.Minute())<<5 | uint32(t.Second()/2)
+}
+
+func le16(b []byte, v uint16) []byte { return append(b, byte(v), byte(v>>8)) }
+func le32(b []byte, v uint32) []byte { return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+
+// header4 finishes a RAR 4 header, whose fields after the size are in body.
+func header4(typ byte, flags uint16, body []byte) []byte {
+	h := []byte{0, 0, typ}
+	h = le16(h, flags)
+	h = le16(h, uint16(7+len(body)))
+	h = append(h, body...)
+	binary.LittleEndian.PutUint16(h, uint16(crc32.ChecksumIEEE(h[2:])))
+	return h
+}
+
+// encodeName4 encodes a name in the RAR 4 unicode form, with each
+// character stored as 16 bits.
+func encodeName4(name string) []byte {
+	enc := []byte{0}
+	for i, c := range utf16.Encode([]rune(name)) {
+		if i%4 == 0 {
+			enc = append(enc, 0xaa)
+		}
+		enc = append(enc, byte(c), byte(c>>8))
+	}
+	ascii := []byte{}
+	for _, c := range name {
+		if c < 0x80 {
+			ascii = append(ascii, byte(c))
+		} else {
+			ascii = append(ascii, '_')
+		}
+	}
+	return append(append(ascii, 0), enc...)
+}
+
+// archive4 returns the volumes of a RAR 4 archive. The packed data of
+// each file is split into parts of volSize bytes.
+func archive4(files []file, volSize int, crypt, headers bool) [][]byte {
+	var hsalt, hkey, hiv []byte
+	if headers {
+		hsalt = random(8)
+		hkey, hiv = key30(hsalt)
+	}
+	var vols [][]byte
+	var cur []byte
+	emit := func(h []byte) {
+		if headers {
+			cur = append(cur, hsalt...)
+			h = encrypt(hkey, hiv, h)
+		}
+		cur = append(cur, h...)
+	}
+	start := func() {
+		cur = []byte("Rar!\x1a\x07\x00")
+		flags := uint16(0x10)
+		if volSize > 0 {
+			flags |= 0x01
+			if len(vols) == 0 {
+				flags |= 0x100
+			}
+		}
+		if headers {
+			flags |= 0x80
+		}
+		cur = append(cur, header4(0x73, flags, make([]byte, 6))...)
+	}
+	finish := func(last bool) {
+		flags := uint16(0)
+		if !last {
+			flags |= 0x01
+		}
+		emit(header4(0x7b, flags, nil))
+		vols = append(vols, cur)
+	}
+	start()
+	for _, f := range files {
+		packed := f.data
+		var salt []byte
+		if crypt && !f.dir {
+			salt = random(8)
+			key, iv := key30(salt)
+			packed = encrypt(key, iv, f.data)
+		}
+		parts := split(packed, volSize)
+		for i, p := range parts {
+			if i > 0 {
+				finish(false)
+				start()
+			}
+			flags := uint16(0x8000)
+			if i > 0 {
+				flags |= 0x01
+			}
+			if i < len(parts)-1 {
+				flags |= 0x02
+			}
+			if f.dir {
+				flags |= 0xe0
+			}
+			name := []byte(f.name)
+			for _, c := range f.name {
+				if c >= 0x80 {
+					flags |= 0x200
+					name = encodeName4(f.name)
+					break
+				}
+			}
+			if salt != nil {
+				flags |= 0x04 | 0x400
+			}
+			crc := crc32.ChecksumIEEE(f.data)
+			if i < len(parts)-1 {
+				crc = crc32.ChecksumIEEE(p)
+			}
+			var b []byte
+			b = le32(b, uint32(len(p)))
+			b = le32(b, uint32(len(f.data)))
+			b = append(b, 3) // unix
+			b = le32(b, crc)
+			b = le32(b, dosTime(mtime))
+			b = append(b, 29, 0x30+f.method)
+			b = le16(b, uint16(len(name)))
+			attr := uint32(0100644)
+			if f.dir {
+				attr = 040755
+			}
+			b = le32(b, attr)
+			b = append(b, name...)
+			b = append(b, salt...)
+			emit(header4(0x74, flags, b))
+			cur = append(cur, p...)
+		}
+	}
+	finish(true)
+	return vols
+}
+
+func vint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// header5 finishes a RAR 5 header.
+func header5(typ, flags uint64, body, extra []byte, dataSize int) []byte {
+	var h []byte
+	h = vint(h, typ)
+	if extra != nil {
+		flags |= 0x01
+	}
+	if dataSize >= 0 {
+		flags |= 0x02
+	}
+	h = vint(h, flags)
+	if extra != nil {
+		h = vint(h, uint64(len(extra)))
+	}
+	if dataSize >= 0 {
+		h = vint(h, uint64(dataSize))
+	}
+	h = append(h, body...)
+	h = append(h, extra...)
+	sized := vint(nil, uint64(len(h)))
+	sized = append(sized, h...)
+	return append(le32(nil, crc32.ChecksumIEEE(sized)), sized...)
+}
+
+type keys50 struct {
+	key, hashKey, check []byte
+}
+
+const kdfCount = 15
+
+func key50(salt []byte) keys50 {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	f := append([]byte(nil), u...)
+	var out [][]byte
+	for _, n := range []int{1<<kdfCount - 1, 16, 16} {
+		for i := 0; i < n; i++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(nil)
+			for j := range f {
+				f[j] ^= u[j]
+			}
+		}
+		out = append(out, append([]byte(nil), f...))
+	}
+	return keys50{out[0], out[1], out[2]}
+}
+
+// checkValue returns the password check value with its checksum.
+func (k keys50) checkValue() []byte {
+	v := make([]byte, 8)
+	for i, b := range k.check {
+		v[i%8] ^= b
+	}
+	sum := sha256.Sum256(v)
+	return append(v, sum[:4]...)
+}
+
+func (k keys50) tweak(crc uint32) uint32 {
+	mac := hmac.New(sha256.New, k.hashKey)
+	mac.Write(le32(nil, crc))
+	var v uint32
+	for i, b := range mac.Sum(nil) {
+		v ^= uint32(b) << (uint(i&3) * 8)
+	}
+	return v
+}
+
+// archive5 returns the volumes of a RAR 5 archive.
+func archive5(files []file, volSize int, crypt, headers bool) [][]byte {
+	var hk keys50
+	var hsalt []byte
+	if headers {
+		hsalt = random(16)
+		hk = key50(hsalt)
+	}
+	var vols [][]byte
+	var cur []byte
+	emit := func(h []byte) {
+		if headers {
+			iv := random(16)
+			cur = append(cur, iv...)
+			h = encrypt(hk.key, iv, h)
+		}
+		cur = append(cur, h...)
+	}
+	start := func() {
+		cur = []byte("Rar!\x1a\x07\x01\x00")
+		if headers {
+			var b []byte
+			b = vint(b, 0)
+			b = vint(b, 0x01)
+			b = append(b, kdfCount)
+			b = append(b, hsalt...)
+			b = append(b, hk.checkValue()...)
+			cur = append(cur, header5(4, 0, b, nil, -1)...)
+		}
+		var b []byte
+		if volSize > 0 {
+			if len(vols) == 0 {
+				b = vint(b, 0x01)
+			} else {
+				b = vint(b, 0x03)
+				b = vint(b, uint64(len(vols)))
+			}
+		} else {
+			b = vint(b, 0)
+		}
+		emit(header5(1, 0, b, nil, -1))
+	}
+	finish := func(last bool) {
+		flags := uint64(0)
+		if !last {
+			flags = 0x01
+		}
+		emit(header5(5, 0, vint(nil, flags), nil, -1))
+		vols = append(vols, cur)
+	}
+	start()
+	for _, f := range files {
+		packed := f.data
+		var extra []byte
+		var k keys50
+		if crypt && !f.dir {
+			salt, iv := random(16), random(16)
+			k = key50(salt)
+			packed = encrypt(k.key, iv, f.data)
+			var rec []byte
+			rec = vint(rec, 1)
+			rec = vint(rec, 0)
+			rec = vint(rec, 0x01|0x02)
+			rec = append(rec, kdfCount)
+			rec = append(rec, salt...)
+			rec = append(rec, iv...)
+			rec = append(rec, k.checkValue()...)
+			extra = append(vint(nil, uint64(len(rec))), rec...)
+		}
+		parts := split(packed, volSize)
+		for i, p := range parts {
+			if i > 0 {
+				finish(false)
+				start()
+			}
+			flags := uint64(0)
+			if i > 0 {
+				flags |= 0x08
+			}
+			if i < len(parts)-1 {
+				flags |= 0x10
+			}
+			fileFlags := uint64(0x02)
+			crc := crc32.ChecksumIEEE(f.data)
+			if k.key != nil {
+				crc = k.tweak(crc)
+			}
+			if i == len(parts)-1 && !f.dir {
+				fileFlags |= 0x04
+			}
+			attr := uint64(0644)
+			if f.dir {
+				fileFlags |= 0x01
+				attr = 0755
+			}
+			var b []byte
+			b = vint(b, fileFlags)
+			b = vint(b, uint64(len(f.data)))
+			b = vint(b, attr)
+			b = le32(b, uint32(mtime.Unix()))
+			if fileFlags&0x04 != 0 {
+				b = le32(b, crc)
+			}
+			b = vint(b, 0) // stored
+			b = vint(b, 1) // unix
+			b = vint(b, uint64(len(f.name)))
+			b = append(b, f.name...)
+			emit(header5(2, flags, b, extra, len(p)))
+			cur = append(cur, p...)
+		}
+	}
+	finish(true)
+	return vols
+}
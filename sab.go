@@ -0,0 +1,531 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the SABnzbd compatible API, so that tools that
+// know how to talk to SABnzbd can use gonzbee as their download client.
+// Only JSON output and the parts of the API that those tools use are
+// supported.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// the SABnzbd version whose API we follow
+const sabVersion = "3.7.2"
+
+var errURLNzb = errors.New("adding NZB files by URL needs an API key")
+
+// urlClient fetches the NZB files added by URL.
+var urlClient = &http.Client{Timeout: time.Minute}
+
+// SABnzbd priorities that don't map directly to ours.
+const (
+	sabDefaultPriority = -100
+	sabPausedPriority  = -2
+)
+
+type sabStatus struct {
+	Status bool   `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type sabAdded struct {
+	Status bool     `json:"status"`
+	IDs    []string `json:"nzo_ids"`
+}
+
+type sabQueue struct {
+	Status        string        `json:"status"`
+	Paused        bool          `json:"paused"`
+	Speed         string        `json:"speed"`
+	KBPerSec      string        `json:"kbpersec"`
+	SpeedLimitAbs string        `json:"speedlimit_abs"`
+	MB            string        `json:"mb"`
+	MBLeft        string        `json:"mbleft"`
+	TimeLeft      string        `json:"timeleft"`
+	NoOfSlots     int           `json:"noofslots"`
+	Slots         []sabQueueJob `json:"slots"`
+	Version       string        `json:"version"`
+}
+
+type sabQueueJob struct {
+	Index      int    `json:"index"`
+	ID         string `json:"nzo_id"`
+	Filename   string `json:"filename"`
+	Cat        string `json:"cat"`
+	Priority   string `json:"priority"`
+	Status     string `json:"status"`
+	MB         string `json:"mb"`
+	MBLeft     string `json:"mbleft"`
+	Percentage string `json:"percentage"`
+	TimeLeft   string `json:"timeleft"`
+}
+
+type sabHistory struct {
+	NoOfSlots int             `json:"noofslots"`
+	Slots     []sabHistoryJob `json:"slots"`
+}
+
+type sabHistoryJob struct {
+	ID          string `json:"nzo_id"`
+	Name        string `json:"name"`
+	NZBName     string `json:"nzb_name"`
+	Category    string `json:"category"`
+	Status      string `json:"status"`
+	FailMessage string `json:"fail_message"`
+	Storage     string `json:"storage"`
+	Bytes       int64  `json:"bytes"`
+	Completed   int64  `json:"completed"`
+	ScriptLog   string `json:"script_log"`
+}
+
+type sabCategory struct {
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`
+	Priority int    `json:"priority"`
+	PP       string `json:"pp"`
+	Script   string `json:"script"`
+}
+
+// sabHandler handles the /api endpoint. The action is chosen by the mode parameter.
+func (r *runner) sabHandler(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseMultipartForm(maxUpload)
+	if err != nil && err != http.ErrNotMultipart {
+		sabError(w, err.Error())
+		return
+	}
+	switch req.FormValue("mode") {
+	case "version":
+		writeJSON(w, http.StatusOK, map[string]string{"version": sabVersion})
+	case "addfile":
+		r.sabAddFile(w, req)
+	case "addurl":
+		r.sabAddURL(w, req)
+	case "queue":
+		r.sabQueue(w, req)
+	case "history":
+		r.sabHistory(w, req)
+	case "pause":
+		r.pauseQueue()
+		writeJSON(w, http.StatusOK, sabStatus{Status: true})
+	case "resume":
+		r.resumeQueue()
+		writeJSON(w, http.StatusOK, sabStatus{Status: true})
+	case "get_config":
+		r.sabConfig(w, req)
+	default:
+		sabError(w, "not implemented")
+	}
+}
+
+func sabError(w http.ResponseWriter, msg string) {
+	writeJSON(w, http.StatusOK, sabStatus{Status: false, Error: msg})
+}
+
+func sabID(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+// sabIDs parses the comma separated ids in value.
+func sabIDs(value string) ([]int64, error) {
+	var ids []int64
+	for _, s := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job id %q", s)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (r *runner) sabAddFile(w http.ResponseWriter, req *http.Request) {
+	f, fh, err := req.FormFile("name")
+	if err != nil {
+		f, fh, err = req.FormFile("nzbfile")
+	}
+	if err != nil {
+		sabError(w, errNoNzb.Error())
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(f, maxUpload))
+	if err != nil {
+		sabError(w, err.Error())
+		return
+	}
+	r.sabAdd(w, req, nzbName(fh.Filename), b)
+}
+
+func (r *runner) sabAddURL(w http.ResponseWriter, req *http.Request) {
+	if config.APIKey == "" {
+		// anyone could have us fetch from hosts only we can reach
+		sabError(w, errURLNzb.Error())
+		return
+	}
+	u := req.FormValue("name")
+	if u == "" {
+		sabError(w, errNoNzb.Error())
+		return
+	}
+	resp, err := urlClient.Get(u)
+	if err != nil {
+		sabError(w, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		sabError(w, fmt.Sprintf("fetching %s: %s", u, resp.Status))
+		return
+	}
+	// read a byte more than we accept, to tell if there was more
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpload+1))
+	if err != nil {
+		sabError(w, err.Error())
+		return
+	}
+	if len(b) > maxUpload {
+		sabError(w, fmt.Sprintf("fetching %s: NZB file too large", u))
+		return
+	}
+	r.sabAdd(w, req, urlName(resp), b)
+}
+
+// urlName finds a job name for an NZB fetched over HTTP.
+func urlName(resp *http.Response) string {
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return nzbName(params["filename"])
+	}
+	p, err := url.PathUnescape(path.Base(resp.Request.URL.Path))
+	if err != nil || p == "/" || p == "." {
+		return resp.Request.URL.Host
+	}
+	return nzbName(p)
+}
+
+func (r *runner) sabAdd(w http.ResponseWriter, req *http.Request, name string, b []byte) {
+	it := queue.Item{
+		Name:     name,
+		Category: req.FormValue("cat"),
+		Priority: *priority,
+	}
+	if n := req.FormValue("nzbname"); n != "" {
+		it.Name = n
+	}
+	if it.Category == "*" {
+		it.Category = ""
+	}
+	paused := false
+	setPriority := priorityFlagSet()
+	if p := req.FormValue("priority"); p != "" {
+		prio, err := strconv.Atoi(p)
+		if err != nil {
+			sabError(w, err.Error())
+			return
+		}
+		switch prio {
+		case sabDefaultPriority:
+		case sabPausedPriority:
+			paused = true
+		default:
+			it.Priority = prio
+			setPriority = true
+		}
+	}
+	it, err := addNzb(r.q, it, b, setPriority)
+	if err == nil && paused {
+		err = r.pause(it.ID)
+	}
+	if err != nil {
+		sabError(w, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, sabAdded{Status: true, IDs: []string{sabID(it.ID)}})
+}
+
+func (r *runner) sabQueue(w http.ResponseWriter, req *http.Request) {
+	value := req.FormValue("value")
+	var err error
+	switch req.FormValue("name") {
+	case "":
+	case "delete":
+		err = r.sabDelete(value, req.FormValue("del_files") == "1", false)
+	case "pause":
+		err = r.sabEach(value, r.pause)
+	case "resume":
+		err = r.sabEach(value, r.resume)
+	case "priority":
+		var prio int
+		prio, err = strconv.Atoi(req.FormValue("value2"))
+		if err == nil {
+			err = r.sabEach(value, func(id int64) error {
+				return r.q.SetPriority(id, prio)
+			})
+		}
+	default:
+		err = fmt.Errorf("not implemented")
+	}
+	if err != nil {
+		sabError(w, err.Error())
+		return
+	}
+	if req.FormValue("name") != "" {
+		writeJSON(w, http.StatusOK, sabStatus{Status: true})
+		return
+	}
+
+	speed := r.currentSpeed()
+	sq := sabQueue{
+		Status:        "Idle",
+		Paused:        r.queuePaused(),
+		Speed:         sabSpeed(speed),
+		KBPerSec:      fmt.Sprintf("%.2f", float64(speed)/1024),
+		SpeedLimitAbs: strconv.FormatInt(r.total.Rate(), 10),
+		Slots:         []sabQueueJob{},
+		Version:       sabVersion,
+	}
+	if sq.Paused {
+		sq.Status = "Paused"
+	}
+	var total, left int64
+	for _, it := range r.q.Items() {
+		if it.Status.Finished() {
+			continue
+		}
+		job := sabQueueJob{
+			Index:    len(sq.Slots),
+			ID:       sabID(it.ID),
+			Filename: it.Name,
+			Cat:      it.Category,
+			Priority: sabPriority(it.Priority),
+			Status:   sabQueueStatus(it.Status),
+		}
+		if job.Cat == "" {
+			job.Cat = "*"
+		}
+		done := int64(0)
+		if p := r.progress(it.ID); p != nil {
+			done = p.BytesDone
+			if !sq.Paused {
+				sq.Status = "Downloading"
+			}
+		}
+		job.MB = sabMB(it.Bytes)
+		job.MBLeft = sabMB(it.Bytes - done)
+		job.Percentage = "0"
+		if it.Bytes > 0 {
+			job.Percentage = strconv.FormatInt(done*100/it.Bytes, 10)
+		}
+		total += it.Bytes
+		left += it.Bytes - done
+		job.TimeLeft = sabTimeLeft(left, speed)
+		sq.Slots = append(sq.Slots, job)
+	}
+	sq.NoOfSlots = len(sq.Slots)
+	sq.MB = sabMB(total)
+	sq.MBLeft = sabMB(left)
+	sq.TimeLeft = sabTimeLeft(left, speed)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"queue": sq})
+}
+
+func (r *runner) sabHistory(w http.ResponseWriter, req *http.Request) {
+	switch req.FormValue("name") {
+	case "":
+	case "delete":
+		err := r.sabDelete(req.FormValue("value"), req.FormValue("del_files") == "1", true)
+		if err != nil {
+			sabError(w, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, sabStatus{Status: true})
+		return
+	default:
+		sabError(w, "not implemented")
+		return
+	}
+
+	h := sabHistory{Slots: []sabHistoryJob{}}
+	for _, it := range r.q.Items() {
+		if !it.Status.Finished() {
+			continue
+		}
+		if c := req.FormValue("category"); c != "" && c != it.Category {
+			continue
+		}
+		job := sabHistoryJob{
+			ID:          sabID(it.ID),
+			Name:        it.Name,
+			NZBName:     it.Name + ".nzb",
+			Category:    it.Category,
+			Status:      "Completed",
+			FailMessage: it.Error,
+			Storage:     it.Dir,
+			Bytes:       it.Bytes,
+			Completed:   it.Finished.Unix(),
+			ScriptLog:   it.ScriptLog,
+		}
+		if it.Status == queue.Failed {
+			job.Status = "Failed"
+		}
+		if job.Category == "" {
+			job.Category = "*"
+		}
+		h.Slots = append(h.Slots, job)
+	}
+	h.NoOfSlots = len(h.Slots)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"history": h})
+}
+
+// sabDelete deletes the jobs in value from the queue or the history.
+// value is either a list of ids, "all", or for the history, "failed".
+func (r *runner) sabDelete(value string, deleteFiles, history bool) error {
+	var ids []int64
+	if value == "all" || (history && value == "failed") {
+		for _, it := range r.q.Items() {
+			if it.Status.Finished() != history {
+				continue
+			}
+			if value == "failed" && it.Status != queue.Failed {
+				continue
+			}
+			ids = append(ids, it.ID)
+		}
+	} else {
+		var err error
+		ids, err = sabIDs(value)
+		if err != nil {
+			return err
+		}
+	}
+	for _, id := range ids {
+		it, err := r.q.Get(id)
+		if err != nil {
+			return err
+		}
+		if it.Status.Finished() != history {
+			continue
+		}
+		// only the files of failed jobs are removed from the history
+		err = r.cancel(id, deleteFiles && it.Status != queue.Done)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sabEach calls action for every id in value.
+func (r *runner) sabEach(value string, action func(id int64) error) error {
+	ids, err := sabIDs(value)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = action(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *runner) sabConfig(w http.ResponseWriter, req *http.Request) {
+	if s := req.FormValue("section"); s != "" && s != "categories" {
+		sabError(w, "not implemented")
+		return
+	}
+	cats := []sabCategory{{Name: "*", Dir: config.downloadDir(), Priority: *priority, PP: "1", Script: "None"}}
+	for _, c := range config.Categories {
+		sc := sabCategory{
+			Name:     c.Name,
+			Dir:      filepath.Dir(config.jobDir(c.Name, "x")),
+			Priority: c.Priority,
+			PP:       sabPP(&c),
+			Script:   c.Script,
+		}
+		if sc.Script == "" {
+			sc.Script = "None"
+		}
+		cats = append(cats, sc)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"config": map[string]interface{}{"categories": cats},
+	})
+}
+
+// sabPP returns the SABnzbd post-processing level matching the settings of c.
+// Each level includes the ones below it: repair, unpack, then delete.
+func sabPP(c *Category) string {
+	repair, unpack := config.repair(c.Name), config.unpack(c.Name)
+	switch {
+	case repair && unpack && c.Delete:
+		return "3"
+	case repair && unpack:
+		return "2"
+	case repair:
+		return "1"
+	}
+	return "0"
+}
+
+func sabPriority(p int) string {
+	switch {
+	case p < 0:
+		return "Low"
+	case p == 0:
+		return "Normal"
+	case p == 1:
+		return "High"
+	}
+	return "Force"
+}
+
+func sabQueueStatus(s queue.Status) string {
+	switch s {
+	case queue.Paused:
+		return "Paused"
+	case queue.Downloading:
+		return "Downloading"
+	case queue.Verifying:
+		return "Verifying"
+	case queue.Repairing:
+		return "Repairing"
+	case queue.Unpacking:
+		return "Extracting"
+	}
+	return "Queued"
+}
+
+func sabMB(n int64) string {
+	return fmt.Sprintf("%.2f", float64(n)/(1<<20))
+}
+
+func sabSpeed(n int64) string {
+	s := humanBytes(n)
+	// SABnzbd leaves out the unit for bytes
+	return strings.TrimSuffix(strings.TrimSuffix(s, "iB"), " B")
+}
+
+func sabTimeLeft(left, speed int64) string {
+	if speed <= 0 {
+		return "0:00:00"
+	}
+	d := time.Duration(left/speed) * time.Second
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
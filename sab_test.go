@@ -0,0 +1,284 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// newAPIServer serves the API of a runner with an empty queue.
+func newAPIServer(t *testing.T, key string) (*runner, *httptest.Server) {
+	setConfig(t, &Config{DownloadDir: t.TempDir(), APIKey: key})
+	r := newTestRunner(t)
+	s := httptest.NewServer(checkAPIKey(key, r.apiHandler()))
+	t.Cleanup(s.Close)
+	return r, s
+}
+
+// decode decodes the JSON reply to req into v, checking the status code.
+func decode(t *testing.T, req *http.Request, code int, v interface{}) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: got %s, expected %d", req.Method, req.URL.Path, resp.Status, code)
+	}
+	if v == nil {
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sabCall calls the SABnzbd API with params, decoding the reply into v.
+func sabCall(t *testing.T, s *httptest.Server, params url.Values, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest("GET", s.URL+"/api?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Api-Key", config.APIKey)
+	decode(t, req, http.StatusOK, v)
+}
+
+// addItem adds a job to the queue of r.
+func addItem(t *testing.T, r *runner, name string) queue.Item {
+	it, err := addNzb(r.q, queue.Item{Name: name}, []byte(testNzb), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return it
+}
+
+func TestSabAddFile(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("name", "show.nzb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(testNzb))
+	mw.WriteField("cat", "tv")
+	mw.WriteField("priority", strconv.Itoa(sabPausedPriority))
+	mw.Close()
+	req, err := http.NewRequest("POST", s.URL+"/api?mode=addfile", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var added sabAdded
+	decode(t, req, http.StatusOK, &added)
+	if !added.Status || len(added.IDs) != 1 {
+		t.Fatalf("got %+v", added)
+	}
+
+	items := r.q.Items()
+	if len(items) != 1 {
+		t.Fatalf("got %d items", len(items))
+	}
+	it := items[0]
+	if sabID(it.ID) != added.IDs[0] || it.Name != "show" || it.Category != "tv" || it.Status != queue.Paused {
+		t.Errorf("got %+v", it)
+	}
+}
+
+func TestSabAddURL(t *testing.T) {
+	nzbs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/get" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="from url.nzb"`)
+		w.Write([]byte(testNzb))
+	}))
+	defer nzbs.Close()
+
+	// without an API key, anyone could have us fetch from hosts only we can reach
+	r, s := newAPIServer(t, "")
+	var status sabStatus
+	sabCall(t, s, url.Values{"mode": {"addurl"}, "name": {nzbs.URL + "/get"}}, &status)
+	if status.Status || status.Error != errURLNzb.Error() || len(r.q.Items()) != 0 {
+		t.Errorf("got %+v without an API key", status)
+	}
+
+	r, s = newAPIServer(t, "secret")
+	var added sabAdded
+	sabCall(t, s, url.Values{"mode": {"addurl"}, "name": {nzbs.URL + "/get"}}, &added)
+	if !added.Status {
+		t.Fatalf("got %+v", added)
+	}
+	if items := r.q.Items(); len(items) != 1 || items[0].Name != "from url" {
+		t.Errorf("got %+v", items)
+	}
+	// the job directory stays in the download directory
+	sabCall(t, s, url.Values{"mode": {"addurl"}, "name": {nzbs.URL + "/get"}, "nzbname": {"../../x"}}, &added)
+	if it, err := r.q.Get(r.q.Items()[1].ID); err != nil || it.Name != "x" || it.Dir != config.jobDir("", "x") {
+		t.Errorf("got name %q and directory %q", it.Name, it.Dir)
+	}
+	sabCall(t, s, url.Values{"mode": {"addurl"}, "name": {nzbs.URL + "/get"}, "nzbname": {".."}}, &status)
+	if status.Status {
+		t.Error("job called .. was added")
+	}
+
+	sabCall(t, s, url.Values{"mode": {"addurl"}, "name": {nzbs.URL + "/missing"}}, &status)
+	if status.Status || status.Error == "" {
+		t.Errorf("got %+v for a missing NZB", status)
+	}
+}
+
+func TestSabQueue(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	first := addItem(t, r, "first")
+	second := addItem(t, r, "second")
+	done := addItem(t, r, "done")
+	err := r.q.SetStatus(done.ID, queue.Done, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var status sabStatus
+	sabCall(t, s, url.Values{"mode": {"queue"}, "name": {"pause"}, "value": {sabID(first.ID)}}, &status)
+	if !status.Status {
+		t.Fatalf("pause: %+v", status)
+	}
+	sabCall(t, s, url.Values{"mode": {"queue"}, "name": {"priority"}, "value": {sabID(second.ID)}, "value2": {"1"}}, &status)
+	if !status.Status {
+		t.Fatalf("priority: %+v", status)
+	}
+	var q struct{ Queue sabQueue }
+	sabCall(t, s, url.Values{"mode": {"queue"}}, &q)
+	if q.Queue.NoOfSlots != 2 {
+		t.Fatalf("got %d slots", q.Queue.NoOfSlots)
+	}
+	// the job with the higher priority comes first
+	if sl := q.Queue.Slots[0]; sl.Filename != "second" || sl.Priority != "High" || sl.Cat != "*" {
+		t.Errorf("got %+v", sl)
+	}
+	if sl := q.Queue.Slots[1]; sl.Filename != "first" || sl.Status != "Paused" {
+		t.Errorf("got %+v", sl)
+	}
+
+	sabCall(t, s, url.Values{"mode": {"queue"}, "name": {"delete"}, "value": {sabID(first.ID)}}, &status)
+	if !status.Status {
+		t.Fatalf("delete: %+v", status)
+	}
+	if _, err := r.q.Get(first.ID); err != queue.ErrNotFound {
+		t.Error("deleted job still in the queue")
+	}
+	// jobs in the history can't be deleted from the queue
+	sabCall(t, s, url.Values{"mode": {"queue"}, "name": {"delete"}, "value": {"all"}}, &status)
+	if items := r.q.Items(); len(items) != 1 || items[0].ID != done.ID {
+		t.Errorf("got %+v", items)
+	}
+
+	var h struct{ History sabHistory }
+	sabCall(t, s, url.Values{"mode": {"history"}}, &h)
+	if h.History.NoOfSlots != 1 || h.History.Slots[0].Name != "done" || h.History.Slots[0].Status != "Completed" {
+		t.Errorf("got %+v", h.History)
+	}
+	sabCall(t, s, url.Values{"mode": {"history"}, "name": {"delete"}, "value": {"all"}}, &status)
+	if len(r.q.Items()) != 0 {
+		t.Error("history not deleted")
+	}
+}
+
+func TestSabPause(t *testing.T) {
+	r, s := newAPIServer(t, "")
+	var status sabStatus
+	sabCall(t, s, url.Values{"mode": {"pause"}}, &status)
+	if !status.Status || !r.queuePaused() {
+		t.Error("queue not paused")
+	}
+	sabCall(t, s, url.Values{"mode": {"resume"}}, &status)
+	if !status.Status || r.queuePaused() {
+		t.Error("queue not resumed")
+	}
+	sabCall(t, s, url.Values{"mode": {"nonsense"}}, &status)
+	if status.Status {
+		t.Error("unknown mode succeeded")
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	_, s := newAPIServer(t, "secret")
+	tests := []struct {
+		path   string
+		header string
+		code   int
+		// whether the request gets through, for the SABnzbd API
+		// which reports errors with status 200
+		ok bool
+	}{
+		{"/api/status", "", http.StatusUnauthorized, false},
+		{"/api/status?apikey=wrong", "", http.StatusUnauthorized, false},
+		{"/api/status", "wrong", http.StatusUnauthorized, false},
+		{"/api/status?apikey=secret", "", http.StatusOK, true},
+		{"/api/status", "secret", http.StatusOK, true},
+		{"/api?mode=version", "", http.StatusOK, false},
+		{"/sabnzbd/api?mode=version&apikey=wrong", "", http.StatusOK, false},
+		{"/api?mode=version&apikey=secret", "", http.StatusOK, true},
+		{"/sabnzbd/api?mode=version", "secret", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest("GET", s.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.header != "" {
+			req.Header.Set("X-Api-Key", tt.header)
+		}
+		var reply map[string]interface{}
+		decode(t, req, tt.code, &reply)
+		if _, rejected := reply["error"]; tt.code == http.StatusOK && rejected == tt.ok {
+			t.Errorf("%s with key %q: got %v", tt.path, tt.header, reply)
+		}
+	}
+	// the web interface asks for the key itself
+	req, err := http.NewRequest("GET", s.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decode(t, req, http.StatusOK, nil)
+}
+
+func TestSabConfig(t *testing.T) {
+	no := false
+	setConfig(t, &Config{Unpack: true, Categories: []Category{
+		{Name: "all", Delete: true},
+		// deleting archives does nothing if they aren't extracted
+		{Name: "keep", Unpack: &no, Delete: true},
+		{Name: "none", Repair: &no},
+	}})
+	r := newTestRunner(t)
+	s := httptest.NewServer(r.apiHandler())
+	defer s.Close()
+	var c struct {
+		Config struct{ Categories []sabCategory }
+	}
+	sabCall(t, s, url.Values{"mode": {"get_config"}}, &c)
+	want := map[string]string{"*": "1", "all": "3", "keep": "1", "none": "0"}
+	if len(c.Config.Categories) != len(want) {
+		t.Fatalf("got %+v", c.Config.Categories)
+	}
+	for _, cat := range c.Config.Categories {
+		if cat.PP != want[cat.Name] {
+			t.Errorf("%s: pp %s, expected %s", cat.Name, cat.PP, want[cat.Name])
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the post-processing scripts, run once a job has
+// finished, whether it succeeded or not. The script is run with the job
+// directory as its working directory, and gets the details of the job
+// from its environment:
+//
+//	GONZBEE_NAME             the name of the job
+//	GONZBEE_DIR              the directory the job was downloaded to
+//	GONZBEE_STATUS           "done" or "failed"
+//	GONZBEE_ERROR            why the job failed, if it did
+//	GONZBEE_CATEGORY         the category of the job, if any
+//	GONZBEE_FAILED_SEGMENTS  the number of segments that couldn't be downloaded
+//	GONZBEE_PAR2             the result of verifying against the par2 files:
+//	                         "none", "verified", "repairable" or "unrepairable"
+//	GONZBEE_PAR2_BLOCKS      the number of recovery blocks needed for repair
+//
+// Scripts that run for longer than the configured timeout are killed.
+// The output of the script is written to the log.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/download"
+)
+
+// the most script output kept
+const maxScriptLog = 64 << 10
+
+// scriptJob describes a finished job to a script.
+type scriptJob struct {
+	name     string
+	dir      string
+	category string
+	err      error
+	job      *download.Job
+}
+
+func (s *scriptJob) env() []string {
+	status := "done"
+	errMsg := ""
+	if s.err != nil {
+		status = "failed"
+		errMsg = s.err.Error()
+	}
+	failed, par, blocks := 0, download.ParNone, 0
+	if s.job != nil {
+		failed = s.job.Progress().SegmentsFailed
+		par = s.job.ParStatus()
+		blocks = s.job.BlocksNeeded()
+	}
+	return append(os.Environ(),
+		"GONZBEE_NAME="+s.name,
+		"GONZBEE_DIR="+s.dir,
+		"GONZBEE_STATUS="+status,
+		"GONZBEE_ERROR="+errMsg,
+		"GONZBEE_CATEGORY="+s.category,
+		"GONZBEE_FAILED_SEGMENTS="+strconv.Itoa(failed),
+		"GONZBEE_PAR2="+par.String(),
+		"GONZBEE_PAR2_BLOCKS="+strconv.Itoa(blocks),
+	)
+}
+
+// runScript runs script for the finished job s, writing its output to l.
+// It returns the output of the script.
+func runScript(script string, s *scriptJob, l *log.Logger) string {
+	ctx, cancel := context.WithTimeout(context.Background(), config.scriptTimeout())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = s.env()
+	if fi, err := os.Stat(s.dir); err == nil && fi.IsDir() {
+		cmd.Dir = s.dir
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// don't wait for children of a killed script that hold on to the output
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", config.scriptTimeout())
+	}
+	if err != nil {
+		fmt.Fprintf(&out, "script failed: %v\n", err)
+	}
+	output := out.String()
+	if len(output) > maxScriptLog {
+		output = "...\n" + output[len(output)-maxScriptLog:]
+	}
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line != "" {
+			l.Printf("%s: %s", s.name, line)
+		}
+	}
+	return output
+}
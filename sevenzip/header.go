@@ -0,0 +1,527 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package sevenzip
+
+import (
+	"encoding/binary"
+	"time"
+	"unicode/utf16"
+)
+
+// property ids
+const (
+	idEnd                   = 0x00
+	idHeader                = 0x01
+	idArchiveProperties     = 0x02
+	idAdditionalStreamsInfo = 0x03
+	idMainStreamsInfo       = 0x04
+	idFilesInfo             = 0x05
+	idPackInfo              = 0x06
+	idUnpackInfo            = 0x07
+	idSubStreamsInfo        = 0x08
+	idSize                  = 0x09
+	idCRC                   = 0x0a
+	idFolder                = 0x0b
+	idCodersUnpackSize      = 0x0c
+	idNumUnpackStream       = 0x0d
+	idEmptyStream           = 0x0e
+	idEmptyFile             = 0x0f
+	idName                  = 0x11
+	idMTime                 = 0x14
+	idWinAttributes         = 0x15
+	idEncodedHeader         = 0x17
+)
+
+// file attributes
+const (
+	attrDirectory = 0x10
+	// the high 16 bits hold a unix mode
+	attrUnixExtension = 0x8000
+	unixDir           = 0040000
+	unixTypeMask      = 0170000
+)
+
+// the most items of any kind in a header
+const maxItems = 1 << 24
+
+func (rd *Reader) readHeader(b *buf) error {
+	id := b.byte()
+	if id == idArchiveProperties {
+		for b.err == nil {
+			if b.byte() == idEnd {
+				break
+			}
+			b.bytes(b.count())
+		}
+		id = b.byte()
+	}
+	if id == idAdditionalStreamsInfo {
+		err := (&Reader{}).readStreamsInfo(b)
+		if err != nil {
+			return err
+		}
+		id = b.byte()
+	}
+	if id == idMainStreamsInfo {
+		err := rd.readStreamsInfo(b)
+		if err != nil {
+			return err
+		}
+		id = b.byte()
+	}
+	if id == idFilesInfo {
+		err := rd.readFilesInfo(b)
+		if err != nil {
+			return err
+		}
+		id = b.byte()
+	}
+	if id != idEnd || b.err != nil {
+		return ErrFormat
+	}
+	n := 0
+	for _, f := range rd.files {
+		if f.hasStream {
+			n++
+		}
+	}
+	if n != len(rd.streams) {
+		return ErrFormat
+	}
+	return nil
+}
+
+func (rd *Reader) readStreamsInfo(b *buf) error {
+	id := b.byte()
+	if id == idPackInfo {
+		pos := int64(b.number())
+		n := b.count()
+		rd.packs = make([]pack, n)
+		id = b.byte()
+		if id == idSize {
+			off := sigHeaderSize + pos
+			for i := range rd.packs {
+				rd.packs[i].offset = off
+				rd.packs[i].size = int64(b.number())
+				off += rd.packs[i].size
+			}
+			id = b.byte()
+		}
+		if id == idCRC {
+			b.digests(n)
+			id = b.byte()
+		}
+		if id != idEnd {
+			return ErrFormat
+		}
+		id = b.byte()
+	}
+	if id == idUnpackInfo {
+		err := rd.readUnpackInfo(b)
+		if err != nil {
+			return err
+		}
+		id = b.byte()
+	}
+	if id == idSubStreamsInfo {
+		err := rd.readSubStreams(b)
+		if err != nil {
+			return err
+		}
+		id = b.byte()
+	} else {
+		// without substream info, each folder holds a single file
+		for i, f := range rd.folders {
+			f.numStreams = 1
+			rd.streams = append(rd.streams, stream{
+				folder: i,
+				size:   f.size(),
+				hasCRC: f.hasCRC,
+				crc:    f.crc,
+			})
+		}
+	}
+	if id != idEnd || b.err != nil {
+		return ErrFormat
+	}
+	return nil
+}
+
+// readSubStreams reads how the data of each folder is split into files.
+func (rd *Reader) readSubStreams(b *buf) error {
+	for _, f := range rd.folders {
+		f.numStreams = 1
+	}
+	id := b.byte()
+	if id == idNumUnpackStream {
+		for _, f := range rd.folders {
+			f.numStreams = b.count()
+		}
+		id = b.byte()
+	}
+	// the size of the last stream in a folder is what is left of it
+	for i, f := range rd.folders {
+		if f.numStreams == 0 {
+			continue
+		}
+		var sum int64
+		for j := 1; j < f.numStreams; j++ {
+			if id != idSize {
+				return ErrFormat
+			}
+			s := int64(b.number())
+			rd.streams = append(rd.streams, stream{folder: i, size: s})
+			sum += s
+		}
+		if sum > f.size() || sum < 0 {
+			return ErrFormat
+		}
+		rd.streams = append(rd.streams, stream{folder: i, size: f.size() - sum})
+	}
+	if id == idSize {
+		id = b.byte()
+	}
+	// a stream that is alone in its folder has the checksum of the folder
+	n := 0
+	for _, f := range rd.folders {
+		if f.numStreams != 1 || !f.hasCRC {
+			n += f.numStreams
+		}
+	}
+	var defined []bool
+	var crcs []uint32
+	if id == idCRC {
+		defined, crcs = b.digests(n)
+		id = b.byte()
+	}
+	s, d := 0, 0
+	for _, f := range rd.folders {
+		if f.numStreams == 1 && f.hasCRC {
+			rd.streams[s].hasCRC = true
+			rd.streams[s].crc = f.crc
+			s++
+			continue
+		}
+		for j := 0; j < f.numStreams; j++ {
+			if d < len(defined) && defined[d] {
+				rd.streams[s].hasCRC = true
+				rd.streams[s].crc = crcs[d]
+			}
+			s++
+			d++
+		}
+	}
+	if id != idEnd || b.err != nil {
+		return ErrFormat
+	}
+	return nil
+}
+
+func (rd *Reader) readUnpackInfo(b *buf) error {
+	if b.byte() != idFolder {
+		return ErrFormat
+	}
+	n := b.count()
+	if b.byte() != 0 {
+		// folders stored elsewhere
+		return ErrUnsupported
+	}
+	rd.folders = make([]*folder, n)
+	pack := 0
+	for i := range rd.folders {
+		f, err := readFolder(b)
+		if err != nil {
+			return err
+		}
+		f.firstPack = pack
+		pack += f.numPacks
+		rd.folders[i] = f
+	}
+	if b.byte() != idCodersUnpackSize {
+		return ErrFormat
+	}
+	for _, f := range rd.folders {
+		for i := range f.unpackSizes {
+			f.unpackSizes[i] = int64(b.number())
+		}
+	}
+	id := b.byte()
+	if id == idCRC {
+		defined, crcs := b.digests(n)
+		for i, f := range rd.folders {
+			if i < len(defined) {
+				f.hasCRC = defined[i]
+				f.crc = crcs[i]
+			}
+		}
+		id = b.byte()
+	}
+	if id != idEnd || b.err != nil {
+		return ErrFormat
+	}
+	return nil
+}
+
+// coder flags
+const (
+	coderIDSize  = 0x0f
+	coderComplex = 0x10
+	coderProps   = 0x20
+)
+
+func readFolder(b *buf) (*folder, error) {
+	f := &folder{}
+	n := b.count()
+	numIn, numOut := 0, 0
+	for i := 0; i < n && b.err == nil; i++ {
+		flags := b.byte()
+		c := coder{id: b.bytes(int(flags & coderIDSize)), numIn: 1, numOut: 1}
+		if flags&coderComplex != 0 {
+			c.numIn = b.count()
+			c.numOut = b.count()
+		}
+		if flags&coderProps != 0 {
+			c.props = b.bytes(b.count())
+		}
+		numIn += c.numIn
+		numOut += c.numOut
+		f.coders = append(f.coders, c)
+	}
+	if numOut == 0 || numOut > maxItems {
+		return nil, ErrFormat
+	}
+	f.bound = numOut - 1
+	for i := 0; i < f.bound; i++ {
+		b.number()
+		b.number()
+	}
+	f.numPacks = numIn - f.bound
+	if f.numPacks < 1 {
+		return nil, ErrFormat
+	}
+	if f.numPacks > 1 {
+		for i := 0; i < f.numPacks; i++ {
+			b.number()
+		}
+	}
+	f.unpackSizes = make([]int64, numOut)
+	return f, b.err
+}
+
+func (rd *Reader) readFilesInfo(b *buf) error {
+	n := b.count()
+	rd.files = make([]*entry, n)
+	for i := range rd.files {
+		rd.files[i] = &entry{hasStream: true}
+	}
+	var emptyStream, emptyFile []bool
+	numEmpty := 0
+	for b.err == nil {
+		typ := b.byte()
+		if typ == idEnd {
+			break
+		}
+		d := &buf{b: b.bytes(b.count())}
+		switch typ {
+		case idEmptyStream:
+			emptyStream = d.bits(n)
+			numEmpty = 0
+			for _, e := range emptyStream {
+				if e {
+					numEmpty++
+				}
+			}
+		case idEmptyFile:
+			emptyFile = d.bits(numEmpty)
+		case idName:
+			if d.byte() != 0 {
+				return ErrUnsupported
+			}
+			for _, f := range rd.files {
+				f.Name = d.name()
+			}
+		case idMTime:
+			defined := d.defined(n)
+			if d.byte() != 0 {
+				return ErrUnsupported
+			}
+			for i, f := range rd.files {
+				if defined[i] {
+					f.ModTime = fileTime(d.uint64())
+				}
+			}
+		case idWinAttributes:
+			defined := d.defined(n)
+			if d.byte() != 0 {
+				return ErrUnsupported
+			}
+			for i, f := range rd.files {
+				if !defined[i] {
+					continue
+				}
+				attr := d.uint32()
+				if attr&attrDirectory != 0 ||
+					attr&attrUnixExtension != 0 && attr>>16&unixTypeMask == unixDir {
+					f.IsDir = true
+				}
+			}
+		}
+		if d.err != nil {
+			return ErrFormat
+		}
+	}
+	e := 0
+	for i, f := range rd.files {
+		if i < len(emptyStream) && emptyStream[i] {
+			f.hasStream = false
+			if e >= len(emptyFile) || !emptyFile[e] {
+				f.IsDir = true
+			}
+			e++
+		}
+	}
+	s := 0
+	for _, f := range rd.files {
+		if f.hasStream {
+			if s >= len(rd.streams) {
+				return ErrFormat
+			}
+			f.Size = rd.streams[s].size
+			s++
+		}
+	}
+	return b.err
+}
+
+// the difference between the Windows and Unix epochs, in 100ns units
+const windowsEpoch = 116444736000000000
+
+func fileTime(ft uint64) time.Time {
+	t := int64(ft) - windowsEpoch
+	return time.Unix(t/1e7, t%1e7*100)
+}
+
+// buf reads the fields of a header. Reading past the end sets err,
+// so that it only needs to be checked once all fields are read.
+type buf struct {
+	b   []byte
+	err error
+}
+
+func (b *buf) bytes(n int) []byte {
+	if n < 0 || n > len(b.b) {
+		b.err = ErrFormat
+		b.b = nil
+		return nil
+	}
+	p := b.b[:n]
+	b.b = b.b[n:]
+	return p
+}
+
+func (b *buf) byte() byte {
+	p := b.bytes(1)
+	if p == nil {
+		return 0
+	}
+	return p[0]
+}
+
+func (b *buf) uint32() uint32 {
+	p := b.bytes(4)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(p)
+}
+
+func (b *buf) uint64() uint64 {
+	p := b.bytes(8)
+	if p == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(p)
+}
+
+// number reads a number in the variable length encoding of 7z,
+// where the leading 1 bits of the first byte say how many bytes follow.
+func (b *buf) number() uint64 {
+	first := b.byte()
+	mask := byte(0x80)
+	var v uint64
+	for i := 0; i < 8; i++ {
+		if first&mask == 0 {
+			high := uint64(first & (mask - 1))
+			return v | high<<(8*uint(i))
+		}
+		v |= uint64(b.byte()) << (8 * uint(i))
+		mask >>= 1
+	}
+	return v
+}
+
+// count reads a number of items.
+func (b *buf) count() int {
+	n := b.number()
+	if n > maxItems {
+		b.err = ErrFormat
+		return 0
+	}
+	return int(n)
+}
+
+// bits reads a vector of n bits, most significant bit first.
+func (b *buf) bits(n int) []bool {
+	v := make([]bool, n)
+	var c byte
+	for i := range v {
+		if i%8 == 0 {
+			c = b.byte()
+		}
+		v[i] = c&(0x80>>uint(i%8)) != 0
+	}
+	return v
+}
+
+// defined reads a bit vector that is preceded by a byte saying
+// whether all bits are set.
+func (b *buf) defined(n int) []bool {
+	if b.byte() == 0 {
+		return b.bits(n)
+	}
+	v := make([]bool, n)
+	for i := range v {
+		v[i] = true
+	}
+	return v
+}
+
+// digests reads n optional CRCs.
+func (b *buf) digests(n int) ([]bool, []uint32) {
+	defined := b.defined(n)
+	crcs := make([]uint32, n)
+	for i := range crcs {
+		if defined[i] {
+			crcs[i] = b.uint32()
+		}
+	}
+	return defined, crcs
+}
+
+// name reads a zero terminated UTF-16 name.
+func (b *buf) name() string {
+	var u []uint16
+	for b.err == nil {
+		c := b.bytes(2)
+		if c == nil {
+			break
+		}
+		v := binary.LittleEndian.Uint16(c)
+		if v == 0 {
+			break
+		}
+		u = append(u, v)
+	}
+	return string(utf16.Decode(u))
+}
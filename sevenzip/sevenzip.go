@@ -0,0 +1,381 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// Package sevenzip reads 7z archives.
+//
+// Files stored uncompressed or compressed with LZMA or LZMA2 can be
+// extracted. Archives using other methods, filters or encryption are
+// listed, but reading their files returns ErrUnsupported.
+//
+// A Reader works like an archive/tar Reader, reading the files in the
+// order they are stored:
+//
+//	r, err := sevenzip.NewReader(f, size)
+//	if err != nil {
+//		return err
+//	}
+//	for {
+//		hdr, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		if err != nil {
+//			return err
+//		}
+//		// read the contents of hdr.Name from r
+//	}
+package sevenzip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/lzma"
+)
+
+var (
+	// ErrFormat is returned for data that isn't a 7z archive, or that is damaged.
+	ErrFormat = errors.New("sevenzip: not a valid 7z archive")
+	// ErrUnsupported is returned when reading files compressed with a
+	// method that this package doesn't implement.
+	ErrUnsupported = errors.New("sevenzip: unsupported compression method")
+	// ErrChecksum is returned when the contents of a file don't match its checksum.
+	ErrChecksum = errors.New("sevenzip: checksum error")
+)
+
+// FileHeader describes a file in an archive.
+type FileHeader struct {
+	// Name is the path of the file in the archive, with forward slashes.
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Reader reads the files of an archive in order.
+type Reader struct {
+	r     io.ReaderAt
+	files []*entry
+	// the pack streams, and the folders that decode them
+	packs   []pack
+	folders []*folder
+	streams []stream
+
+	// the next file and stream
+	next      int
+	nextStrm  int
+	folderIdx int
+	// reads the decoded data of the current folder
+	folder io.Reader
+	// unread bytes of the current file
+	left int64
+	// reads the contents of the current file
+	file io.Reader
+	err  error
+}
+
+// entry is a file in an archive.
+type entry struct {
+	FileHeader
+	hasStream bool
+}
+
+// pack is a stream of packed data.
+type pack struct {
+	offset, size int64
+}
+
+// coder is a decompression method, or a filter.
+type coder struct {
+	id            []byte
+	props         []byte
+	numIn, numOut int
+}
+
+// folder is a set of coders that decodes one or more pack streams
+// into the data of one or more files.
+type folder struct {
+	coders      []coder
+	bound       int
+	firstPack   int
+	numPacks    int
+	unpackSizes []int64
+	hasCRC      bool
+	crc         uint32
+	numStreams  int
+}
+
+// size returns the size of the decoded data of the folder.
+func (f *folder) size() int64 {
+	if len(f.unpackSizes) == 0 {
+		return 0
+	}
+	// the last coder outputs the final data in archives with a single
+	// chain of coders, which are the only kind that can be decoded.
+	return f.unpackSizes[len(f.unpackSizes)-1]
+}
+
+// stream is the data of a single file in a folder.
+type stream struct {
+	folder int
+	size   int64
+	hasCRC bool
+	crc    uint32
+}
+
+var signature = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+
+// the size of the signature header
+const sigHeaderSize = 32
+
+// the most header data read, to guard against broken archives.
+const maxHeaderSize = 64 << 20
+
+// NewReader returns a Reader for the archive of size bytes read from r.
+func NewReader(r io.ReaderAt, size int64) (*Reader, error) {
+	var sh [sigHeaderSize]byte
+	_, err := r.ReadAt(sh[:], 0)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if string(sh[:6]) != string(signature) {
+		return nil, ErrFormat
+	}
+	if crc32.ChecksumIEEE(sh[12:]) != binary.LittleEndian.Uint32(sh[8:]) {
+		return nil, ErrFormat
+	}
+	off := binary.LittleEndian.Uint64(sh[12:])
+	n := binary.LittleEndian.Uint64(sh[20:])
+	crc := binary.LittleEndian.Uint32(sh[28:])
+	rd := &Reader{r: r}
+	if n == 0 {
+		// an empty archive
+		return rd, nil
+	}
+	if n > maxHeaderSize || off > uint64(size) || sigHeaderSize+off+n > uint64(size) {
+		return nil, ErrFormat
+	}
+	hdr := make([]byte, n)
+	_, err = r.ReadAt(hdr, int64(sigHeaderSize+off))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(hdr) != crc {
+		return nil, ErrFormat
+	}
+	for {
+		b := &buf{b: hdr}
+		switch b.byte() {
+		case idHeader:
+			err = rd.readHeader(b)
+			if err != nil {
+				return nil, err
+			}
+			return rd, nil
+		case idEncodedHeader:
+			// the header is compressed like file data
+			hdr, err = rd.decodeHeader(b)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrFormat
+		}
+	}
+}
+
+// decodeHeader decodes a compressed header.
+func (rd *Reader) decodeHeader(b *buf) ([]byte, error) {
+	h := &Reader{r: rd.r}
+	err := h.readStreamsInfo(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.folders) == 0 || h.folders[0].size() > maxHeaderSize {
+		return nil, ErrFormat
+	}
+	f := h.folders[0]
+	r, err := h.folderReader(0)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, f.size())
+	_, err = io.ReadFull(r, hdr)
+	if err != nil {
+		return nil, ErrFormat
+	}
+	if f.hasCRC && crc32.ChecksumIEEE(hdr) != f.crc {
+		return nil, ErrFormat
+	}
+	return hdr, nil
+}
+
+// Next advances to the next file in the archive, skipping what is
+// left of the current one. It returns io.EOF at the end of the archive.
+func (rd *Reader) Next() (*FileHeader, error) {
+	if rd.err != nil {
+		return nil, rd.err
+	}
+	if rd.left > 0 && rd.folder != nil {
+		_, err := io.CopyN(ioutil.Discard, rd.folder, rd.left)
+		if err != nil {
+			// the rest of the folder can't be decoded
+			rd.folder = nil
+		}
+	}
+	rd.left = 0
+	if rd.next >= len(rd.files) {
+		rd.err = io.EOF
+		return nil, io.EOF
+	}
+	e := rd.files[rd.next]
+	rd.next++
+	hdr := e.FileHeader
+	if !e.hasStream {
+		rd.file = eofReader{}
+		return &hdr, nil
+	}
+	s := rd.streams[rd.nextStrm]
+	rd.nextStrm++
+	if rd.folder == nil || s.folder != rd.folderIdx {
+		rd.folderIdx = s.folder
+		r, err := rd.folderReader(s.folder)
+		if err != nil {
+			rd.folder = nil
+			rd.file = errReader{err}
+			return &hdr, nil
+		}
+		rd.folder = r
+	}
+	rd.left = s.size
+	rd.file = &checkReader{
+		r:   &fileReader{rd},
+		h:   crc32.NewIEEE(),
+		s:   s,
+		err: ErrChecksum,
+	}
+	return &hdr, nil
+}
+
+// Read reads from the current file. It returns io.EOF at the end of
+// the file, and ErrChecksum if the file is damaged.
+func (rd *Reader) Read(b []byte) (int, error) {
+	if rd.err != nil {
+		return 0, rd.err
+	}
+	if rd.file == nil {
+		return 0, io.EOF
+	}
+	return rd.file.Read(b)
+}
+
+// fileReader reads the current file from the folder.
+type fileReader struct {
+	rd *Reader
+}
+
+func (f *fileReader) Read(b []byte) (int, error) {
+	rd := f.rd
+	if rd.left == 0 {
+		return 0, io.EOF
+	}
+	if rd.folder == nil {
+		return 0, ErrFormat
+	}
+	if int64(len(b)) > rd.left {
+		b = b[:rd.left]
+	}
+	n, err := rd.folder.Read(b)
+	rd.left -= int64(n)
+	if err == io.EOF && rd.left > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// checkReader checks the checksum of a file once it has been read.
+type checkReader struct {
+	r   io.Reader
+	h   hash.Hash32
+	s   stream
+	err error
+}
+
+func (c *checkReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.h.Write(b[:n])
+	if err == io.EOF && c.s.hasCRC && c.h.Sum32() != c.s.crc {
+		return n, c.err
+	}
+	return n, err
+}
+
+type errReader struct{ err error }
+
+func (e errReader) Read([]byte) (int, error) { return 0, e.err }
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+// coder ids
+var (
+	idCopy  = []byte{0x00}
+	idLZMA  = []byte{0x03, 0x01, 0x01}
+	idLZMA2 = []byte{0x21}
+)
+
+// folderReader returns a reader for the decoded data of folder i.
+func (rd *Reader) folderReader(i int) (io.Reader, error) {
+	f := rd.folders[i]
+	if len(f.coders) != 1 || f.numPacks != 1 || f.coders[0].numIn != 1 || f.coders[0].numOut != 1 {
+		return nil, ErrUnsupported
+	}
+	if f.firstPack >= len(rd.packs) {
+		return nil, ErrFormat
+	}
+	p := rd.packs[f.firstPack]
+	var r io.Reader = bufio.NewReader(io.NewSectionReader(rd.r, p.offset, p.size))
+	c := f.coders[0]
+	size := f.size()
+	switch string(c.id) {
+	case string(idCopy):
+	case string(idLZMA):
+		// the dictionary never needs to be larger than the data
+		props, err := lzma.DecodeProps(c.props)
+		if err != nil {
+			return nil, err
+		}
+		if int64(props.DictSize) > size {
+			props.DictSize = uint32(size)
+		}
+		r, err = lzma.NewRawReader(r, props, size)
+		if err != nil {
+			return nil, err
+		}
+	case string(idLZMA2):
+		if len(c.props) != 1 {
+			return nil, ErrFormat
+		}
+		dict, err := lzma.DictSize2(c.props[0])
+		if err != nil {
+			return nil, err
+		}
+		if int64(dict) > size {
+			dict = uint32(size)
+		}
+		r = lzma.NewReader2(r, dict)
+	default:
+		return nil, ErrUnsupported
+	}
+	return io.LimitReader(r, size), nil
+}
@@ -0,0 +1,178 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package sevenzip_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	. "github.com/DanielMorsing/gonzbee/sevenzip"
+)
+
+// The archives in testdata were made with bsdtar, storing the files
+// uncompressed, with LZMA and with LZMA2. The LZMA2 archive also has
+// a compressed header.
+
+// words returns n bytes of random words, which compress well.
+func words(n int, seed uint32) []byte {
+	w := []string{"the ", "quick ", "brown ", "fox ", "jumps ", "over ", "lazy ", "dog ", "\n"}
+	var b []byte
+	x := seed
+	for len(b) < n {
+		x = x*1103515245 + 12345
+		b = append(b, w[(x>>16)%9]...)
+	}
+	return b[:n]
+}
+
+// noise returns n bytes that don't compress.
+func noise(n int, seed uint32) []byte {
+	b := make([]byte, n)
+	x := seed
+	for i := range b {
+		x = x*1103515245 + 12345
+		b[i] = byte(x >> 24)
+	}
+	return b
+}
+
+var contents = map[string][]byte{
+	"dir/hello.txt": []byte("Hello, world!\n"),
+	"words.txt":     words(50000, 1),
+	"noise.bin":     noise(3000, 2),
+	"empty.txt":     {},
+}
+
+var modTime = time.Date(2013, 5, 17, 14, 32, 10, 0, time.UTC)
+
+func open(t *testing.T, name string) (*Reader, []byte) {
+	b, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, b
+}
+
+func TestRead(t *testing.T) {
+	for _, name := range []string{"copy.7z", "lzma1.7z", "lzma2.7z"} {
+		r, _ := open(t, name)
+		seen := 0
+		sawDir := false
+		for {
+			hdr, err := r.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !hdr.ModTime.Equal(modTime) {
+				t.Errorf("%s: %s: bad time %v", name, hdr.Name, hdr.ModTime)
+			}
+			if hdr.IsDir {
+				if hdr.Name != "dir" {
+					t.Errorf("%s: unexpected directory %s", name, hdr.Name)
+				}
+				sawDir = true
+				continue
+			}
+			exp, ok := contents[hdr.Name]
+			if !ok {
+				t.Errorf("%s: unexpected file %s", name, hdr.Name)
+				continue
+			}
+			seen++
+			if hdr.Size != int64(len(exp)) {
+				t.Errorf("%s: %s: size %d, want %d", name, hdr.Name, hdr.Size, len(exp))
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Errorf("%s: %s: %v", name, hdr.Name, err)
+			}
+			if !bytes.Equal(got, exp) {
+				t.Errorf("%s: %s: contents differ", name, hdr.Name)
+			}
+		}
+		if seen != len(contents) || !sawDir {
+			t.Errorf("%s: saw %d files, directory %v", name, seen, sawDir)
+		}
+	}
+}
+
+func TestSkip(t *testing.T) {
+	// skipping files has to keep the position in solid folders
+	r, _ := open(t, "lzma1.7z")
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "noise.bin" {
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents["noise.bin"]) {
+			t.Error("contents differ")
+		}
+		return
+	}
+	t.Error("noise.bin not found")
+}
+
+func TestChecksum(t *testing.T) {
+	_, b := open(t, "copy.7z")
+	// damage the stored words, which follow the signature header
+	i := bytes.Index(b, contents["words.txt"][:100])
+	if i < 0 {
+		t.Fatal("words not found")
+	}
+	b[i+50] ^= 0xff
+	r, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		hdr, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != "words.txt" {
+			continue
+		}
+		_, err = ioutil.ReadAll(r)
+		if err != ErrChecksum {
+			t.Errorf("expected %v, got %v", ErrChecksum, err)
+		}
+		return
+	}
+}
+
+func TestNot7z(t *testing.T) {
+	b := []byte("this is not an archive, but it is long enough to have a header")
+	_, err := NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != ErrFormat {
+		t.Errorf("expected %v, got %v", ErrFormat, err)
+	}
+
+	// a damaged header
+	_, b = open(t, "copy.7z")
+	b[len(b)-10] ^= 0xff
+	_, err = NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != ErrFormat {
+		t.Errorf("expected %v for damaged header, got %v", ErrFormat, err)
+	}
+}
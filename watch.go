@@ -0,0 +1,142 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+// This file contains the watch directory, where NZB files dropped in
+// are added to the daemon queue.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+const (
+	watchInterval = 5 * time.Second
+	// files modified more recently than this might still be being written
+	watchSettle = 2 * time.Second
+)
+
+// subdirectories of the watch directory that processed NZB files are moved to
+const (
+	watchDone   = "done"
+	watchFailed = "failed"
+)
+
+// watch polls dir for new NZB files and adds them to q until stopping is closed.
+// If categories is set, files in subdirectories of dir are also picked up,
+// with the name of the subdirectory as their category.
+func watch(q *queue.Queue, dir string, categories bool, stopping <-chan struct{}) {
+	tick := time.NewTicker(watchInterval)
+	defer tick.Stop()
+	for {
+		err := scanWatchDir(q, dir, categories)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		select {
+		case <-tick.C:
+		case <-stopping:
+			return
+		}
+	}
+}
+
+func scanWatchDir(q *queue.Queue, dir string, categories bool) error {
+	queued := make(map[string]bool)
+	for _, it := range q.Items() {
+		if it.Source != "" && !it.Status.Finished() {
+			queued[it.Source] = true
+		}
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() {
+			if !categories || name == watchDone || name == watchFailed || strings.HasPrefix(name, ".") {
+				continue
+			}
+			sub, err := ioutil.ReadDir(filepath.Join(dir, name))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			for _, sfi := range sub {
+				path := filepath.Join(dir, name, sfi.Name())
+				if isNewNzb(sfi, now) && !queued[path] {
+					watchEnqueue(q, dir, path, name)
+				}
+			}
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if isNewNzb(fi, now) && !queued[path] {
+			watchEnqueue(q, dir, path, "")
+		}
+	}
+	return nil
+}
+
+func isNewNzb(fi os.FileInfo, now time.Time) bool {
+	return fi.Mode().IsRegular() &&
+		strings.HasSuffix(strings.ToLower(fi.Name()), ".nzb") &&
+		now.Sub(fi.ModTime()) > watchSettle
+}
+
+func watchEnqueue(q *queue.Queue, watchDir, path, category string) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	it := queue.Item{
+		Name:     nzbName(path),
+		Priority: *priority,
+		Category: category,
+		Source:   path,
+	}
+	_, err = addNzb(q, it, b, priorityFlagSet())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		moveProcessed(watchDir, path, false)
+	}
+}
+
+// moveProcessed moves an NZB file picked up from the watch directory
+// into the done or failed subdirectory.
+func moveProcessed(watchDir, path string, ok bool) {
+	sub := watchFailed
+	if ok {
+		sub = watchDone
+	}
+	dir := filepath.Join(watchDir, sub)
+	err := os.MkdirAll(dir, 0777)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	dst := filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s.%d%s", strings.TrimSuffix(base, ext), i, ext))
+	}
+	err = os.Rename(path, dst)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
@@ -0,0 +1,160 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DanielMorsing/gonzbee/queue"
+)
+
+// writeNzb writes an NZB file to path that is old enough to be picked up.
+func writeNzb(t *testing.T, path string) {
+	err := os.MkdirAll(filepath.Dir(path), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, []byte(testNzb), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sources(q *queue.Queue) []string {
+	var srcs []string
+	for _, it := range q.Items() {
+		srcs = append(srcs, it.Source)
+	}
+	sort.Strings(srcs)
+	return srcs
+}
+
+func TestScanWatchDir(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, &Config{WatchDir: dir, DownloadDir: t.TempDir()})
+	r := newTestRunner(t)
+	writeNzb(t, filepath.Join(dir, "first.nzb"))
+	writeNzb(t, filepath.Join(dir, "tv", "second.NZB"))
+	writeNzb(t, filepath.Join(dir, watchDone, "done.nzb"))
+	writeNzb(t, filepath.Join(dir, watchFailed, "failed.nzb"))
+	// not an NZB file, and one that might still be being written
+	writeNzb(t, filepath.Join(dir, "notes.txt"))
+	err := ioutil.WriteFile(filepath.Join(dir, "new.nzb"), []byte(testNzb), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = scanWatchDir(r.q, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srcs := sources(r.q); len(srcs) != 1 || srcs[0] != filepath.Join(dir, "first.nzb") {
+		t.Fatalf("got %v", srcs)
+	}
+	// files already queued aren't added again
+	err = scanWatchDir(r.q, dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcs := sources(r.q)
+	if len(srcs) != 2 || srcs[1] != filepath.Join(dir, "tv", "second.NZB") {
+		t.Fatalf("got %v", srcs)
+	}
+	for _, it := range r.q.Items() {
+		if it.Source == srcs[1] && (it.Category != "tv" || it.Name != "second") {
+			t.Errorf("got category %q and name %q", it.Category, it.Name)
+		}
+	}
+}
+
+func TestScanWatchDirInvalid(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, &Config{WatchDir: dir})
+	r := newTestRunner(t)
+	path := filepath.Join(dir, "broken.nzb")
+	err := ioutil.WriteFile(path, []byte("<nzb/>"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Minute)
+	err = os.Chtimes(path, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = scanWatchDir(r.q, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.q.Items()) != 0 {
+		t.Error("invalid NZB file was queued")
+	}
+	if _, err := os.Stat(filepath.Join(dir, watchFailed, "broken.nzb")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMoveProcessed(t *testing.T) {
+	dir := t.TempDir()
+	for i, ok := range []bool{true, true, false} {
+		path := filepath.Join(dir, "tv", "show.nzb")
+		writeNzb(t, path)
+		moveProcessed(dir, path, ok)
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%d: file wasn't moved", i)
+		}
+	}
+	// names already taken get a number
+	for _, name := range []string{
+		filepath.Join(watchDone, "show.nzb"),
+		filepath.Join(watchDone, "show.1.nzb"),
+		filepath.Join(watchFailed, "show.nzb"),
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCancelWatched(t *testing.T) {
+	dir := t.TempDir()
+	setConfig(t, &Config{WatchDir: dir, DownloadDir: t.TempDir()})
+	r := newTestRunner(t)
+	path := filepath.Join(dir, "cancel.nzb")
+	writeNzb(t, path)
+	err := scanWatchDir(r.q, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := r.q.Items()
+	if len(items) != 1 {
+		t.Fatalf("got %d items", len(items))
+	}
+
+	err = r.cancel(items[0].ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, watchFailed, "cancel.nzb")); err != nil {
+		t.Fatal(err)
+	}
+	// and it isn't picked up again
+	err = scanWatchDir(r.q, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.q.Items()) != 0 {
+		t.Error("cancelled job was queued again")
+	}
+}
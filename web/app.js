@@ -0,0 +1,203 @@
+// The gonzbee web interface. Everything goes through the JSON API,
+// see api.go for the endpoints.
+"use strict";
+
+const refreshInterval = 1000;
+
+let apiKey = new URLSearchParams(location.search).get("apikey") || localStorage.getItem("apikey") || "";
+
+async function api(method, path, body) {
+	const resp = await fetch(path, {method: method, body: body, headers: {"X-Api-Key": apiKey}});
+	if (resp.status === 401) {
+		apiKey = prompt("API key") || "";
+		localStorage.setItem("apikey", apiKey);
+		throw new Error("unauthorized");
+	}
+	if (resp.status === 204) {
+		return null;
+	}
+	const v = await resp.json();
+	if (!resp.ok) {
+		throw new Error(v.Error);
+	}
+	return v;
+}
+
+function humanBytes(n) {
+	const units = ["B", "KiB", "MiB", "GiB", "TiB"];
+	let i = 0;
+	while (n >= 1024 && i < units.length - 1) {
+		n /= 1024;
+		i++;
+	}
+	return (i === 0 ? n : n.toFixed(1)) + " " + units[i];
+}
+
+function cell(tr, text, cls) {
+	const td = document.createElement("td");
+	td.textContent = text;
+	if (cls) {
+		td.className = cls;
+	}
+	tr.appendChild(td);
+	return td;
+}
+
+function button(td, label, action) {
+	const b = document.createElement("button");
+	b.textContent = label;
+	b.onclick = () => action().then(refresh, showError);
+	td.appendChild(b);
+}
+
+function progressBar(td, done, total) {
+	const bar = document.createElement("div");
+	bar.className = "bar";
+	const fill = document.createElement("div");
+	fill.style.width = (total ? 100 * done / total : 0) + "%";
+	bar.appendChild(fill);
+	td.appendChild(bar);
+}
+
+function showError(err) {
+	console.error(err);
+}
+
+function renderQueue(jobs) {
+	const tbody = document.querySelector("#queue tbody");
+	tbody.textContent = "";
+	for (const job of jobs) {
+		if (job.Status === "done" || job.Status === "failed") {
+			continue;
+		}
+		const tr = document.createElement("tr");
+		cell(tr, job.Name);
+		cell(tr, job.Category || "");
+		const prio = cell(tr, job.Priority + " ");
+		button(prio, "+", () => api("POST", "/api/jobs/" + job.ID + "/priority?priority=" + (job.Priority + 1)));
+		button(prio, "-", () => api("POST", "/api/jobs/" + job.ID + "/priority?priority=" + (job.Priority - 1)));
+		cell(tr, job.Status);
+		const done = job.Progress ? job.Progress.BytesDone : 0;
+		progressBar(cell(tr, ""), done, job.Bytes);
+		cell(tr, humanBytes(job.Bytes || 0));
+		const actions = cell(tr, "", "actions");
+		if (job.Status === "paused") {
+			button(actions, "Resume", () => api("POST", "/api/jobs/" + job.ID + "/resume"));
+		} else {
+			button(actions, "Pause", () => api("POST", "/api/jobs/" + job.ID + "/pause"));
+		}
+		button(actions, "Cancel", () => {
+			if (!confirm("Cancel " + job.Name + " and delete its files?")) {
+				return Promise.resolve();
+			}
+			return api("DELETE", "/api/jobs/" + job.ID + "?delete=1");
+		});
+		tbody.appendChild(tr);
+	}
+}
+
+function renderHistory(jobs) {
+	const tbody = document.querySelector("#history tbody");
+	tbody.textContent = "";
+	for (const job of jobs) {
+		if (job.Status !== "done" && job.Status !== "failed") {
+			continue;
+		}
+		const tr = document.createElement("tr");
+		cell(tr, job.Name);
+		cell(tr, job.Category || "");
+		const st = cell(tr, job.Status + (job.Error ? ": " + job.Error : ""));
+		if (job.Status === "failed") {
+			st.className = "failed";
+		}
+		cell(tr, humanBytes(job.Bytes || 0));
+		cell(tr, new Date(job.Finished).toLocaleString());
+		const actions = cell(tr, "", "actions");
+		button(actions, "Remove", () => api("DELETE", "/api/jobs/" + job.ID));
+		tbody.appendChild(tr);
+	}
+}
+
+function renderStatus(st) {
+	let speed = humanBytes(st.Speed) + "/s";
+	if (st.Limits.Total) {
+		speed += " (limit " + humanBytes(st.Limits.Total) + "/s)";
+	}
+	document.getElementById("speed").textContent = speed;
+	const pause = document.getElementById("pause");
+	pause.textContent = st.Paused ? "Resume" : "Pause";
+	pause.onclick = () => api("POST", st.Paused ? "/api/resume" : "/api/pause").then(refresh, showError);
+	drawGraph(st.SpeedHistory);
+}
+
+function drawGraph(speeds) {
+	const canvas = document.getElementById("graph");
+	canvas.width = canvas.clientWidth;
+	const ctx = canvas.getContext("2d");
+	const w = canvas.width, h = canvas.height;
+	ctx.clearRect(0, 0, w, h);
+	if (speeds.length < 2) {
+		return;
+	}
+	const max = Math.max(...speeds, 1);
+	ctx.beginPath();
+	ctx.moveTo(0, h);
+	speeds.forEach((s, i) => {
+		ctx.lineTo(i * w / (speeds.length - 1), h - s * (h - 4) / max);
+	});
+	ctx.lineTo(w, h);
+	ctx.fillStyle = "#cfe8dc";
+	ctx.fill();
+	ctx.fillStyle = "#222";
+	ctx.fillText("max " + humanBytes(max) + "/s", 4, 12);
+}
+
+function renderLog(lines) {
+	const pre = document.getElementById("log");
+	const atBottom = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 2;
+	pre.textContent = lines.map(l => new Date(l.Time).toLocaleTimeString() + " " + l.Text).join("\n");
+	if (atBottom) {
+		pre.scrollTop = pre.scrollHeight;
+	}
+}
+
+async function refresh() {
+	try {
+		const [jobs, st, log] = await Promise.all([api("GET", "/api/jobs"), api("GET", "/api/status"), api("GET", "/api/log")]);
+		renderQueue(jobs);
+		renderHistory(jobs);
+		renderStatus(st);
+		renderLog(log);
+	} catch (err) {
+		showError(err);
+	}
+}
+
+document.getElementById("upload").onsubmit = async (ev) => {
+	ev.preventDefault();
+	const files = document.getElementById("nzb").files;
+	for (const f of files) {
+		const form = new FormData();
+		form.append("nzb", f);
+		form.append("category", document.getElementById("category").value);
+		try {
+			await api("POST", "/api/jobs", form);
+		} catch (err) {
+			alert(f.name + ": " + err.message);
+		}
+	}
+	document.getElementById("nzb").value = "";
+	refresh();
+};
+
+api("GET", "/api/categories").then(cats => {
+	const list = document.getElementById("categories");
+	for (const c of cats) {
+		const opt = document.createElement("option");
+		opt.value = c.Name;
+		list.appendChild(opt);
+	}
+}, showError);
+
+refresh();
+setInterval(refresh, refreshInterval);
@@ -0,0 +1,73 @@
+//Copyright 2013, Daniel Morsing
+//For licensing information, See the LICENSE file
+
+package yenc
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Header describes the part written by Encode.
+// For single part encodings, leave Number and NumParts as zero.
+type Header struct {
+	Filename string
+	// Size is the size of the entire file, not this part.
+	Size     int64
+	Begin    int64
+	Number   int
+	NumParts int
+}
+
+const lineLength = 128
+
+// Encode writes data as a yEnc encoded part described by h to w.
+func Encode(w io.Writer, h *Header, data []byte) error {
+	bw := bufio.NewWriter(w)
+	multipart := h.Number != 0 || h.NumParts != 0
+	if multipart {
+		fmt.Fprintf(bw, "=ybegin part=%d total=%d line=%d size=%d name=%s\n", h.Number, h.NumParts, lineLength, h.Size, h.Filename)
+		fmt.Fprintf(bw, "=ypart begin=%d end=%d\n", h.Begin+1, h.Begin+int64(len(data)))
+	} else {
+		fmt.Fprintf(bw, "=ybegin line=%d size=%d name=%s\n", lineLength, len(data), h.Filename)
+	}
+
+	col := 0
+	for i, b := range data {
+		c := b + 42
+		escape := false
+		switch c {
+		case 0, '\n', '\r', '=':
+			escape = true
+		case '\t', ' ':
+			// whitespace gets eaten by some servers at the start and end of lines
+			escape = col == 0 || col >= lineLength-1 || i == len(data)-1
+		case '.':
+			escape = col == 0
+		}
+		if escape {
+			bw.WriteByte('=')
+			c += 64
+			col++
+		}
+		bw.WriteByte(c)
+		col++
+		if col >= lineLength {
+			bw.WriteByte('\n')
+			col = 0
+		}
+	}
+	if col != 0 {
+		bw.WriteByte('\n')
+	}
+
+	crc := crc32.ChecksumIEEE(data)
+	if multipart {
+		fmt.Fprintf(bw, "=yend size=%d part=%d pcrc32=%08x\n", len(data), h.Number, crc)
+	} else {
+		fmt.Fprintf(bw, "=yend size=%d crc32=%08x\n", len(data), crc)
+	}
+	return bw.Flush()
+}
@@ -4,6 +4,7 @@
 package yenc_test
 
 import (
+	"bytes"
 	. "github.com/DanielMorsing/gonzbee/yenc"
 	"io/ioutil"
 	"os"
@@ -110,3 +111,46 @@ func TestMultipartDecode(t *testing.T) {
 	}
 
 }
+
+func TestEncodeRoundtrip(t *testing.T) {
+	exp, err := ioutil.ReadFile("testdata/joystick.jpg")
+	checkErr(t, err)
+
+	// single part
+	var buf bytes.Buffer
+	err = Encode(&buf, &Header{Filename: "joystick.jpg"}, exp)
+	checkErr(t, err)
+	yenc, err := NewPart(&buf)
+	checkErr(t, err)
+	checkPart(t, yenc, &testYenc{begin: 0, size: int64(len(exp)), name: "joystick.jpg"})
+	dec, err := ioutil.ReadAll(yenc)
+	checkErr(t, err)
+	if !bytes.Equal(dec, exp) {
+		t.Errorf("binaries differ")
+	}
+
+	// multipart
+	split := 11250
+	var decoded []byte
+	for i, data := range [][]byte{exp[:split], exp[split:]} {
+		buf.Reset()
+		h := &Header{
+			Filename: "joystick.jpg",
+			Size:     int64(len(exp)),
+			Begin:    int64(i * split),
+			Number:   i + 1,
+			NumParts: 2,
+		}
+		err = Encode(&buf, h, data)
+		checkErr(t, err)
+		yenc, err := NewPart(&buf)
+		checkErr(t, err)
+		checkPart(t, yenc, &testYenc{begin: h.Begin, size: int64(len(data)), name: "joystick.jpg", number: i + 1})
+		dec, err := ioutil.ReadAll(yenc)
+		checkErr(t, err)
+		decoded = append(decoded, dec...)
+	}
+	if !bytes.Equal(decoded, exp) {
+		t.Errorf("binaries differ")
+	}
+}